@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// awsOptions pick account, region and endpoint, empty ones are left to SDK defaults,
+// so AWS_PROFILE, AWS_REGION and AWS_ENDPOINT_URL keep working
+type awsOptions struct {
+	profile     string
+	region      string
+	endpointURL string
+	// role to assume on top of profile credentials
+	roleArn         string
+	roleSessionName string
+	externalId      string
+	mfaSerial       string
+}
+
+type stsClient interface {
+	GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+func (o *awsOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.profile, "profile", "", "String, shared config profile, AWS_PROFILE env")
+	flags.StringVar(&o.region, "region", "", "String, AWS region, AWS_REGION env")
+	flags.StringVar(&o.endpointURL, "endpoint-url", "", "String, endpoint URL override, e.g. of local emulator, AWS_ENDPOINT_URL env")
+	flags.StringVar(&o.roleArn, "role-arn", os.Getenv("AWS_ASSUME_ROLE_ARN"), "String, ARN of role to assume, AWS_ASSUME_ROLE_ARN env")
+	flags.StringVar(&o.roleSessionName, "role-session-name", envOrDefault("AWS_ROLE_SESSION_NAME", "golang-ec2"), "String, session name of assumed role, AWS_ROLE_SESSION_NAME env")
+	flags.StringVar(&o.externalId, "external-id", os.Getenv("AWS_EXTERNAL_ID"), "String, external ID required by assumed role, AWS_EXTERNAL_ID env")
+	flags.StringVar(&o.mfaSerial, "mfa-serial", os.Getenv("AWS_MFA_SERIAL"), "String, MFA device serial or ARN, token code is asked on stdin, AWS_MFA_SERIAL env")
+}
+
+// loadAwsConfig builds SDK config from options, assumed role credentials are cached and refreshed by SDK
+func loadAwsConfig(ctx context.Context, o awsOptions, callTimeout time.Duration) (aws.Config, error) {
+	loadOptions := []func(*config.LoadOptions) error{}
+	if o.profile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(o.profile))
+	}
+	if o.region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(o.region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return cfg, err
+	}
+	if o.endpointURL != "" {
+		cfg.BaseEndpoint = aws.String(o.endpointURL)
+	}
+	// every client built from config gets it, STS one assuming role included
+	if callTimeout > 0 {
+		cfg.APIOptions = append(cfg.APIOptions, withCallTimeout(callTimeout))
+	}
+
+	if o.roleArn != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), o.roleArn, func(options *stscreds.AssumeRoleOptions) {
+			options.RoleSessionName = o.roleSessionName
+			if o.externalId != "" {
+				options.ExternalID = aws.String(o.externalId)
+			}
+			if o.mfaSerial != "" {
+				options.SerialNumber = aws.String(o.mfaSerial)
+				options.TokenProvider = stscreds.StdinTokenProvider
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	return cfg, nil
+}
+
+// whoami logs account and ARN requests are made as, so it's clear where resources will land
+func whoami(ctx context.Context, stsClient stsClient) (*sts.GetCallerIdentityOutput, error) {
+	identity, err := stsClient.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, fmt.Errorf("getting caller identity: %w", err)
+	}
+
+	slog.Info("Running as account " + aws.ToString(identity.Account) + ", " + aws.ToString(identity.Arn))
+	return identity, nil
+}
+
+// whoamiCommand only prints identity, it's what every mutating command checks first
+func whoamiCommand(ctx context.Context, app *app) error {
+	_, err := whoami(ctx, app.stsClient)
+	return err
+}
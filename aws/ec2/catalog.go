@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	// OS and architecture of default spec, the tool launched Ubuntu Jammy before the catalog existed
+	defaultOS   string = "ubuntu-22.04"
+	defaultArch string = "amd64"
+
+	canonicalsId string = "099720109477"
+	// SSH user of images that don't come from the catalog
+	fallbackSSHUser string = "ec2-user"
+)
+
+// osImage is a family of images, like Ubuntu 24.04, and how to find the newest one for an architecture
+type osImage struct {
+	Owner string `json:"owner"`
+	// {{arch}} is replaced with architecture spelled the way the publisher does it
+	NamePattern string `json:"namePattern"`
+	SSHUser     string `json:"sshUser"`
+	// architecture as given to -arch, amd64 or arm64, to publisher's spelling
+	Architectures map[string]string `json:"architectures"`
+}
+
+// ec2Architectures maps -arch values to architecture filter of DescribeImages
+var ec2Architectures = map[string]string{
+	"amd64": "x86_64",
+	"arm64": "arm64",
+}
+
+// osCatalog is built-in catalog, -os-catalog file adds to it or overrides its entries
+var osCatalog = map[string]osImage{
+	"ubuntu-20.04": {
+		Owner:         canonicalsId,
+		NamePattern:   "ubuntu/images/hvm-ssd/ubuntu-focal-20.04-{{arch}}-server-*",
+		SSHUser:       "ubuntu",
+		Architectures: map[string]string{"amd64": "amd64", "arm64": "arm64"},
+	},
+	"ubuntu-22.04": {
+		Owner:         canonicalsId,
+		NamePattern:   "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-{{arch}}-server-*",
+		SSHUser:       "ubuntu",
+		Architectures: map[string]string{"amd64": "amd64", "arm64": "arm64"},
+	},
+	"ubuntu-24.04": {
+		Owner:         canonicalsId,
+		NamePattern:   "ubuntu/images/hvm-ssd-gp3/ubuntu-noble-24.04-{{arch}}-server-*",
+		SSHUser:       "ubuntu",
+		Architectures: map[string]string{"amd64": "amd64", "arm64": "arm64"},
+	},
+	"debian-12": {
+		Owner:         "136693071363",
+		NamePattern:   "debian-12-{{arch}}-*",
+		SSHUser:       "admin",
+		Architectures: map[string]string{"amd64": "amd64", "arm64": "arm64"},
+	},
+	"al2023": {
+		Owner:         "137112412989",
+		NamePattern:   "al2023-ami-2023.*-kernel-*-{{arch}}",
+		SSHUser:       "ec2-user",
+		Architectures: map[string]string{"amd64": "x86_64", "arm64": "arm64"},
+	},
+	"rocky-9": {
+		Owner:         "792107900819",
+		NamePattern:   "Rocky-9-EC2-Base-9.*.{{arch}}",
+		SSHUser:       "rocky",
+		Architectures: map[string]string{"amd64": "x86_64", "arm64": "aarch64"},
+	},
+}
+
+// lookupOS returns catalog entry and image name pattern for OS and architecture, empty arch means amd64
+func lookupOS(name string, arch string) (osImage, string, error) {
+	image, ok := osCatalog[name]
+	if !ok {
+		return osImage{}, "", fmt.Errorf("unknown OS %q, expected one of: %s", name, strings.Join(catalogNames(), ", "))
+	}
+
+	if arch == "" {
+		arch = defaultArch
+	}
+	if _, ok := ec2Architectures[arch]; !ok {
+		return osImage{}, "", fmt.Errorf("unknown architecture %q, expected amd64 or arm64", arch)
+	}
+	publisherArch, ok := image.Architectures[arch]
+	if !ok {
+		return osImage{}, "", fmt.Errorf("OS %s isn't available for architecture %q", name, arch)
+	}
+
+	return image, strings.ReplaceAll(image.NamePattern, "{{arch}}", publisherArch), nil
+}
+
+func catalogNames() []string {
+	names := []string{}
+	for name := range osCatalog {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// loadOsCatalog adds OS families from JSON file to the catalog, same names replace built-in ones
+func loadOsCatalog(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	catalogFile, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	extra := map[string]osImage{}
+	err = json.Unmarshal(catalogFile, &extra)
+	if err != nil {
+		return fmt.Errorf("parsing OS catalog %s: %w", path, err)
+	}
+
+	for name, image := range extra {
+		if image.Owner == "" || image.NamePattern == "" || len(image.Architectures) == 0 {
+			return fmt.Errorf("OS %s in catalog %s needs owner, namePattern and architectures", name, path)
+		}
+		osCatalog[name] = image
+	}
+
+	return nil
+}
+
+// sshUser is login user of images picked by selector, for selectors without OS it's guessed by image owner
+func (s imageSelector) sshUser() string {
+	if image, ok := osCatalog[s.OS]; ok && image.SSHUser != "" {
+		return image.SSHUser
+	}
+
+	for _, name := range catalogNames() {
+		if osCatalog[name].Owner == s.Owner && osCatalog[name].SSHUser != "" {
+			return osCatalog[name].SSHUser
+		}
+	}
+
+	return fallbackSSHUser
+}
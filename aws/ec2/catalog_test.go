@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestDefaultSpecImage(t *testing.T) {
+	// changing default selector would change spec hash and orphan already launched instances
+	expected := imageSelector{Owner: canonicalsId, Name: "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-*"}
+	if image := defaultSpec().Image; image.Owner != expected.Owner || image.Name != expected.Name || image.OS != "" {
+		t.Errorf("default image selector is %+v, expected %+v", image, expected)
+	}
+}
+
+func TestLookupOS(t *testing.T) {
+	image, namePattern, err := lookupOS("ubuntu-24.04", "arm64")
+	if err != nil {
+		t.Fatal("Error looking up OS: " + err.Error())
+	}
+	if image.Owner != canonicalsId || namePattern != "ubuntu/images/hvm-ssd-gp3/ubuntu-noble-24.04-arm64-server-*" || image.SSHUser != "ubuntu" {
+		t.Errorf("ubuntu-24.04 arm64 resolved to %+v %s", image, namePattern)
+	}
+
+	_, namePattern, _ = lookupOS("rocky-9", "arm64")
+	if namePattern != "Rocky-9-EC2-Base-9.*.aarch64" {
+		t.Errorf("rocky-9 arm64 name pattern is %s", namePattern)
+	}
+
+	_, _, err = lookupOS("windows-2022", "")
+	if err == nil {
+		t.Error("unknown OS should fail")
+	}
+	_, _, err = lookupOS("debian-12", "riscv64")
+	if err == nil {
+		t.Error("unknown architecture should fail")
+	}
+}
+
+func TestFindImageByOS(t *testing.T) {
+	ec2Client := &mockEc2Client{
+		describeImagesOutput: &ec2.DescribeImagesOutput{Images: []types.Image{{ImageId: aws.String(mockImageId)}}},
+	}
+
+	_, err := findImage(context.TODO(), ec2Client, imageSelector{OS: "al2023", Arch: "arm64"})
+	if err != nil {
+		t.Fatal("Error finding image: " + err.Error())
+	}
+
+	input := ec2Client.describeImagesInput
+	if input.Owners[0] != "137112412989" {
+		t.Errorf("owner is %s, expected Amazon", input.Owners[0])
+	}
+	filters := map[string]string{}
+	for _, filter := range input.Filters {
+		filters[aws.ToString(filter.Name)] = filter.Values[0]
+	}
+	if filters["name"] != "al2023-ami-2023.*-kernel-*-arm64" || filters["architecture"] != "arm64" {
+		t.Errorf("filters are %v", filters)
+	}
+}
+
+func TestSelectOS(t *testing.T) {
+	spec := defaultSpec()
+	err := spec.selectOS("debian-12", "arm64")
+	if err != nil {
+		t.Fatal("Error selecting OS: " + err.Error())
+	}
+	if spec.Image.OS != "debian-12" || spec.Image.Arch != "arm64" || spec.Image.sshUser() != "admin" {
+		t.Errorf("image selector is %+v", spec.Image)
+	}
+
+	spec = defaultSpec()
+	if spec.Image.sshUser() != "ubuntu" {
+		t.Errorf("SSH user of default image is %s, expected ubuntu", spec.Image.sshUser())
+	}
+	err = spec.selectOS("", "arm64")
+	if err == nil {
+		t.Error("-arch without OS should fail")
+	}
+}
+
+func TestLoadOsCatalog(t *testing.T) {
+	catalogPath := filepath.Join(t.TempDir(), "catalog.json")
+	err := os.WriteFile(catalogPath, []byte(`{"fedora-40": {"owner": "125523088429", "namePattern": "Fedora-Cloud-Base-40-*.{{arch}}-hvm-*", "sshUser": "fedora", "architectures": {"amd64": "x86_64"}}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delete(osCatalog, "fedora-40")
+
+	err = loadOsCatalog(catalogPath)
+	if err != nil {
+		t.Fatal("Error loading OS catalog: " + err.Error())
+	}
+
+	_, namePattern, err := lookupOS("fedora-40", "")
+	if err != nil || namePattern != "Fedora-Cloud-Base-40-*.x86_64-hvm-*" {
+		t.Errorf("fedora-40 resolved to %s (%v)", namePattern, err)
+	}
+}
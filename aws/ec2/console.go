@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// consoleOverlap caps how much of the start of fresh output is looked for in printed one when following,
+// console output is a rolling buffer, not a stream, its start moves as new lines come in
+const consoleOverlap int = 1024
+
+func consoleCommand(flags *flag.FlagSet) func(ctx context.Context, app *app) error {
+	var (
+		instance   string
+		latest     bool
+		follow     bool
+		interval   time.Duration
+		screenshot string
+	)
+	flags.StringVar(&instance, "instance", "", "String, instance ID or Name tag, the only instance of the spec from state if empty")
+	flags.BoolVar(&latest, "latest", false, "Bool, fetch the most recent output, only supported by Nitro instances")
+	flags.BoolVar(&follow, "follow", false, "Bool, keep polling and print new output till interrupted")
+	flags.DurationVar(&interval, "interval", 10*time.Second, "Duration, how often to poll with -follow")
+	flags.StringVar(&screenshot, "screenshot", "", "String, save console screenshot to this JPEG file instead of printing output")
+
+	return func(ctx context.Context, app *app) error {
+		instanceId, err := resolveInstance(ctx, app, instance)
+		if err != nil {
+			return err
+		}
+
+		if screenshot != "" {
+			err = saveConsoleScreenshot(ctx, app.ec2Client, instanceId, screenshot)
+			if err != nil {
+				return err
+			}
+
+			slog.Info("Screenshot of " + instanceId + " saved to " + screenshot)
+			return nil
+		}
+
+		if follow {
+			return followConsoleOutput(ctx, app.ec2Client, os.Stdout, instanceId, latest, interval)
+		}
+
+		output, err := consoleOutput(ctx, app.ec2Client, instanceId, latest)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.WriteString(os.Stdout, output)
+		return err
+	}
+}
+
+// resolveInstance turns instance ID or Name tag into ID, empty reference means the only instance of the spec in state
+func resolveInstance(ctx context.Context, app *app, reference string) (string, error) {
+	if reference == "" {
+		instanceRecord, err := managedInstance(app, "")
+		return instanceRecord.ID, err
+	}
+	if strings.HasPrefix(reference, "i-") {
+		return reference, nil
+	}
+
+	instanceIds := []string{}
+	err := eachInstance(ctx, app.ec2Client, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("tag:Name"), Values: []string{reference}},
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}},
+		},
+	}, func(instance types.Instance) bool {
+		instanceIds = append(instanceIds, aws.ToString(instance.InstanceId))
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+
+	switch len(instanceIds) {
+	case 0:
+		return "", fmt.Errorf("no instance named %s", reference)
+	case 1:
+		return instanceIds[0], nil
+	default:
+		return "", fmt.Errorf("%d instances named %s: %s, pick one by ID", len(instanceIds), reference, strings.Join(instanceIds, ", "))
+	}
+}
+
+// consoleOutput returns decoded console output, it's empty till instance has written something
+func consoleOutput(ctx context.Context, ec2Client ec2Client, instanceId string, latest bool) (string, error) {
+	input := &ec2.GetConsoleOutputInput{InstanceId: aws.String(instanceId)}
+	if latest {
+		input.Latest = aws.Bool(true)
+	}
+
+	consoleOutput, err := ec2Client.GetConsoleOutput(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	if consoleOutput.Output == nil {
+		return "", nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(*consoleOutput.Output)
+	if err != nil {
+		return "", fmt.Errorf("decoding console output of %s: %w", instanceId, err)
+	}
+
+	return string(decoded), nil
+}
+
+// followConsoleOutput prints console output and then only what's new every interval, till ctx is done
+func followConsoleOutput(ctx context.Context, ec2Client ec2Client, w io.Writer, instanceId string, latest bool, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	printed := ""
+	for {
+		output, err := consoleOutput(ctx, ec2Client, instanceId, latest)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		_, err = io.WriteString(w, newConsoleOutput(printed, output))
+		if err != nil {
+			return err
+		}
+		if output != "" {
+			printed = output
+		}
+
+		select {
+		case <-ctx.Done():
+			// following ends with Ctrl-C, that's not a failure
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// newConsoleOutput returns part of current output not printed yet, when the buffer has rolled its start
+// is somewhere in printed output, when it can't be found current output is printed whole
+func newConsoleOutput(printed string, current string) string {
+	if strings.HasPrefix(current, printed) {
+		return current[len(printed):]
+	}
+
+	// the first line of current output, wherever it is in printed output, the rest has to follow it
+	head := current[:min(len(current), consoleOverlap)]
+	if i := strings.IndexByte(head, '\n'); i >= 0 {
+		head = head[:i+1]
+	}
+	for offset := 0; ; {
+		i := strings.Index(printed[offset:], head)
+		if i < 0 {
+			return current
+		}
+
+		rest := printed[offset+i:]
+		if strings.HasPrefix(current, rest) {
+			return current[len(rest):]
+		}
+		offset += i + 1
+	}
+}
+
+func saveConsoleScreenshot(ctx context.Context, ec2Client ec2Client, instanceId string, path string) error {
+	screenshotOutput, err := ec2Client.GetConsoleScreenshot(ctx, &ec2.GetConsoleScreenshotInput{
+		InstanceId: aws.String(instanceId),
+		WakeUp:     aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+	if screenshotOutput.ImageData == nil {
+		return errors.New("no screenshot returned for " + instanceId)
+	}
+
+	image, err := base64.StdEncoding.DecodeString(*screenshotOutput.ImageData)
+	if err != nil {
+		return fmt.Errorf("decoding screenshot of %s: %w", instanceId, err)
+	}
+
+	return os.WriteFile(path, image, 0644)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestNewConsoleOutput(t *testing.T) {
+	cases := []struct {
+		printed  string
+		current  string
+		expected string
+	}{
+		{"", "boot\n", "boot\n"},
+		{"boot\n", "boot\ncloud-init\n", "cloud-init\n"},
+		{"boot\ncloud-init\n", "boot\ncloud-init\n", ""},
+		// buffer rolled, its start is gone, but the rest of printed output is still there
+		{"boot\ncloud-init\n", "cloud-init\nfailed\n", "failed\n"},
+		// rolled past everything printed
+		{"boot\n", "failed\n", "failed\n"},
+	}
+	for _, c := range cases {
+		if got := newConsoleOutput(c.printed, c.current); got != c.expected {
+			t.Errorf("newConsoleOutput(%q, %q) is %q, expected %q", c.printed, c.current, got, c.expected)
+		}
+	}
+}
+
+func TestFollowConsoleOutput(t *testing.T) {
+	ec2Client := &mockEc2Client{consoleOutputs: []string{"", "boot\n", "boot\ncloud-init failed\n"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var out bytes.Buffer
+	err := followConsoleOutput(ctx, ec2Client, &out, "i-0f3f71c5c31adaae2", false, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal("Error following console output: " + err.Error())
+	}
+
+	if out.String() != "boot\ncloud-init failed\n" {
+		t.Errorf("output is %q, every line expected once", out.String())
+	}
+}
+
+func TestResolveInstance(t *testing.T) {
+	ec2Client := &mockEc2Client{
+		describeInstancesOutput: &ec2.DescribeInstancesOutput{
+			Reservations: []types.Reservation{{Instances: []types.Instance{{InstanceId: aws.String("i-0f3f71c5c31adaae2")}}}},
+		},
+	}
+	app := &app{ec2Client: ec2Client}
+
+	instanceId, err := resolveInstance(context.TODO(), app, "bastion")
+	if err != nil || instanceId != "i-0f3f71c5c31adaae2" {
+		t.Errorf("instance is %s (%v), expected i-0f3f71c5c31adaae2", instanceId, err)
+	}
+
+	instanceId, err = resolveInstance(context.TODO(), app, "i-0123456789abcdef0")
+	if err != nil || instanceId != "i-0123456789abcdef0" {
+		t.Errorf("instance ID should be taken as it is, got %s (%v)", instanceId, err)
+	}
+
+	ec2Client.describeInstancesOutput.Reservations[0].Instances = append(ec2Client.describeInstancesOutput.Reservations[0].Instances, types.Instance{InstanceId: aws.String("i-0123456789abcdef0")})
+	_, err = resolveInstance(context.TODO(), app, "bastion")
+	if err == nil || !strings.Contains(err.Error(), "pick one by ID") {
+		t.Errorf("ambiguous name should fail, got %v", err)
+	}
+}
+
+func TestSaveConsoleScreenshot(t *testing.T) {
+	jpeg := []byte{0xff, 0xd8, 0xff, 0xe0}
+	path := filepath.Join(t.TempDir(), "screen.jpg")
+
+	err := saveConsoleScreenshot(context.TODO(), &mockEc2Client{screenshot: jpeg}, "i-0f3f71c5c31adaae2", path)
+	if err != nil {
+		t.Fatal("Error saving screenshot: " + err.Error())
+	}
+
+	saved, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(saved, jpeg) {
+		t.Errorf("saved screenshot is %x (%v), expected %x", saved, err, jpeg)
+	}
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
 )
 
 type ec2Client interface {
@@ -13,32 +18,242 @@ type ec2Client interface {
 	DescribeKeyPairs(ctx context.Context, params *ec2.DescribeKeyPairsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeKeyPairsOutput, error)
 	CreateKeyPair(ctx context.Context, params *ec2.CreateKeyPairInput, optFns ...func(*ec2.Options)) (*ec2.CreateKeyPairOutput, error)
 	RunInstances(ctx context.Context, params *ec2.RunInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RunInstancesOutput, error)
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+	DescribeInstanceTypes(ctx context.Context, params *ec2.DescribeInstanceTypesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceTypesOutput, error)
+	CreateSecurityGroup(ctx context.Context, params *ec2.CreateSecurityGroupInput, optFns ...func(*ec2.Options)) (*ec2.CreateSecurityGroupOutput, error)
+	AuthorizeSecurityGroupIngress(ctx context.Context, params *ec2.AuthorizeSecurityGroupIngressInput, optFns ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupIngressOutput, error)
+	DescribeSecurityGroups(ctx context.Context, params *ec2.DescribeSecurityGroupsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupsOutput, error)
+	CreateVolume(ctx context.Context, params *ec2.CreateVolumeInput, optFns ...func(*ec2.Options)) (*ec2.CreateVolumeOutput, error)
+	AttachVolume(ctx context.Context, params *ec2.AttachVolumeInput, optFns ...func(*ec2.Options)) (*ec2.AttachVolumeOutput, error)
+	DescribeVolumes(ctx context.Context, params *ec2.DescribeVolumesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error)
+	DescribeInstanceStatus(ctx context.Context, params *ec2.DescribeInstanceStatusInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceStatusOutput, error)
+	ModifyInstanceAttribute(ctx context.Context, params *ec2.ModifyInstanceAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceAttributeOutput, error)
+	CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error)
+	StopInstances(ctx context.Context, params *ec2.StopInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error)
+	StartInstances(ctx context.Context, params *ec2.StartInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StartInstancesOutput, error)
+	CreateImage(ctx context.Context, params *ec2.CreateImageInput, optFns ...func(*ec2.Options)) (*ec2.CreateImageOutput, error)
+	DeregisterImage(ctx context.Context, params *ec2.DeregisterImageInput, optFns ...func(*ec2.Options)) (*ec2.DeregisterImageOutput, error)
+	DeleteSnapshot(ctx context.Context, params *ec2.DeleteSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSnapshotOutput, error)
+	DescribeAddresses(ctx context.Context, params *ec2.DescribeAddressesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeAddressesOutput, error)
+	AllocateAddress(ctx context.Context, params *ec2.AllocateAddressInput, optFns ...func(*ec2.Options)) (*ec2.AllocateAddressOutput, error)
+	AssociateAddress(ctx context.Context, params *ec2.AssociateAddressInput, optFns ...func(*ec2.Options)) (*ec2.AssociateAddressOutput, error)
+	DisassociateAddress(ctx context.Context, params *ec2.DisassociateAddressInput, optFns ...func(*ec2.Options)) (*ec2.DisassociateAddressOutput, error)
+	ReleaseAddress(ctx context.Context, params *ec2.ReleaseAddressInput, optFns ...func(*ec2.Options)) (*ec2.ReleaseAddressOutput, error)
+	TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error)
+	DeleteVolume(ctx context.Context, params *ec2.DeleteVolumeInput, optFns ...func(*ec2.Options)) (*ec2.DeleteVolumeOutput, error)
+	DeleteSecurityGroup(ctx context.Context, params *ec2.DeleteSecurityGroupInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSecurityGroupOutput, error)
+	GetConsoleOutput(ctx context.Context, params *ec2.GetConsoleOutputInput, optFns ...func(*ec2.Options)) (*ec2.GetConsoleOutputOutput, error)
+	GetConsoleScreenshot(ctx context.Context, params *ec2.GetConsoleScreenshotInput, optFns ...func(*ec2.Options)) (*ec2.GetConsoleScreenshotOutput, error)
+	DeleteKeyPair(ctx context.Context, params *ec2.DeleteKeyPairInput, optFns ...func(*ec2.Options)) (*ec2.DeleteKeyPairOutput, error)
 }
 
-func getAmiId(ctx context.Context, ec2Client ec2Client) (*string, error) {
-	describeImagesOutput, err := ec2Client.DescribeImages(ctx, &ec2.DescribeImagesInput{
-		Owners: []string{canonicalsId},
-		Filters: []types.Filter{
-			{
-				Name:   aws.String("name"),
-				Values: []string{ubuntuImageNameFilter},
-			},
-		},
+const (
+	managedByTagKey   string = "managed-by"
+	managedByTagValue string = "golang-ec2"
+	specHashTagKey    string = "spec-hash"
+
+	// instances launched per spec
+	instanceCount int32 = 1
+
+	waitTimeout time.Duration = 10 * time.Minute
+)
+
+// eachImage walks every page of DescribeImages results and calls fn for each image,
+// stopping as soon as fn returns false
+func eachImage(ctx context.Context, ec2Client ec2Client, input *ec2.DescribeImagesInput, fn func(image types.Image) bool) error {
+	paginator := ec2.NewDescribeImagesPaginator(ec2Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, image := range page.Images {
+			if !fn(image) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// eachInstance walks every page of DescribeInstances results and calls fn for each instance
+// of every reservation, stopping as soon as fn returns false
+func eachInstance(ctx context.Context, ec2Client ec2Client, input *ec2.DescribeInstancesInput, fn func(instance types.Instance) bool) error {
+	paginator := ec2.NewDescribeInstancesPaginator(ec2Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				if !fn(instance) {
+					return nil
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// eachVolume walks every page of DescribeVolumes results and calls fn for each volume,
+// stopping as soon as fn returns false
+func eachVolume(ctx context.Context, ec2Client ec2Client, input *ec2.DescribeVolumesInput, fn func(volume types.Volume) bool) error {
+	paginator := ec2.NewDescribeVolumesPaginator(ec2Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, volume := range page.Volumes {
+			if !fn(volume) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// eachInstanceType walks every page of DescribeInstanceTypes results and calls fn for each instance type,
+// stopping as soon as fn returns false
+func eachInstanceType(ctx context.Context, ec2Client ec2Client, input *ec2.DescribeInstanceTypesInput, fn func(info types.InstanceTypeInfo) bool) error {
+	paginator := ec2.NewDescribeInstanceTypesPaginator(ec2Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, info := range page.InstanceTypes {
+			if !fn(info) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// eachSecurityGroup walks every page of DescribeSecurityGroups results and calls fn for each group,
+// stopping as soon as fn returns false
+func eachSecurityGroup(ctx context.Context, ec2Client ec2Client, input *ec2.DescribeSecurityGroupsInput, fn func(securityGroup types.SecurityGroup) bool) error {
+	paginator := ec2.NewDescribeSecurityGroupsPaginator(ec2Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, securityGroup := range page.SecurityGroups {
+			if !fn(securityGroup) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// describeInstance returns instance by ID, or nil if AWS doesn't know it
+func describeInstance(ctx context.Context, ec2Client ec2Client, instanceId string) (*types.Instance, error) {
+	var found *types.Instance
+	err := eachInstance(ctx, ec2Client, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceId}}, func(instance types.Instance) bool {
+		found = &instance
+		return false
 	})
+
+	if isNotFound(err) {
+		return nil, nil
+	}
+
+	return found, err
+}
+
+// isNotFound tells if AWS doesn't know the resource, like InvalidInstanceID.NotFound or InvalidGroup.NotFound
+func isNotFound(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && strings.HasSuffix(apiErr.ErrorCode(), ".NotFound")
+}
+
+func getAmiId(ctx context.Context, ec2Client ec2Client, image imageSelector) (*string, error) {
+	latestImage, err := findImage(ctx, ec2Client, image)
 	if err != nil {
 		return nil, err
 	}
 
-	ubuntuAmiId := describeImagesOutput.Images[0].ImageId
-	return ubuntuAmiId, nil
+	return latestImage.ImageId, nil
 }
 
-func lookUpKeyPair(ctx context.Context, ec2Client ec2Client) (bool, error) {
+// findImage returns the newest image matching selector, launch needs more of it than ID, e.g. root device name
+func findImage(ctx context.Context, ec2Client ec2Client, image imageSelector) (*types.Image, error) {
+	filters := []types.Filter{}
+	if image.OS != "" {
+		osImage, namePattern, err := lookupOS(image.OS, image.Arch)
+		if err != nil {
+			return nil, err
+		}
+
+		image.Owner = osImage.Owner
+		image.Name = namePattern
+		// name patterns of some publishers match other architectures too
+		arch := image.Arch
+		if arch == "" {
+			arch = defaultArch
+		}
+		filters = append(filters, types.Filter{
+			Name:   aws.String("architecture"),
+			Values: []string{ec2Architectures[arch]},
+		})
+	}
+	if image.Name != "" {
+		filters = append(filters, types.Filter{
+			Name:   aws.String("name"),
+			Values: []string{image.Name},
+		})
+	}
+	for key, value := range image.Tags {
+		filters = append(filters, types.Filter{
+			Name:   aws.String("tag:" + key),
+			Values: []string{value},
+		})
+	}
+
+	// pick the most recent image, as results are spread over pages in no particular order
+	var latestImage *types.Image
+	err := eachImage(ctx, ec2Client, &ec2.DescribeImagesInput{
+		Owners:  []string{image.Owner},
+		Filters: filters,
+	}, func(image types.Image) bool {
+		if latestImage == nil || aws.ToString(image.CreationDate) > aws.ToString(latestImage.CreationDate) {
+			latestImage = &image
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if latestImage == nil {
+		return nil, fmt.Errorf("no images found for owner %s matching name %q and tags %v", image.Owner, image.Name, image.Tags)
+	}
+
+	return latestImage, nil
+}
+
+func lookUpKeyPair(ctx context.Context, ec2Client ec2Client, keyName string) (bool, error) {
+	// DescribeKeyPairs isn't paginated by the API, all key pairs come back in a single response
 	keyPairs, err := ec2Client.DescribeKeyPairs(ctx, &ec2.DescribeKeyPairsInput{
 		Filters: []types.Filter{
 			{
 				Name:   aws.String("key-name"),
-				Values: []string{keyPairName},
+				Values: []string{keyName},
 			},
 		},
 	})
@@ -48,7 +263,7 @@ func lookUpKeyPair(ctx context.Context, ec2Client ec2Client) (bool, error) {
 
 	keyPairFound := false
 	for _, keyPair := range keyPairs.KeyPairs {
-		if *keyPair.KeyName == keyPairName {
+		if *keyPair.KeyName == keyName {
 			keyPairFound = true
 			break
 		}
@@ -57,9 +272,9 @@ func lookUpKeyPair(ctx context.Context, ec2Client ec2Client) (bool, error) {
 	return keyPairFound, nil
 }
 
-func createKeyPair(ctx context.Context, ec2Client ec2Client) (*ec2.CreateKeyPairOutput, error) {
+func createKeyPair(ctx context.Context, ec2Client ec2Client, keyName string) (*ec2.CreateKeyPairOutput, error) {
 	keyPairCreatedOutput, err := ec2Client.CreateKeyPair(ctx, &ec2.CreateKeyPairInput{
-		KeyName: aws.String(keyPairName),
+		KeyName: aws.String(keyName),
 	})
 	if err != nil {
 		return nil, err
@@ -68,18 +283,236 @@ func createKeyPair(ctx context.Context, ec2Client ec2Client) (*ec2.CreateKeyPair
 	return keyPairCreatedOutput, nil
 }
 
-func createEc2Instance(ctx context.Context, ec2Client ec2Client, ubuntuAmiId *string) (*ec2.RunInstancesOutput, error) {
-	// run EC2 instance
-	ec2RunOutput, err := ec2Client.RunInstances(ctx, &ec2.RunInstancesInput{
-		MaxCount:     aws.Int32(1),
-		MinCount:     aws.Int32(1),
-		ImageId:      ubuntuAmiId,
-		InstanceType: types.InstanceTypeT3Micro,
-		KeyName:      aws.String(keyPairName),
+// resourceTags builds tags for resource created from spec, so it can be found in AWS even without state file
+func resourceTags(resourceType types.ResourceType, name string, spec launchSpec) []types.TagSpecification {
+	tags := []types.Tag{
+		{Key: aws.String("Name"), Value: aws.String(name)},
+		{Key: aws.String(managedByTagKey), Value: aws.String(managedByTagValue)},
+		{Key: aws.String(specHashTagKey), Value: aws.String(spec.hash())},
+	}
+	for key, value := range spec.Tags {
+		tags = append(tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+
+	return []types.TagSpecification{
+		{
+			ResourceType: resourceType,
+			Tags:         tags,
+		},
+	}
+}
+
+func createSecurityGroup(ctx context.Context, ec2Client ec2Client, spec launchSpec) (*string, error) {
+	securityGroupOutput, err := ec2Client.CreateSecurityGroup(ctx, &ec2.CreateSecurityGroupInput{
+		GroupName:         aws.String(spec.SecurityGroup.Name),
+		Description:       aws.String(spec.SecurityGroup.Description),
+		TagSpecifications: resourceTags(types.ResourceTypeSecurityGroup, spec.SecurityGroup.Name, spec),
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	if len(spec.SecurityGroup.Ingress) == 0 {
+		return securityGroupOutput.GroupId, nil
+	}
+
+	ipPermissions := []types.IpPermission{}
+	for _, rule := range spec.SecurityGroup.Ingress {
+		ipPermissions = append(ipPermissions, types.IpPermission{
+			IpProtocol: aws.String(rule.Protocol),
+			FromPort:   aws.Int32(rule.FromPort),
+			ToPort:     aws.Int32(rule.ToPort),
+			IpRanges:   []types.IpRange{{CidrIp: aws.String(rule.CidrIp)}},
+		})
+	}
+
+	_, err = ec2Client.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:       securityGroupOutput.GroupId,
+		IpPermissions: ipPermissions,
+	})
+	if err != nil {
+		return securityGroupOutput.GroupId, err
+	}
+
+	return securityGroupOutput.GroupId, nil
+}
+
+func createEc2Instance(ctx context.Context, ec2Client ec2Client, input *ec2.RunInstancesInput) (*ec2.RunInstancesOutput, error) {
+	// run EC2 instance
+	ec2RunOutput, err := ec2Client.RunInstances(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
 	return ec2RunOutput, nil
 }
+
+// runInstancesInput is the launch request for instance tagged with name, with hardened defaults: IMDSv2 only,
+// encrypted root volume and public IP only when spec asks for it, policy is checked against it before anything is created
+func runInstancesInput(spec launchSpec, name string, keyName string, image types.Image, securityGroupIds []string) *ec2.RunInstancesInput {
+	input := &ec2.RunInstancesInput{
+		MaxCount:     aws.Int32(instanceCount),
+		MinCount:     aws.Int32(instanceCount),
+		ImageId:      image.ImageId,
+		InstanceType: types.InstanceType(spec.InstanceType),
+		KeyName:      aws.String(keyName),
+		MetadataOptions: &types.InstanceMetadataOptionsRequest{
+			HttpEndpoint: types.InstanceMetadataEndpointStateEnabled,
+			HttpTokens:   types.HttpTokensStateRequired,
+		},
+		Monitoring: &types.RunInstancesMonitoringEnabled{Enabled: aws.Bool(spec.Monitoring)},
+		// public IP can only be controlled on network interface, security groups have to move there as well
+		NetworkInterfaces: []types.InstanceNetworkInterfaceSpecification{{
+			DeviceIndex:              aws.Int32(0),
+			AssociatePublicIpAddress: aws.Bool(spec.PublicIp),
+			DeleteOnTermination:      aws.Bool(true),
+			Groups:                   securityGroupIds,
+		}},
+		TagSpecifications: resourceTags(types.ResourceTypeInstance, name, spec),
+	}
+
+	// root volume keeps size and type from the image, only encryption is forced
+	if image.RootDeviceName != nil {
+		input.BlockDeviceMappings = []types.BlockDeviceMapping{{
+			DeviceName: image.RootDeviceName,
+			Ebs:        &types.EbsBlockDevice{Encrypted: aws.Bool(true), DeleteOnTermination: aws.Bool(true)},
+		}}
+	}
+
+	return input
+}
+
+// waitInstanceRunning blocks till instance is running and returns its fresh description
+func waitInstanceRunning(ctx context.Context, ec2Client ec2Client, instanceId string) (*types.Instance, error) {
+	describeOutput, err := ec2.NewInstanceRunningWaiter(ec2Client).WaitForOutput(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceId},
+	}, waitTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, reservation := range describeOutput.Reservations {
+		for _, instance := range reservation.Instances {
+			if aws.ToString(instance.InstanceId) == instanceId {
+				return &instance, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("instance %s not found", instanceId)
+}
+
+// createVolume creates EBS volume in the instance's AZ and attaches it once it's available
+func createVolume(ctx context.Context, ec2Client ec2Client, spec launchSpec, volume volumeSpec, instance *types.Instance) (*string, error) {
+	volumeOutput, err := ec2Client.CreateVolume(ctx, &ec2.CreateVolumeInput{
+		AvailabilityZone:  instance.Placement.AvailabilityZone,
+		Size:              aws.Int32(volume.SizeGiB),
+		VolumeType:        types.VolumeType(volume.Type),
+		TagSpecifications: resourceTags(types.ResourceTypeVolume, spec.Name+" "+volume.Device, spec),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = ec2.NewVolumeAvailableWaiter(ec2Client).Wait(ctx, &ec2.DescribeVolumesInput{
+		VolumeIds: []string{*volumeOutput.VolumeId},
+	}, waitTimeout)
+	if err != nil {
+		return volumeOutput.VolumeId, err
+	}
+
+	_, err = ec2Client.AttachVolume(ctx, &ec2.AttachVolumeInput{
+		Device:     aws.String(volume.Device),
+		InstanceId: instance.InstanceId,
+		VolumeId:   volumeOutput.VolumeId,
+	})
+	if err != nil {
+		return volumeOutput.VolumeId, err
+	}
+
+	return volumeOutput.VolumeId, nil
+}
+
+// describeResource checks that resource exists in AWS and returns its name
+func describeResource(ctx context.Context, ec2Client ec2Client, t resourceType, id string) (string, error) {
+	switch t {
+	case resourceKeyPair:
+		keyPairs, err := ec2Client.DescribeKeyPairs(ctx, &ec2.DescribeKeyPairsInput{KeyNames: []string{id}})
+		if err != nil {
+			return "", err
+		}
+		if len(keyPairs.KeyPairs) == 0 {
+			return "", fmt.Errorf("key pair %s not found", id)
+		}
+
+		return aws.ToString(keyPairs.KeyPairs[0].KeyName), nil
+
+	case resourceSecurityGroup:
+		var found *types.SecurityGroup
+		err := eachSecurityGroup(ctx, ec2Client, &ec2.DescribeSecurityGroupsInput{GroupIds: []string{id}}, func(securityGroup types.SecurityGroup) bool {
+			found = &securityGroup
+			return false
+		})
+		if err != nil {
+			return "", err
+		}
+		if found == nil {
+			return "", fmt.Errorf("security group %s not found", id)
+		}
+
+		return aws.ToString(found.GroupName), nil
+
+	case resourceInstance:
+		found, err := describeInstance(ctx, ec2Client, id)
+		if err != nil {
+			return "", err
+		}
+		if found == nil {
+			return "", fmt.Errorf("instance %s not found", id)
+		}
+
+		return tagValue(found.Tags, "Name"), nil
+
+	case resourceVolume:
+		var found *types.Volume
+		err := eachVolume(ctx, ec2Client, &ec2.DescribeVolumesInput{VolumeIds: []string{id}}, func(volume types.Volume) bool {
+			found = &volume
+			return false
+		})
+		if err != nil {
+			return "", err
+		}
+		if found == nil {
+			return "", fmt.Errorf("volume %s not found", id)
+		}
+
+		return tagValue(found.Tags, "Name"), nil
+
+	case resourceImage:
+		var found *types.Image
+		err := eachImage(ctx, ec2Client, &ec2.DescribeImagesInput{ImageIds: []string{id}}, func(image types.Image) bool {
+			found = &image
+			return false
+		})
+		if err != nil {
+			return "", err
+		}
+		if found == nil {
+			return "", fmt.Errorf("image %s not found", id)
+		}
+
+		return aws.ToString(found.Name), nil
+	}
+
+	return "", fmt.Errorf("unknown resource type %s", t)
+}
+
+func tagValue(tags []types.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == key {
+			return aws.ToString(tag.Value)
+		}
+	}
+
+	return ""
+}
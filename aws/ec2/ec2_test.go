@@ -2,36 +2,449 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
 )
 
 type mockEc2Client struct {
-	describeImagesOutput   *ec2.DescribeImagesOutput
-	describeKeyPairsOutput *ec2.DescribeKeyPairsOutput
-	createKeyPairOutput    *ec2.CreateKeyPairOutput
-	runInstancesOutput     *ec2.RunInstancesOutput
+	describeImagesOutput         *ec2.DescribeImagesOutput
+	describeKeyPairsOutput       *ec2.DescribeKeyPairsOutput
+	createKeyPairOutput          *ec2.CreateKeyPairOutput
+	runInstancesOutput           *ec2.RunInstancesOutput
+	describeInstancesOutput      *ec2.DescribeInstancesOutput
+	describeInstanceTypesOutput  *ec2.DescribeInstanceTypesOutput
+	createSecurityGroupOutput    *ec2.CreateSecurityGroupOutput
+	describeSecurityGroupsOutput *ec2.DescribeSecurityGroupsOutput
+	createVolumeOutput           *ec2.CreateVolumeOutput
+	describeVolumesOutput        *ec2.DescribeVolumesOutput
+	createImageOutput            *ec2.CreateImageOutput
+	// Elastic IPs behave like in AWS: allocate adds, associate points, release removes
+	addresses []types.Address
+	// multi-page fakes, page N is served for NextToken "page-N", see mockPageToken
+	describeImagesPages    []*ec2.DescribeImagesOutput
+	describeInstancesPages []*ec2.DescribeInstancesOutput
+	describeVolumesPages   []*ec2.DescribeVolumesOutput
+	describeTypesPages     []*ec2.DescribeInstanceTypesOutput
+	// number of pages served from multi-page fakes, to check streaming stops early
+	pagesServed int
+	// console output served by consecutive GetConsoleOutput calls, the last one repeats
+	consoleOutputs []string
+	screenshot     []byte
+	// names of mutating API calls in order they were made
+	calls []string
+	// mutating API calls to fail, by name
+	failOn map[string]error
+	// mutating API call to hang till context is cancelled
+	blockOn string
+	// last DescribeImages request, to check filters
+	describeImagesInput *ec2.DescribeImagesInput
 }
 
 const mockImageId string = "prod-x7h6cigkuiul6"
 
+// record notes mutating call and returns error it's set to fail with,
+// blocked call waits till ctx is done, like a hung API call would
+func (m *mockEc2Client) record(ctx context.Context, call string) error {
+	m.calls = append(m.calls, call)
+	if call == m.blockOn {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	return m.failOn[call]
+}
+
+// mockPageToken returns NextToken value pointing to page index
+func mockPageToken(index int) *string {
+	return aws.String("page-" + strconv.Itoa(index))
+}
+
+// mockPageIndex turns NextToken from request back into page index, first page has no token
+func mockPageIndex(nextToken *string) int {
+	if nextToken == nil {
+		return 0
+	}
+
+	index, _ := strconv.Atoi(strings.TrimPrefix(*nextToken, "page-"))
+	return index
+}
+
 func (m *mockEc2Client) DescribeImages(ctx context.Context, params *ec2.DescribeImagesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeImagesOutput, error) {
+	m.describeImagesInput = params
+	if m.describeImagesPages != nil {
+		m.pagesServed++
+		return m.describeImagesPages[mockPageIndex(params.NextToken)], nil
+	}
+
 	return m.describeImagesOutput, nil
 }
 
+func (m *mockEc2Client) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	if m.describeInstancesPages != nil {
+		m.pagesServed++
+		return m.describeInstancesPages[mockPageIndex(params.NextToken)], nil
+	}
+	if len(params.InstanceIds) == 0 || m.describeInstancesOutput == nil {
+		return m.describeInstancesOutput, nil
+	}
+
+	// asking by ID gets only those instances, like waiters do
+	reservations := []types.Reservation{}
+	for _, reservation := range m.describeInstancesOutput.Reservations {
+		instances := []types.Instance{}
+		for _, instance := range reservation.Instances {
+			if slices.Contains(params.InstanceIds, aws.ToString(instance.InstanceId)) {
+				instances = append(instances, instance)
+			}
+		}
+		if len(instances) > 0 {
+			reservations = append(reservations, types.Reservation{Instances: instances})
+		}
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: reservations}, nil
+}
+
+func (m *mockEc2Client) DescribeInstanceTypes(ctx context.Context, params *ec2.DescribeInstanceTypesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceTypesOutput, error) {
+	if m.describeTypesPages != nil {
+		m.pagesServed++
+		return m.describeTypesPages[mockPageIndex(params.NextToken)], nil
+	}
+	return m.describeInstanceTypesOutput, nil
+}
+
+func (m *mockEc2Client) CreateSecurityGroup(ctx context.Context, params *ec2.CreateSecurityGroupInput, optFns ...func(*ec2.Options)) (*ec2.CreateSecurityGroupOutput, error) {
+	err := m.record(ctx, "CreateSecurityGroup")
+	if err != nil {
+		return nil, err
+	}
+	return m.createSecurityGroupOutput, nil
+}
+
+func (m *mockEc2Client) AuthorizeSecurityGroupIngress(ctx context.Context, params *ec2.AuthorizeSecurityGroupIngressInput, optFns ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	err := m.record(ctx, "AuthorizeSecurityGroupIngress")
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.AuthorizeSecurityGroupIngressOutput{}, nil
+}
+
+func (m *mockEc2Client) DescribeSecurityGroups(ctx context.Context, params *ec2.DescribeSecurityGroupsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupsOutput, error) {
+	if len(params.GroupIds) == 0 {
+		return m.describeSecurityGroupsOutput, nil
+	}
+
+	// asking by ID for unknown group fails, like in AWS
+	groups := []types.SecurityGroup{}
+	if m.describeSecurityGroupsOutput != nil {
+		for _, group := range m.describeSecurityGroupsOutput.SecurityGroups {
+			if slices.Contains(params.GroupIds, aws.ToString(group.GroupId)) {
+				groups = append(groups, group)
+			}
+		}
+	}
+	if len(groups) < len(params.GroupIds) {
+		return nil, &smithy.GenericAPIError{Code: "InvalidGroup.NotFound"}
+	}
+	return &ec2.DescribeSecurityGroupsOutput{SecurityGroups: groups}, nil
+}
+
+func (m *mockEc2Client) CreateVolume(ctx context.Context, params *ec2.CreateVolumeInput, optFns ...func(*ec2.Options)) (*ec2.CreateVolumeOutput, error) {
+	err := m.record(ctx, "CreateVolume")
+	if err != nil {
+		return nil, err
+	}
+	return m.createVolumeOutput, nil
+}
+
+func (m *mockEc2Client) AttachVolume(ctx context.Context, params *ec2.AttachVolumeInput, optFns ...func(*ec2.Options)) (*ec2.AttachVolumeOutput, error) {
+	err := m.record(ctx, "AttachVolume")
+	if err != nil {
+		return nil, err
+	}
+	// attached volume is listed by attachment.instance-id filter
+	if m.describeVolumesOutput != nil {
+		for i, volume := range m.describeVolumesOutput.Volumes {
+			if aws.ToString(volume.VolumeId) == aws.ToString(params.VolumeId) {
+				m.describeVolumesOutput.Volumes[i].Attachments = []types.VolumeAttachment{{InstanceId: params.InstanceId, Device: params.Device}}
+			}
+		}
+	}
+	return &ec2.AttachVolumeOutput{}, nil
+}
+
+func (m *mockEc2Client) StopInstances(ctx context.Context, params *ec2.StopInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error) {
+	err := m.record(ctx, "StopInstances")
+	if err != nil {
+		return nil, err
+	}
+	m.setInstanceState(params.InstanceIds, types.InstanceStateNameStopped)
+	return &ec2.StopInstancesOutput{}, nil
+}
+
+func (m *mockEc2Client) StartInstances(ctx context.Context, params *ec2.StartInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StartInstancesOutput, error) {
+	err := m.record(ctx, "StartInstances")
+	if err != nil {
+		return nil, err
+	}
+	m.setInstanceState(params.InstanceIds, types.InstanceStateNameRunning)
+	return &ec2.StartInstancesOutput{}, nil
+}
+
+func (m *mockEc2Client) DescribeInstanceStatus(ctx context.Context, params *ec2.DescribeInstanceStatusInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceStatusOutput, error) {
+	// status checks of every instance pass, unless they're set to fail
+	if err := m.failOn["DescribeInstanceStatus"]; err != nil {
+		return nil, err
+	}
+
+	statuses := []types.InstanceStatus{}
+	for _, instanceId := range params.InstanceIds {
+		statuses = append(statuses, types.InstanceStatus{
+			InstanceId:     aws.String(instanceId),
+			InstanceStatus: &types.InstanceStatusSummary{Status: types.SummaryStatusOk},
+			SystemStatus:   &types.InstanceStatusSummary{Status: types.SummaryStatusOk},
+		})
+	}
+	return &ec2.DescribeInstanceStatusOutput{InstanceStatuses: statuses}, nil
+}
+
+func (m *mockEc2Client) ModifyInstanceAttribute(ctx context.Context, params *ec2.ModifyInstanceAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifyInstanceAttributeOutput, error) {
+	err := m.record(ctx, "ModifyInstanceAttribute")
+	if err != nil {
+		return nil, err
+	}
+	m.eachDescribedInstance([]string{aws.ToString(params.InstanceId)}, func(instance *types.Instance) {
+		instance.InstanceType = types.InstanceType(aws.ToString(params.InstanceType.Value))
+	})
+	return &ec2.ModifyInstanceAttributeOutput{}, nil
+}
+
+func (m *mockEc2Client) CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	err := m.record(ctx, "CreateTags")
+	if err != nil {
+		return nil, err
+	}
+	m.eachDescribedInstance(params.Resources, func(instance *types.Instance) {
+		for _, tag := range params.Tags {
+			instance.Tags = slices.DeleteFunc(instance.Tags, func(t types.Tag) bool { return aws.ToString(t.Key) == aws.ToString(tag.Key) })
+			instance.Tags = append(instance.Tags, tag)
+		}
+	})
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+// setInstanceState makes described instances follow start/stop calls, so waiters see the change
+func (m *mockEc2Client) setInstanceState(instanceIds []string, stateName types.InstanceStateName) {
+	m.eachDescribedInstance(instanceIds, func(instance *types.Instance) {
+		instance.State = &types.InstanceState{Name: stateName}
+	})
+}
+
+// eachDescribedInstance lets fn change described instances with given IDs
+func (m *mockEc2Client) eachDescribedInstance(instanceIds []string, fn func(instance *types.Instance)) {
+	if m.describeInstancesOutput == nil {
+		return
+	}
+
+	for _, reservation := range m.describeInstancesOutput.Reservations {
+		for i := range reservation.Instances {
+			if slices.Contains(instanceIds, aws.ToString(reservation.Instances[i].InstanceId)) {
+				fn(&reservation.Instances[i])
+			}
+		}
+	}
+}
+
+func (m *mockEc2Client) CreateImage(ctx context.Context, params *ec2.CreateImageInput, optFns ...func(*ec2.Options)) (*ec2.CreateImageOutput, error) {
+	err := m.record(ctx, "CreateImage")
+	if err != nil {
+		return nil, err
+	}
+	return m.createImageOutput, nil
+}
+
+func (m *mockEc2Client) DeregisterImage(ctx context.Context, params *ec2.DeregisterImageInput, optFns ...func(*ec2.Options)) (*ec2.DeregisterImageOutput, error) {
+	err := m.record(ctx, "DeregisterImage "+aws.ToString(params.ImageId))
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.DeregisterImageOutput{}, nil
+}
+
+func (m *mockEc2Client) DeleteSnapshot(ctx context.Context, params *ec2.DeleteSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSnapshotOutput, error) {
+	err := m.record(ctx, "DeleteSnapshot "+aws.ToString(params.SnapshotId))
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.DeleteSnapshotOutput{}, nil
+}
+
+func (m *mockEc2Client) DescribeAddresses(ctx context.Context, params *ec2.DescribeAddressesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeAddressesOutput, error) {
+	if len(params.AllocationIds) == 0 {
+		return &ec2.DescribeAddressesOutput{Addresses: m.addresses}, nil
+	}
+
+	for _, address := range m.addresses {
+		if aws.ToString(address.AllocationId) == params.AllocationIds[0] {
+			return &ec2.DescribeAddressesOutput{Addresses: []types.Address{address}}, nil
+		}
+	}
+
+	return nil, &smithy.GenericAPIError{Code: "InvalidAllocationID.NotFound"}
+}
+
+func (m *mockEc2Client) AllocateAddress(ctx context.Context, params *ec2.AllocateAddressInput, optFns ...func(*ec2.Options)) (*ec2.AllocateAddressOutput, error) {
+	err := m.record(ctx, "AllocateAddress")
+	if err != nil {
+		return nil, err
+	}
+	allocationId := "eipalloc-" + strconv.Itoa(len(m.addresses))
+	m.addresses = append(m.addresses, types.Address{
+		AllocationId: aws.String(allocationId),
+		PublicIp:     aws.String("203.0.113.10"),
+		Tags:         params.TagSpecifications[0].Tags,
+	})
+
+	return &ec2.AllocateAddressOutput{AllocationId: aws.String(allocationId), PublicIp: aws.String("203.0.113.10")}, nil
+}
+
+func (m *mockEc2Client) AssociateAddress(ctx context.Context, params *ec2.AssociateAddressInput, optFns ...func(*ec2.Options)) (*ec2.AssociateAddressOutput, error) {
+	err := m.record(ctx, "AssociateAddress")
+	if err != nil {
+		return nil, err
+	}
+	for i := range m.addresses {
+		if aws.ToString(m.addresses[i].AllocationId) == aws.ToString(params.AllocationId) {
+			m.addresses[i].InstanceId = params.InstanceId
+			m.addresses[i].AssociationId = aws.String("eipassoc-" + aws.ToString(params.InstanceId))
+		}
+	}
+
+	return &ec2.AssociateAddressOutput{}, nil
+}
+
+func (m *mockEc2Client) DisassociateAddress(ctx context.Context, params *ec2.DisassociateAddressInput, optFns ...func(*ec2.Options)) (*ec2.DisassociateAddressOutput, error) {
+	err := m.record(ctx, "DisassociateAddress")
+	if err != nil {
+		return nil, err
+	}
+	for i := range m.addresses {
+		if aws.ToString(m.addresses[i].AssociationId) == aws.ToString(params.AssociationId) {
+			m.addresses[i].InstanceId = nil
+			m.addresses[i].AssociationId = nil
+		}
+	}
+
+	return &ec2.DisassociateAddressOutput{}, nil
+}
+
+func (m *mockEc2Client) ReleaseAddress(ctx context.Context, params *ec2.ReleaseAddressInput, optFns ...func(*ec2.Options)) (*ec2.ReleaseAddressOutput, error) {
+	err := m.record(ctx, "ReleaseAddress")
+	if err != nil {
+		return nil, err
+	}
+	m.addresses = slices.DeleteFunc(m.addresses, func(address types.Address) bool {
+		return aws.ToString(address.AllocationId) == aws.ToString(params.AllocationId)
+	})
+
+	return &ec2.ReleaseAddressOutput{}, nil
+}
+
+func (m *mockEc2Client) TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error) {
+	err := m.record(ctx, "TerminateInstances")
+	if err != nil {
+		return nil, err
+	}
+	m.setInstanceState(params.InstanceIds, types.InstanceStateNameTerminated)
+	return &ec2.TerminateInstancesOutput{}, nil
+}
+
+func (m *mockEc2Client) DeleteVolume(ctx context.Context, params *ec2.DeleteVolumeInput, optFns ...func(*ec2.Options)) (*ec2.DeleteVolumeOutput, error) {
+	err := m.record(ctx, "DeleteVolume")
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.DeleteVolumeOutput{}, nil
+}
+
+func (m *mockEc2Client) DeleteSecurityGroup(ctx context.Context, params *ec2.DeleteSecurityGroupInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSecurityGroupOutput, error) {
+	err := m.record(ctx, "DeleteSecurityGroup")
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.DeleteSecurityGroupOutput{}, nil
+}
+
+func (m *mockEc2Client) DeleteKeyPair(ctx context.Context, params *ec2.DeleteKeyPairInput, optFns ...func(*ec2.Options)) (*ec2.DeleteKeyPairOutput, error) {
+	err := m.record(ctx, "DeleteKeyPair")
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.DeleteKeyPairOutput{}, nil
+}
+
+func (m *mockEc2Client) GetConsoleOutput(ctx context.Context, params *ec2.GetConsoleOutputInput, optFns ...func(*ec2.Options)) (*ec2.GetConsoleOutputOutput, error) {
+	if len(m.consoleOutputs) == 0 {
+		return &ec2.GetConsoleOutputOutput{InstanceId: params.InstanceId}, nil
+	}
+
+	output := m.consoleOutputs[0]
+	if len(m.consoleOutputs) > 1 {
+		m.consoleOutputs = m.consoleOutputs[1:]
+	}
+	return &ec2.GetConsoleOutputOutput{InstanceId: params.InstanceId, Output: aws.String(base64.StdEncoding.EncodeToString([]byte(output)))}, nil
+}
+
+func (m *mockEc2Client) GetConsoleScreenshot(ctx context.Context, params *ec2.GetConsoleScreenshotInput, optFns ...func(*ec2.Options)) (*ec2.GetConsoleScreenshotOutput, error) {
+	return &ec2.GetConsoleScreenshotOutput{InstanceId: params.InstanceId, ImageData: aws.String(base64.StdEncoding.EncodeToString(m.screenshot))}, nil
+}
+
+func (m *mockEc2Client) DescribeVolumes(ctx context.Context, params *ec2.DescribeVolumesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error) {
+	if m.describeVolumesPages != nil {
+		m.pagesServed++
+		return m.describeVolumesPages[mockPageIndex(params.NextToken)], nil
+	}
+	if len(params.Filters) == 0 || m.describeVolumesOutput == nil {
+		return m.describeVolumesOutput, nil
+	}
+
+	// only attachment.instance-id filter is supported
+	volumes := []types.Volume{}
+	for _, volume := range m.describeVolumesOutput.Volumes {
+		for _, attachment := range volume.Attachments {
+			if slices.Contains(params.Filters[0].Values, aws.ToString(attachment.InstanceId)) {
+				volumes = append(volumes, volume)
+			}
+		}
+	}
+	return &ec2.DescribeVolumesOutput{Volumes: volumes}, nil
+}
+
 func (m *mockEc2Client) DescribeKeyPairs(ctx context.Context, params *ec2.DescribeKeyPairsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeKeyPairsOutput, error) {
 	return m.describeKeyPairsOutput, nil
 }
 
 func (m *mockEc2Client) CreateKeyPair(ctx context.Context, params *ec2.CreateKeyPairInput, optFns ...func(*ec2.Options)) (*ec2.CreateKeyPairOutput, error) {
+	err := m.record(ctx, "CreateKeyPair")
+	if err != nil {
+		return nil, err
+	}
 	return m.createKeyPairOutput, nil
 }
 
 func (m *mockEc2Client) RunInstances(ctx context.Context, params *ec2.RunInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RunInstancesOutput, error) {
+	err := m.record(ctx, "RunInstances")
+	if err != nil {
+		return nil, err
+	}
 	return m.runInstancesOutput, nil
 }
 
@@ -49,7 +462,7 @@ func TestGetAmiId(t *testing.T) {
 		},
 	}
 
-	ubuntuAmiId, err := getAmiId(ctx, ec2Client)
+	ubuntuAmiId, err := getAmiId(ctx, ec2Client, defaultSpec().Image)
 	if err != nil {
 		t.Error("Error getting list of image IDs by filter: " + err.Error())
 	}
@@ -59,6 +472,159 @@ func TestGetAmiId(t *testing.T) {
 	}
 }
 
+func TestGetAmiIdPaginated(t *testing.T) {
+	var latestImageId string = "ami-0latest"
+
+	ctx := context.TODO()
+	ec2Client := &mockEc2Client{
+		describeImagesPages: []*ec2.DescribeImagesOutput{
+			{
+				Images: []types.Image{
+					{ImageId: aws.String(mockImageId), CreationDate: aws.String("2024-03-01T10:00:00.000Z")},
+				},
+				NextToken: mockPageToken(1),
+			},
+			{
+				Images: []types.Image{
+					{ImageId: aws.String("ami-0older"), CreationDate: aws.String("2023-11-20T10:00:00.000Z")},
+				},
+				NextToken: mockPageToken(2),
+			},
+			{
+				Images: []types.Image{
+					{ImageId: aws.String(latestImageId), CreationDate: aws.String("2024-08-15T10:00:00.000Z")},
+				},
+			},
+		},
+	}
+
+	ubuntuAmiId, err := getAmiId(ctx, ec2Client, defaultSpec().Image)
+	if err != nil {
+		t.Error("Error getting list of image IDs by filter: " + err.Error())
+	}
+
+	if *ubuntuAmiId != latestImageId {
+		t.Errorf("Image ID isn't correct, %s != %s", *ubuntuAmiId, latestImageId)
+	}
+	if ec2Client.pagesServed != 3 {
+		t.Errorf("latest image needs all pages, %d were fetched", ec2Client.pagesServed)
+	}
+}
+
+func TestGetAmiIdNoImages(t *testing.T) {
+	ctx := context.TODO()
+	ec2Client := &mockEc2Client{
+		describeImagesOutput: &ec2.DescribeImagesOutput{},
+	}
+
+	_, err := getAmiId(ctx, ec2Client, defaultSpec().Image)
+	if err == nil {
+		t.Error("getAmiId should fail when no images match the filter")
+	}
+}
+
+func TestEachInstance(t *testing.T) {
+	ctx := context.TODO()
+	ec2Client := &mockEc2Client{
+		describeInstancesPages: []*ec2.DescribeInstancesOutput{
+			{
+				Reservations: []types.Reservation{
+					{Instances: []types.Instance{{InstanceId: aws.String("i-01")}, {InstanceId: aws.String("i-02")}}},
+				},
+				NextToken: mockPageToken(1),
+			},
+			{
+				Reservations: []types.Reservation{
+					{Instances: []types.Instance{{InstanceId: aws.String("i-03")}}},
+					{Instances: []types.Instance{{InstanceId: aws.String("i-04")}}},
+				},
+			},
+		},
+	}
+
+	instanceIds := []string{}
+	err := eachInstance(ctx, ec2Client, &ec2.DescribeInstancesInput{}, func(instance types.Instance) bool {
+		instanceIds = append(instanceIds, *instance.InstanceId)
+		return true
+	})
+	if err != nil {
+		t.Error("Error describing instances: " + err.Error())
+	}
+
+	if strings.Join(instanceIds, ",") != "i-01,i-02,i-03,i-04" || ec2Client.pagesServed != 2 {
+		t.Errorf("instances from all pages expected, got %v from %d pages", instanceIds, ec2Client.pagesServed)
+	}
+
+	// stop streaming as soon as callback says so, without fetching the next page
+	instanceIds = []string{}
+	ec2Client.pagesServed = 0
+	err = eachInstance(ctx, ec2Client, &ec2.DescribeInstancesInput{}, func(instance types.Instance) bool {
+		instanceIds = append(instanceIds, *instance.InstanceId)
+		return len(instanceIds) < 2
+	})
+	if err != nil {
+		t.Error("Error describing instances: " + err.Error())
+	}
+
+	if len(instanceIds) != 2 {
+		t.Errorf("iteration should stop after 2 instances, got %v", instanceIds)
+	}
+	if ec2Client.pagesServed != 1 {
+		t.Errorf("only first page should be fetched, %d were", ec2Client.pagesServed)
+	}
+}
+
+func TestEachVolume(t *testing.T) {
+	ctx := context.TODO()
+	ec2Client := &mockEc2Client{
+		describeVolumesPages: []*ec2.DescribeVolumesOutput{
+			{
+				Volumes:   []types.Volume{{VolumeId: aws.String("vol-01")}},
+				NextToken: mockPageToken(1),
+			},
+			{
+				Volumes: []types.Volume{{VolumeId: aws.String("vol-02")}, {VolumeId: aws.String("vol-03")}},
+			},
+		},
+	}
+
+	volumeIds := []string{}
+	err := eachVolume(ctx, ec2Client, &ec2.DescribeVolumesInput{}, func(volume types.Volume) bool {
+		volumeIds = append(volumeIds, *volume.VolumeId)
+		return true
+	})
+	if err != nil {
+		t.Error("Error describing volumes: " + err.Error())
+	}
+	if strings.Join(volumeIds, ",") != "vol-01,vol-02,vol-03" || ec2Client.pagesServed != 2 {
+		t.Errorf("volumes from all pages expected, got %v from %d pages", volumeIds, ec2Client.pagesServed)
+	}
+
+	// first one found stops streaming
+	ec2Client.pagesServed = 0
+	name, err := describeResource(ctx, ec2Client, resourceVolume, "vol-01")
+	if err != nil || name != "" || ec2Client.pagesServed != 1 {
+		t.Errorf("volume should be found on first page, got %q (%v) after %d pages", name, err, ec2Client.pagesServed)
+	}
+}
+
+func TestInstanceTypeVcpusPaginated(t *testing.T) {
+	ec2Client := &mockEc2Client{
+		describeTypesPages: []*ec2.DescribeInstanceTypesOutput{
+			{NextToken: mockPageToken(1)},
+			{InstanceTypes: []types.InstanceTypeInfo{{InstanceType: types.InstanceTypeT3Micro, VCpuInfo: &types.VCpuInfo{DefaultVCpus: aws.Int32(2)}}}},
+		},
+	}
+
+	vcpus, err := instanceTypeVcpus(context.TODO(), ec2Client, "t3.micro")
+	if err != nil {
+		t.Fatal("Error describing instance type: " + err.Error())
+	}
+	if vcpus != 2 || ec2Client.pagesServed != 2 {
+		t.Errorf("expected 2 vCPUs from second page, got %d after %d pages", vcpus, ec2Client.pagesServed)
+	}
+}
+
 func TestLookUpKeyPair(t *testing.T) {
 	ctx := context.TODO()
 	ec2Client := &mockEc2Client{
@@ -71,7 +637,7 @@ func TestLookUpKeyPair(t *testing.T) {
 		},
 	}
 
-	keyPairFound, err := lookUpKeyPair(ctx, ec2Client)
+	keyPairFound, err := lookUpKeyPair(ctx, ec2Client, keyPairName)
 	if err != nil {
 		t.Error("Error getting list of key pairs by filter: " + err.Error())
 	}
@@ -89,7 +655,7 @@ func TestCreateKeyPair(t *testing.T) {
 		},
 	}
 
-	keyPairCreatedOutput, err := createKeyPair(ctx, ec2Client)
+	keyPairCreatedOutput, err := createKeyPair(ctx, ec2Client, keyPairName)
 	if err != nil {
 		t.Error("Error creating key pair: " + err.Error())
 	}
@@ -111,7 +677,7 @@ func TestCreateEc2Instance(t *testing.T) {
 			},
 		},
 	}
-	ec2RunOutput, err := createEc2Instance(ctx, ec2Client, aws.String(mockImageId))
+	ec2RunOutput, err := createEc2Instance(ctx, ec2Client, runInstancesInput(defaultSpec(), defaultInstanceName, keyPairName, types.Image{ImageId: aws.String(mockImageId)}, nil))
 	if err != nil {
 		slog.Error("Error starting EC2 instance: " + err.Error())
 	}
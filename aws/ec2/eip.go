@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// findElasticIp looks up address allocated by the tool for the spec, by its tags
+func findElasticIp(ctx context.Context, ec2Client ec2Client, spec launchSpec) (*types.Address, error) {
+	// DescribeAddresses isn't paginated by the API, all addresses come back in a single response
+	addresses, err := ec2Client.DescribeAddresses(ctx, &ec2.DescribeAddressesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("tag:Name"), Values: []string{spec.Name}},
+			{Name: aws.String("tag:" + managedByTagKey), Values: []string{managedByTagValue}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(addresses.Addresses) == 0 {
+		return nil, nil
+	}
+
+	return &addresses.Addresses[0], nil
+}
+
+// ensureElasticIp reuses tagged address of the spec or allocates a new one, allocated tells which happened
+func ensureElasticIp(ctx context.Context, ec2Client ec2Client, spec launchSpec) (address *types.Address, allocated bool, err error) {
+	address, err = findElasticIp(ctx, ec2Client, spec)
+	if err != nil || address != nil {
+		return address, false, err
+	}
+
+	allocateOutput, err := ec2Client.AllocateAddress(ctx, &ec2.AllocateAddressInput{
+		Domain:            types.DomainTypeVpc,
+		TagSpecifications: resourceTags(types.ResourceTypeElasticIp, spec.Name, spec),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &types.Address{
+		AllocationId: allocateOutput.AllocationId,
+		PublicIp:     allocateOutput.PublicIp,
+	}, true, nil
+}
+
+// associateElasticIp points address to the instance, taking it from any other instance, that's how it moves to a replacement
+func associateElasticIp(ctx context.Context, ec2Client ec2Client, address *types.Address, instanceId string) error {
+	if aws.ToString(address.InstanceId) == instanceId {
+		slog.Debug("Elastic IP " + aws.ToString(address.PublicIp) + " is already associated with " + instanceId)
+		return nil
+	}
+
+	_, err := ec2Client.AssociateAddress(ctx, &ec2.AssociateAddressInput{
+		AllocationId:       address.AllocationId,
+		InstanceId:         aws.String(instanceId),
+		AllowReassociation: aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	address.InstanceId = aws.String(instanceId)
+	return nil
+}
+
+// releaseElasticIp disassociates address if needed and gives it back, missing address counts as released
+func releaseElasticIp(ctx context.Context, ec2Client ec2Client, allocationId string) error {
+	addresses, err := ec2Client.DescribeAddresses(ctx, &ec2.DescribeAddressesInput{
+		AllocationIds: []string{allocationId},
+	})
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addresses.Addresses {
+		if address.AssociationId != nil {
+			_, err = ec2Client.DisassociateAddress(ctx, &ec2.DisassociateAddressInput{AssociationId: address.AssociationId})
+			if err != nil && !isNotFound(err) {
+				return err
+			}
+		}
+
+		_, err = ec2Client.ReleaseAddress(ctx, &ec2.ReleaseAddressInput{AllocationId: address.AllocationId})
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// attachElasticIp gives running instance the spec's stable address, allocating it on first use,
+// returned resource is the address as recorded in state, allocated tells if it's new
+func attachElasticIp(ctx context.Context, app *app, instanceId string) (resource, bool, error) {
+	address, allocated, err := ensureElasticIp(ctx, app.ec2Client, app.spec)
+	if err != nil {
+		return resource{}, false, fmt.Errorf("allocating Elastic IP: %w", err)
+	}
+
+	recorded := resource{Type: resourceElasticIp, ID: aws.ToString(address.AllocationId), Name: app.spec.Name, SpecHash: app.spec.hash()}
+	app.state.record(recorded)
+	err = app.state.save()
+	if err != nil {
+		return recorded, allocated, fmt.Errorf("saving state: %w", err)
+	}
+	if allocated {
+		slog.Debug("Elastic IP allocated: " + aws.ToString(address.PublicIp))
+	}
+
+	err = associateElasticIp(ctx, app.ec2Client, address, instanceId)
+	if err != nil {
+		return recorded, allocated, fmt.Errorf("associating Elastic IP with %s: %w", instanceId, err)
+	}
+
+	slog.Info("Instance " + instanceId + " is reachable at " + aws.ToString(address.PublicIp))
+	return recorded, allocated, nil
+}
+
+// eipCommand moves spec's Elastic IP to given instance, e.g. after it was rolled by hand
+func eipCommand(flags *flag.FlagSet) func(ctx context.Context, app *app) error {
+	var instanceId string
+	flags.StringVar(&instanceId, "instance", "", "String, ID of instance launched by the tool to move Elastic IP to, the only one from state if empty")
+
+	return func(ctx context.Context, app *app) error {
+		instanceRecord, err := managedInstance(app, instanceId)
+		if err != nil {
+			return err
+		}
+
+		alive, err := instanceAlive(ctx, app.ec2Client, instanceRecord.ID)
+		if err != nil {
+			return err
+		}
+		if !alive {
+			return errors.New("instance " + instanceRecord.ID + " is gone")
+		}
+
+		_, _, err = attachElasticIp(ctx, app, instanceRecord.ID)
+		return err
+	}
+}
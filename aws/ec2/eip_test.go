@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestAttachElasticIp(t *testing.T) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	ctx := context.TODO()
+	ec2Client := newLaunchMock()
+	app := &app{ec2Client: ec2Client, spec: testSpec(), state: st}
+
+	_, _, err = attachElasticIp(ctx, app, "i-01")
+	if err != nil {
+		t.Fatal("Error attaching Elastic IP: " + err.Error())
+	}
+
+	// second run finds tagged address already pointing to the instance
+	_, _, err = attachElasticIp(ctx, app, "i-01")
+	if err != nil {
+		t.Fatal("Error attaching Elastic IP again: " + err.Error())
+	}
+
+	if strings.Join(ec2Client.calls, ",") != "AllocateAddress,AssociateAddress" {
+		t.Errorf("address should be allocated and associated once, calls are %v", ec2Client.calls)
+	}
+
+	// replacement instance takes the address over
+	_, _, err = attachElasticIp(ctx, app, "i-02")
+	if err != nil {
+		t.Fatal("Error moving Elastic IP: " + err.Error())
+	}
+
+	if len(ec2Client.addresses) != 1 || aws.ToString(ec2Client.addresses[0].InstanceId) != "i-02" {
+		t.Errorf("the same address should move to the replacement, addresses are %v", ec2Client.addresses)
+	}
+
+	if len(st.find(resourceElasticIp, "")) != 1 {
+		t.Errorf("Elastic IP should be recorded once, state is %v", st.Resources)
+	}
+}
+
+func TestReleaseElasticIp(t *testing.T) {
+	ctx := context.TODO()
+	ec2Client := newLaunchMock()
+	app := &app{ec2Client: ec2Client, spec: testSpec()}
+
+	address, _, err := ensureElasticIp(ctx, ec2Client, app.spec)
+	if err != nil {
+		t.Fatal("Error allocating Elastic IP: " + err.Error())
+	}
+	err = associateElasticIp(ctx, ec2Client, address, "i-01")
+	if err != nil {
+		t.Fatal("Error associating Elastic IP: " + err.Error())
+	}
+
+	err = releaseElasticIp(ctx, ec2Client, *address.AllocationId)
+	if err != nil {
+		t.Fatal("Error releasing Elastic IP: " + err.Error())
+	}
+
+	// released address is gone, releasing it again is a no-op
+	err = releaseElasticIp(ctx, ec2Client, *address.AllocationId)
+	if err != nil {
+		t.Fatal("Error releasing Elastic IP again: " + err.Error())
+	}
+
+	if strings.Join(ec2Client.calls, ",") != "AllocateAddress,AssociateAddress,DisassociateAddress,ReleaseAddress" {
+		t.Errorf("calls are %v", ec2Client.calls)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const imageTimestampLayout string = "20060102-150405"
+
+type bakeOptions struct {
+	instanceId          string
+	stop                bool
+	nameTemplate        string
+	descriptionTemplate string
+	tags                map[string]string
+	now                 time.Time
+}
+
+// imageTemplateData is available to -name and -description templates
+type imageTemplateData struct {
+	Name         string
+	InstanceId   string
+	InstanceType string
+	SpecHash     string
+	Timestamp    string
+}
+
+func imageCommand(flags *flag.FlagSet) func(ctx context.Context, app *app) error {
+	opts := bakeOptions{tags: keyValueFlag{}}
+	var (
+		keep      int
+		pruneOnly bool
+	)
+	flags.StringVar(&opts.instanceId, "instance", "", "String, ID of instance launched by the tool, the only one from state if empty")
+	flags.BoolVar(&opts.stop, "stop", false, "Bool, stop instance before imaging it and start it again after")
+	flags.StringVar(&opts.nameTemplate, "name", "{{.Name}}-{{.Timestamp}}", "String, image name template")
+	flags.StringVar(&opts.descriptionTemplate, "description", "{{.Name}} baked from {{.InstanceId}}", "String, image description template")
+	flags.Var(keyValueFlag(opts.tags), "tag", "key=value, extra tag for image and its snapshots, can be repeated")
+	flags.IntVar(&keep, "keep", 0, "Int, deregister all but this many newest baked images of the spec, 0 keeps all")
+	flags.BoolVar(&pruneOnly, "prune-only", false, "Bool, only apply -keep retention, don't bake a new image")
+
+	return func(ctx context.Context, app *app) error {
+		if !pruneOnly {
+			opts.now = app.now().UTC()
+			imageId, err := bakeImage(ctx, app, opts)
+			if err != nil {
+				return err
+			}
+
+			slog.Info("Image is available: " + imageId)
+		}
+
+		if keep > 0 {
+			pruned, err := pruneImages(ctx, app, keep)
+			for _, imageId := range pruned {
+				slog.Info("Image deregistered: " + imageId)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// managedInstance returns instance record from state, by ID or the only instance of the spec
+func managedInstance(app *app, instanceId string) (resource, error) {
+	instances := app.state.find(resourceInstance, "")
+	if instanceId != "" {
+		for _, r := range instances {
+			if r.ID == instanceId {
+				return r, nil
+			}
+		}
+
+		return resource{}, fmt.Errorf("instance %s isn't in state, launch or import it first", instanceId)
+	}
+
+	ofSpec := []resource{}
+	for _, r := range instances {
+		if r.Name == app.spec.Name {
+			ofSpec = append(ofSpec, r)
+		}
+	}
+	if len(ofSpec) != 1 {
+		return resource{}, fmt.Errorf("%d instances named %s in state, pick one with -instance", len(ofSpec), app.spec.Name)
+	}
+
+	return ofSpec[0], nil
+}
+
+// bakeImage creates AMI from instance launched by the tool, waits till it's available and records it in state,
+// instance stopped for imaging is started again even if baking fails or is interrupted
+func bakeImage(ctx context.Context, app *app, opts bakeOptions) (imageId string, err error) {
+	instanceRecord, err := managedInstance(app, opts.instanceId)
+	if err != nil {
+		return "", err
+	}
+
+	instance, err := describeInstance(ctx, app.ec2Client, instanceRecord.ID)
+	if err != nil {
+		return "", err
+	}
+	if instance == nil {
+		return "", fmt.Errorf("instance %s from state is gone", instanceRecord.ID)
+	}
+
+	data := imageTemplateData{
+		Name:         app.spec.Name,
+		InstanceId:   instanceRecord.ID,
+		InstanceType: string(instance.InstanceType),
+		SpecHash:     app.spec.hash(),
+		Timestamp:    opts.now.Format(imageTimestampLayout),
+	}
+	name, err := renderTemplate(opts.nameTemplate, data)
+	if err != nil {
+		return "", fmt.Errorf("image name template: %w", err)
+	}
+	description, err := renderTemplate(opts.descriptionTemplate, data)
+	if err != nil {
+		return "", fmt.Errorf("image description template: %w", err)
+	}
+
+	if opts.stop && instance.State != nil && instance.State.Name == types.InstanceStateNameRunning {
+		slog.Info("Stopping instance " + instanceRecord.ID)
+		_, err = app.ec2Client.StopInstances(ctx, &ec2.StopInstancesInput{InstanceIds: []string{instanceRecord.ID}})
+		if err != nil {
+			return "", err
+		}
+
+		defer func() {
+			startCtx, cancel := cleanupContext(ctx)
+			defer cancel()
+
+			slog.Info("Starting instance " + instanceRecord.ID + " again")
+			_, startErr := app.ec2Client.StartInstances(startCtx, &ec2.StartInstancesInput{InstanceIds: []string{instanceRecord.ID}})
+			if startErr != nil {
+				err = errors.Join(err, fmt.Errorf("starting instance %s again: %w", instanceRecord.ID, startErr))
+			}
+		}()
+
+		err = ec2.NewInstanceStoppedWaiter(app.ec2Client).Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceRecord.ID}}, waitTimeout)
+		if err != nil {
+			return "", fmt.Errorf("waiting for instance %s to stop: %w", instanceRecord.ID, err)
+		}
+	}
+
+	tagSpecifications := append(
+		resourceTags(types.ResourceTypeImage, app.spec.Name, app.spec),
+		resourceTags(types.ResourceTypeSnapshot, app.spec.Name, app.spec)...,
+	)
+	for i := range tagSpecifications {
+		for key, value := range opts.tags {
+			tagSpecifications[i].Tags = append(tagSpecifications[i].Tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+	}
+
+	createImageOutput, err := app.ec2Client.CreateImage(ctx, &ec2.CreateImageInput{
+		InstanceId:        aws.String(instanceRecord.ID),
+		Name:              aws.String(name),
+		Description:       aws.String(description),
+		TagSpecifications: tagSpecifications,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	imageId = aws.ToString(createImageOutput.ImageId)
+	slog.Debug("Image creation started: " + imageId)
+	app.state.record(resource{Type: resourceImage, ID: imageId, Name: name, SpecHash: app.spec.hash()})
+	err = app.state.save()
+	if err != nil {
+		return imageId, fmt.Errorf("saving state: %w", err)
+	}
+
+	err = ec2.NewImageAvailableWaiter(app.ec2Client).Wait(ctx, &ec2.DescribeImagesInput{ImageIds: []string{imageId}}, waitTimeout)
+	if err != nil {
+		return imageId, fmt.Errorf("waiting for image %s to become available: %w", imageId, err)
+	}
+
+	return imageId, nil
+}
+
+func renderTemplate(text string, data imageTemplateData) (string, error) {
+	tmpl, err := template.New("image").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, data)
+	if err != nil {
+		return "", err
+	}
+
+	return rendered.String(), nil
+}
+
+// pruneImages deregisters all but keep newest images baked for the spec and deletes their snapshots,
+// returning IDs of deregistered images
+func pruneImages(ctx context.Context, app *app, keep int) ([]string, error) {
+	images := []types.Image{}
+	err := eachImage(ctx, app.ec2Client, &ec2.DescribeImagesInput{
+		Owners: []string{"self"},
+		Filters: []types.Filter{
+			{Name: aws.String("tag:" + managedByTagKey), Values: []string{managedByTagValue}},
+			{Name: aws.String("tag:Name"), Values: []string{app.spec.Name}},
+		},
+	}, func(image types.Image) bool {
+		images = append(images, image)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(images) <= keep {
+		return nil, nil
+	}
+
+	// newest first, CreationDate is ISO 8601, so it sorts as a string
+	slices.SortFunc(images, func(a types.Image, b types.Image) int {
+		return strings.Compare(aws.ToString(b.CreationDate), aws.ToString(a.CreationDate))
+	})
+
+	pruned := []string{}
+	errs := []error{}
+	for _, image := range images[keep:] {
+		imageId := aws.ToString(image.ImageId)
+		_, err := app.ec2Client.DeregisterImage(ctx, &ec2.DeregisterImageInput{ImageId: image.ImageId})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("deregistering image %s: %w", imageId, err))
+			continue
+		}
+		pruned = append(pruned, imageId)
+		app.state.forget(resourceImage, imageId)
+
+		// snapshots outlive deregistered image, so they're removed separately
+		for _, blockDevice := range image.BlockDeviceMappings {
+			if blockDevice.Ebs == nil || blockDevice.Ebs.SnapshotId == nil {
+				continue
+			}
+
+			_, err := app.ec2Client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: blockDevice.Ebs.SnapshotId})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("deleting snapshot %s of image %s: %w", *blockDevice.Ebs.SnapshotId, imageId, err))
+			}
+		}
+	}
+
+	err = app.state.save()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("saving state: %w", err))
+	}
+
+	return pruned, errors.Join(errs...)
+}
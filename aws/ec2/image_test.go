@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestBakeImage(t *testing.T) {
+	var mockInstanceId string = "i-0f3f71c5c31adaae2"
+
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	spec := defaultSpec()
+	st.record(resource{Type: resourceInstance, ID: mockInstanceId, Name: spec.Name})
+
+	ctx := context.TODO()
+	ec2Client := newLaunchMock()
+	ec2Client.createImageOutput = &ec2.CreateImageOutput{ImageId: aws.String("ami-0baked")}
+	ec2Client.describeImagesOutput = &ec2.DescribeImagesOutput{
+		Images: []types.Image{{ImageId: aws.String("ami-0baked"), State: types.ImageStateAvailable}},
+	}
+	app := &app{ec2Client: ec2Client, spec: spec, state: st}
+
+	imageId, err := bakeImage(ctx, app, bakeOptions{
+		stop:                true,
+		nameTemplate:        "{{.Name}}-{{.Timestamp}}",
+		descriptionTemplate: "{{.Name}} baked from {{.InstanceId}}",
+		tags:                map[string]string{"release": "1.2"},
+		now:                 time.Date(2024, 8, 15, 10, 30, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal("Error baking image: " + err.Error())
+	}
+
+	if imageId != "ami-0baked" {
+		t.Errorf("image ID is %s, expected ami-0baked", imageId)
+	}
+
+	if strings.Join(ec2Client.calls, ",") != "StopInstances,CreateImage,StartInstances" {
+		t.Errorf("instance should be stopped for imaging and started after, calls are %v", ec2Client.calls)
+	}
+
+	images := st.find(resourceImage, spec.hash())
+	if len(images) != 1 || images[0].Name != spec.Name+"-20240815-103000" {
+		t.Errorf("image with rendered name should be recorded, state is %v", st.Resources)
+	}
+}
+
+func TestBakeImageUnmanagedInstance(t *testing.T) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	app := &app{ec2Client: newLaunchMock(), spec: defaultSpec(), state: st}
+	_, err = bakeImage(context.TODO(), app, bakeOptions{instanceId: "i-unknown"})
+	if err == nil {
+		t.Error("instance not launched by the tool shouldn't be imaged")
+	}
+}
+
+func TestPruneImages(t *testing.T) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	image := func(id string, created string) types.Image {
+		return types.Image{
+			ImageId:      aws.String(id),
+			CreationDate: aws.String(created),
+			BlockDeviceMappings: []types.BlockDeviceMapping{
+				{DeviceName: aws.String("/dev/sda1"), Ebs: &types.EbsBlockDevice{SnapshotId: aws.String("snap-" + id)}},
+				{DeviceName: aws.String("/dev/sdb"), VirtualName: aws.String("ephemeral0")},
+			},
+		}
+	}
+	ec2Client := &mockEc2Client{
+		describeImagesPages: []*ec2.DescribeImagesOutput{
+			{
+				Images:    []types.Image{image("ami-2", "2024-02-01T00:00:00.000Z"), image("ami-4", "2024-04-01T00:00:00.000Z")},
+				NextToken: mockPageToken(1),
+			},
+			{
+				Images: []types.Image{image("ami-1", "2024-01-01T00:00:00.000Z"), image("ami-3", "2024-03-01T00:00:00.000Z")},
+			},
+		},
+	}
+	st.record(resource{Type: resourceImage, ID: "ami-1"})
+	app := &app{ec2Client: ec2Client, spec: defaultSpec(), state: st}
+
+	pruned, err := pruneImages(context.TODO(), app, 2)
+	if err != nil {
+		t.Fatal("Error pruning images: " + err.Error())
+	}
+
+	if strings.Join(pruned, ",") != "ami-2,ami-1" {
+		t.Errorf("two oldest images should be pruned, got %v", pruned)
+	}
+
+	expectedCalls := "DeregisterImage ami-2,DeleteSnapshot snap-ami-2,DeregisterImage ami-1,DeleteSnapshot snap-ami-1"
+	if strings.Join(ec2Client.calls, ",") != expectedCalls {
+		t.Errorf("calls are %v, expected %s", ec2Client.calls, expectedCalls)
+	}
+
+	if len(st.find(resourceImage, "")) != 0 {
+		t.Error("pruned image should be forgotten from state")
+	}
+}
+
+func TestGetAmiIdOwnImages(t *testing.T) {
+	ec2Client := &mockEc2Client{
+		describeImagesOutput: &ec2.DescribeImagesOutput{
+			Images: []types.Image{{ImageId: aws.String("ami-0baked")}},
+		},
+	}
+
+	imageId, err := getAmiId(context.TODO(), ec2Client, imageSelector{Owner: "self", Tags: map[string]string{"Name": "bastion"}})
+	if err != nil {
+		t.Fatal("Error getting own image: " + err.Error())
+	}
+
+	if *imageId != "ami-0baked" {
+		t.Errorf("image ID is %s, expected ami-0baked", *imageId)
+	}
+
+	input := ec2Client.describeImagesInput
+	if input.Owners[0] != "self" || len(input.Filters) != 1 || *input.Filters[0].Name != "tag:Name" || input.Filters[0].Values[0] != "bastion" {
+		t.Errorf("images should be filtered by owner self and Name tag, request is %+v", input)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// keyName is name of key pair instances are launched with, rotate-key replaces it, so the last one in state wins,
+// key pair of unfinished rotation doesn't count
+func (a *app) keyName() string {
+	name := keyPairName
+	for _, keyPair := range a.state.find(resourceKeyPair, "") {
+		if !keyPair.Pending {
+			name = keyPair.Name
+		}
+	}
+
+	return name
+}
+
+// pendingKeyPair is key pair unfinished rotate-key moves hosts to
+func (a *app) pendingKeyPair() (resource, bool) {
+	for _, keyPair := range a.state.find(resourceKeyPair, "") {
+		if keyPair.Pending {
+			return keyPair, true
+		}
+	}
+
+	return resource{}, false
+}
+
+// keyPath is where private key of key pair is kept, <key dir>/<key name>.pem
+func (a *app) keyPath(keyName string) string {
+	return filepath.Join(a.keyDir, keyName+".pem")
+}
+
+// saveKeyMaterial writes private key of just created key pair, AWS hands it out only once,
+// existing file isn't overwritten
+func (a *app) saveKeyMaterial(keyPair *ec2.CreateKeyPairOutput) error {
+	if keyPair.KeyMaterial == nil {
+		return nil
+	}
+
+	path := a.keyPath(aws.ToString(keyPair.KeyName))
+	keyFile, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("private key %s already exists, move it away and remove key pair %s", path, aws.ToString(keyPair.KeyName))
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = keyFile.WriteString(*keyPair.KeyMaterial)
+	closeErr := keyFile.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	slog.Info("Private key of " + aws.ToString(keyPair.KeyName) + " saved to " + path)
+	return nil
+}
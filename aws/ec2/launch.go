@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// launchStep is one unit of launch, resources it creates are rolled back if any later step fails
+type launchStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// launchRun carries what steps of a single launch hand over to each other
+type launchRun struct {
+	app *app
+	// Name tag of launched instances, spec's name unless launching a replacement
+	instanceName     string
+	image            *types.Image
+	securityGroupIds []string
+	instanceIds      []string
+	runningInstances []*types.Instance
+	// resources created by this run in creation order, only these are rolled back
+	created []resource
+}
+
+// launchReport tells how failed launch was cleaned up
+type launchReport struct {
+	finishedSteps []string
+	failedStep    string
+	err           error
+	// steps after the failed one, they never ran
+	skippedSteps []string
+	rolledBack   []resource
+	kept         []resource
+	// resources rollback couldn't destroy, they stay in state for teardown
+	notRolledBack []resource
+	rollbackErrs  []error
+}
+
+func launchCommand(flags *flag.FlagSet) func(ctx context.Context, app *app) error {
+	var keepOnFailure bool
+	flags.BoolVar(&keepOnFailure, "keep-on-failure", false, "Bool, don't roll back resources created by failed launch, for debugging")
+
+	return func(ctx context.Context, app *app) error {
+		return launch(ctx, app, keepOnFailure)
+	}
+}
+
+// launch brings up everything described by spec, resources recorded in state by earlier runs are reused,
+// when a step fails, whatever this run created is destroyed in reverse order, unless keepOnFailure is set
+func launch(ctx context.Context, app *app, keepOnFailure bool) error {
+	specHash := app.spec.hash()
+	for _, r := range app.state.find(resourceInstance, specHash) {
+		alive, err := instanceAlive(ctx, app.ec2Client, r.ID)
+		if err != nil {
+			return fmt.Errorf("checking instance %s from state: %w", r.ID, err)
+		}
+
+		if alive {
+			slog.Info("Instance " + r.ID + " is already launched from spec " + specHash)
+			if app.spec.ElasticIp {
+				_, _, err = attachElasticIp(ctx, app, r.ID)
+			}
+
+			return err
+		}
+
+		slog.Debug("Instance " + r.ID + " from state is gone, forgetting it")
+		app.state.forget(resourceInstance, r.ID)
+	}
+
+	_, err := launchInstances(ctx, app, app.spec.Name, keepOnFailure)
+	return err
+}
+
+// launchInstances runs launch steps for new instances named name and returns their IDs,
+// Elastic IP is only attached to instances carrying spec's name, replacement gets it when it's healthy
+func launchInstances(ctx context.Context, app *app, name string, keepOnFailure bool) ([]string, error) {
+	l := &launchRun{app: app, instanceName: name}
+	attachElasticIp := app.spec.ElasticIp && name == app.spec.Name
+	steps := []launchStep{
+		{"check quota", l.checkQuota},
+		{"resolve image", l.resolveImage},
+		{"check policy", l.checkPolicy},
+		{"key pair", l.ensureKeyPair},
+		{"security group", l.ensureSecurityGroup},
+		{"run instance", l.runInstance},
+	}
+	// volumes and Elastic IP need instance to be running
+	if len(app.spec.Volumes) > 0 || attachElasticIp {
+		steps = append(steps, launchStep{"wait for instance", l.waitRunning})
+	}
+	if len(app.spec.Volumes) > 0 {
+		steps = append(steps, launchStep{"volumes", l.createVolumes})
+	}
+	if attachElasticIp {
+		steps = append(steps, launchStep{"elastic IP", l.attachElasticIp})
+	}
+
+	report := l.runSteps(ctx, steps, keepOnFailure)
+	if report.err == nil {
+		return l.instanceIds, nil
+	}
+
+	printLaunchReport(os.Stdout, report)
+	return nil, errors.Join(append([]error{fmt.Errorf("%s: %w", report.failedStep, report.err)}, report.rollbackErrs...)...)
+}
+
+// runSteps runs steps in order, on the first failure it rolls back everything created so far
+func (l *launchRun) runSteps(ctx context.Context, steps []launchStep, keepOnFailure bool) launchReport {
+	report := launchReport{}
+	for i, step := range steps {
+		slog.Debug("Launch step: " + step.name)
+		err := step.run(ctx)
+		if err != nil {
+			report.failedStep = step.name
+			report.err = err
+			for _, skipped := range steps[i+1:] {
+				report.skippedSteps = append(report.skippedSteps, skipped.name)
+			}
+			break
+		}
+
+		report.finishedSteps = append(report.finishedSteps, step.name)
+	}
+
+	if report.err == nil {
+		return report
+	}
+
+	if keepOnFailure {
+		report.kept = l.created
+		return report
+	}
+
+	// rollback has to run even when launch failed because it was interrupted or ran out of time
+	cleanupCtx, cancel := cleanupContext(ctx)
+	defer cancel()
+
+	for i := len(l.created) - 1; i >= 0; i-- {
+		r := l.created[i]
+		slog.Debug("Rolling back " + string(r.Type) + " " + r.ID)
+		err := destroyResource(cleanupCtx, l.app.ec2Client, r)
+		if err != nil {
+			report.notRolledBack = append(report.notRolledBack, r)
+			report.rollbackErrs = append(report.rollbackErrs, fmt.Errorf("rolling back %s %s: %w", r.Type, r.ID, err))
+			continue
+		}
+
+		report.rolledBack = append(report.rolledBack, r)
+		l.app.state.forget(r.Type, r.ID)
+	}
+
+	err := l.app.state.save()
+	if err != nil {
+		report.rollbackErrs = append(report.rollbackErrs, fmt.Errorf("saving state after rollback: %w", err))
+	}
+
+	return report
+}
+
+// track records resource created by this run, state is saved right away, so a crash half-way doesn't lose track of it
+func (l *launchRun) track(r resource) error {
+	r.SpecHash = l.app.spec.hash()
+	l.created = append(l.created, r)
+	l.app.state.record(r)
+
+	err := l.app.state.save()
+	if err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+
+	return nil
+}
+
+func (l *launchRun) checkQuota(ctx context.Context) error {
+	return checkVcpuQuota(ctx, l.app, l.app.spec.InstanceType, instanceCount)
+}
+
+func (l *launchRun) resolveImage(ctx context.Context) error {
+	image, err := findImage(ctx, l.app.ec2Client, l.app.spec.Image)
+	if err != nil {
+		return fmt.Errorf("getting list of image IDs by filter: %w", err)
+	}
+
+	l.image = image
+	return nil
+}
+
+// checkPolicy blocks launch before anything is created, security groups aren't known yet, they don't matter to policy
+func (l *launchRun) checkPolicy(ctx context.Context) error {
+	return l.app.policy.check(runInstancesInput(l.app.spec, l.instanceName, l.app.keyName(), *l.image, nil), l.app.spec.SecurityGroup)
+}
+
+func (l *launchRun) ensureKeyPair(ctx context.Context) error {
+	keyName := l.app.keyName()
+	keyPairFound, err := lookUpKeyPair(ctx, l.app.ec2Client, keyName)
+	if err != nil {
+		return fmt.Errorf("getting list of key pairs by filter: %w", err)
+	}
+
+	if keyPairFound {
+		return nil
+	}
+
+	keyPairCreatedOutput, err := createKeyPair(ctx, l.app.ec2Client, keyName)
+	if err != nil {
+		return fmt.Errorf("creating key pair: %w", err)
+	}
+
+	slog.Debug("Key pair created: " + *keyPairCreatedOutput.KeyName)
+	err = l.track(resource{Type: resourceKeyPair, ID: aws.ToString(keyPairCreatedOutput.KeyPairId), Name: *keyPairCreatedOutput.KeyName})
+	if err != nil {
+		return err
+	}
+
+	return l.app.saveKeyMaterial(keyPairCreatedOutput)
+}
+
+func (l *launchRun) ensureSecurityGroup(ctx context.Context) error {
+	if l.app.spec.SecurityGroup == nil {
+		return nil
+	}
+
+	securityGroup, found := l.app.state.findByName(resourceSecurityGroup, l.app.spec.SecurityGroup.Name)
+	if found {
+		slog.Debug("Security group reused from state: " + securityGroup.ID)
+		l.securityGroupIds = append(l.securityGroupIds, securityGroup.ID)
+		return nil
+	}
+
+	securityGroupId, err := createSecurityGroup(ctx, l.app.ec2Client, l.app.spec)
+	if securityGroupId != nil {
+		slog.Debug("Security group created: " + *securityGroupId)
+		l.securityGroupIds = append(l.securityGroupIds, *securityGroupId)
+		trackErr := l.track(resource{Type: resourceSecurityGroup, ID: *securityGroupId, Name: l.app.spec.SecurityGroup.Name})
+		if trackErr != nil {
+			return trackErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("creating security group: %w", err)
+	}
+
+	return nil
+}
+
+func (l *launchRun) runInstance(ctx context.Context) error {
+	ec2RunOutput, err := createEc2Instance(ctx, l.app.ec2Client, runInstancesInput(l.app.spec, l.instanceName, l.app.keyName(), *l.image, l.securityGroupIds))
+	if err != nil {
+		return fmt.Errorf("starting EC2 instance: %w", err)
+	}
+
+	for _, ec2instance := range ec2RunOutput.Instances {
+		slog.Debug("Instance started: " + *ec2instance.InstanceId)
+		l.instanceIds = append(l.instanceIds, *ec2instance.InstanceId)
+		err = l.track(resource{Type: resourceInstance, ID: *ec2instance.InstanceId, Name: l.instanceName})
+		if err != nil {
+			return err
+		}
+		slog.Info("Instance " + *ec2instance.InstanceId + " launched from " + aws.ToString(l.image.ImageId) + ", SSH user is " + l.app.spec.Image.sshUser())
+	}
+
+	return nil
+}
+
+func (l *launchRun) waitRunning(ctx context.Context) error {
+	for _, instanceId := range l.instanceIds {
+		runningInstance, err := waitInstanceRunning(ctx, l.app.ec2Client, instanceId)
+		if err != nil {
+			return fmt.Errorf("waiting for instance %s to run: %w", instanceId, err)
+		}
+
+		l.runningInstances = append(l.runningInstances, runningInstance)
+	}
+
+	return nil
+}
+
+func (l *launchRun) createVolumes(ctx context.Context) error {
+	for _, runningInstance := range l.runningInstances {
+		for _, volume := range l.app.spec.Volumes {
+			volumeId, err := createVolume(ctx, l.app.ec2Client, l.app.spec, volume, runningInstance)
+			if volumeId != nil {
+				slog.Debug("Volume created: " + *volumeId)
+				trackErr := l.track(resource{Type: resourceVolume, ID: *volumeId, Name: l.app.spec.Name + " " + volume.Device})
+				if trackErr != nil {
+					return trackErr
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("creating volume %s: %w", volume.Device, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (l *launchRun) attachElasticIp(ctx context.Context) error {
+	for _, instanceId := range l.instanceIds {
+		address, allocated, err := attachElasticIp(ctx, l.app, instanceId)
+		// reused address isn't this run's to roll back, only a freshly allocated one is
+		if allocated {
+			l.created = append(l.created, address)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func printLaunchReport(w io.Writer, report launchReport) {
+	fmt.Fprintf(w, "Launch failed at %q step: %s\n", report.failedStep, report.err)
+	if len(report.finishedSteps) > 0 {
+		fmt.Fprintln(w, "Finished steps: "+strings.Join(report.finishedSteps, ", "))
+	}
+	if len(report.skippedSteps) > 0 {
+		fmt.Fprintln(w, "Not started steps: "+strings.Join(report.skippedSteps, ", "))
+	}
+
+	if len(report.rolledBack) > 0 {
+		fmt.Fprintln(w, "Rolled back:")
+		for _, r := range report.rolledBack {
+			fmt.Fprintf(w, "  %s %s (%s)\n", r.Type, r.ID, r.Name)
+		}
+	}
+
+	if len(report.notRolledBack) > 0 {
+		fmt.Fprintln(w, "Failed to roll back, left in state, run teardown to retry:")
+		for i, r := range report.notRolledBack {
+			fmt.Fprintf(w, "  %s %s (%s): %s\n", r.Type, r.ID, r.Name, report.rollbackErrs[i])
+		}
+	}
+
+	if len(report.kept) > 0 {
+		fmt.Fprintln(w, "Kept for debugging, run teardown to remove:")
+		for _, r := range report.kept {
+			fmt.Fprintf(w, "  %s %s (%s)\n", r.Type, r.ID, r.Name)
+		}
+	}
+}
+
+// instanceAlive tells if instance still exists and isn't on its way out
+func instanceAlive(ctx context.Context, ec2Client ec2Client, instanceId string) (bool, error) {
+	instance, err := describeInstance(ctx, ec2Client, instanceId)
+	if err != nil || instance == nil || instance.State == nil {
+		return false, err
+	}
+
+	return instance.State.Name != types.InstanceStateNameTerminated && instance.State.Name != types.InstanceStateNameShuttingDown, nil
+}
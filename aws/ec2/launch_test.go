@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// newLaunchMock returns fake client where every launch step succeeds
+func newLaunchMock() *mockEc2Client {
+	var mockInstanceId string = "i-0f3f71c5c31adaae2"
+
+	return &mockEc2Client{
+		describeImagesOutput: &ec2.DescribeImagesOutput{
+			Images: []types.Image{{ImageId: aws.String(mockImageId)}},
+		},
+		describeKeyPairsOutput: &ec2.DescribeKeyPairsOutput{},
+		createKeyPairOutput: &ec2.CreateKeyPairOutput{
+			KeyName:   aws.String(keyPairName),
+			KeyPairId: aws.String("key-0a1b2c3d"),
+		},
+		createSecurityGroupOutput: &ec2.CreateSecurityGroupOutput{
+			GroupId: aws.String("sg-0a1b2c3d"),
+		},
+		runInstancesOutput: &ec2.RunInstancesOutput{
+			Instances: []types.Instance{{InstanceId: aws.String(mockInstanceId)}},
+		},
+		describeInstancesOutput: &ec2.DescribeInstancesOutput{
+			Reservations: []types.Reservation{
+				{
+					Instances: []types.Instance{
+						{
+							InstanceId: aws.String(mockInstanceId),
+							State:      &types.InstanceState{Name: types.InstanceStateNameRunning},
+							Placement:  &types.Placement{AvailabilityZone: aws.String("eu-central-1a")},
+						},
+					},
+				},
+			},
+		},
+		describeInstanceTypesOutput: &ec2.DescribeInstanceTypesOutput{
+			InstanceTypes: []types.InstanceTypeInfo{{InstanceType: types.InstanceTypeT3Micro, VCpuInfo: &types.VCpuInfo{DefaultVCpus: aws.Int32(2)}}},
+		},
+		createVolumeOutput: &ec2.CreateVolumeOutput{
+			VolumeId: aws.String("vol-0a1b2c3d"),
+		},
+		describeVolumesOutput: &ec2.DescribeVolumesOutput{
+			Volumes: []types.Volume{{VolumeId: aws.String("vol-0a1b2c3d"), State: types.VolumeStateAvailable}},
+		},
+	}
+}
+
+func testSpec() launchSpec {
+	spec := defaultSpec()
+	spec.SecurityGroup = &securityGroupSpec{
+		Name:        "ec2-sg",
+		Description: "SSH access",
+		Ingress:     []ingressRule{{Protocol: "tcp", FromPort: 22, ToPort: 22, CidrIp: "10.0.0.0/8"}},
+	}
+	spec.Volumes = []volumeSpec{{Device: "/dev/sdf", SizeGiB: 10, Type: "gp3"}}
+	spec.ElasticIp = true
+
+	return spec
+}
+
+func TestLaunchRecordsResources(t *testing.T) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	ctx := context.TODO()
+	ec2Client := newLaunchMock()
+	app := &app{ec2Client: ec2Client, quotasClient: &mockQuotasClient{quota: 32}, spec: testSpec(), state: st}
+
+	err = launch(ctx, app, false)
+	if err != nil {
+		t.Fatal("Error launching: " + err.Error())
+	}
+
+	expectedCalls := "CreateKeyPair,CreateSecurityGroup,AuthorizeSecurityGroupIngress,RunInstances,CreateVolume,AttachVolume,AllocateAddress,AssociateAddress"
+	if strings.Join(ec2Client.calls, ",") != expectedCalls {
+		t.Errorf("calls are %v, expected %s", ec2Client.calls, expectedCalls)
+	}
+
+	specHash := app.spec.hash()
+	for _, rt := range []resourceType{resourceKeyPair, resourceSecurityGroup, resourceInstance, resourceVolume, resourceElasticIp} {
+		if len(st.find(rt, specHash)) != 1 {
+			t.Errorf("expected one %s recorded for spec %s, state is %v", rt, specHash, st.Resources)
+		}
+	}
+}
+
+func TestLaunchReusesRecordedInstance(t *testing.T) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	ctx := context.TODO()
+	ec2Client := newLaunchMock()
+	ec2Client.addresses = []types.Address{
+		{
+			AllocationId: aws.String("eipalloc-0"),
+			InstanceId:   aws.String("i-0f3f71c5c31adaae2"),
+			Tags:         []types.Tag{{Key: aws.String("Name"), Value: aws.String(defaultInstanceName)}},
+		},
+	}
+	app := &app{ec2Client: ec2Client, quotasClient: &mockQuotasClient{quota: 32}, spec: testSpec(), state: st}
+	st.record(resource{Type: resourceInstance, ID: "i-0f3f71c5c31adaae2", SpecHash: app.spec.hash()})
+
+	err = launch(ctx, app, false)
+	if err != nil {
+		t.Fatal("Error launching: " + err.Error())
+	}
+
+	if len(ec2Client.calls) != 0 {
+		t.Errorf("nothing should be created when instance from state is alive, calls are %v", ec2Client.calls)
+	}
+}
+
+func TestLaunchRollback(t *testing.T) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	ctx := context.TODO()
+	ec2Client := newLaunchMock()
+	ec2Client.failOn = map[string]error{"AssociateAddress": errors.New("AddressLimitExceeded")}
+	app := &app{ec2Client: ec2Client, quotasClient: &mockQuotasClient{quota: 32}, spec: testSpec(), state: st}
+
+	err = launch(ctx, app, false)
+	if err == nil {
+		t.Fatal("launch should fail when Elastic IP can't be associated")
+	}
+
+	expectedCalls := "CreateKeyPair,CreateSecurityGroup,AuthorizeSecurityGroupIngress,RunInstances,CreateVolume,AttachVolume,AllocateAddress,AssociateAddress," +
+		"ReleaseAddress,DeleteVolume,TerminateInstances,DeleteSecurityGroup,DeleteKeyPair"
+	if strings.Join(ec2Client.calls, ",") != expectedCalls {
+		t.Errorf("created resources should be destroyed in reverse order, calls are %v, expected %s", ec2Client.calls, expectedCalls)
+	}
+
+	if len(st.Resources) != 0 {
+		t.Errorf("rolled back resources should be forgotten, state is %v", st.Resources)
+	}
+}
+
+func TestLaunchRollbackKeepsReused(t *testing.T) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	ctx := context.TODO()
+	ec2Client := newLaunchMock()
+	ec2Client.describeKeyPairsOutput = &ec2.DescribeKeyPairsOutput{KeyPairs: []types.KeyPairInfo{{KeyName: aws.String(keyPairName)}}}
+	ec2Client.addresses = []types.Address{{AllocationId: aws.String("eipalloc-0")}}
+	ec2Client.failOn = map[string]error{"AssociateAddress": errors.New("InvalidInstanceID")}
+	spec := defaultSpec()
+	spec.ElasticIp = true
+	app := &app{ec2Client: ec2Client, quotasClient: &mockQuotasClient{quota: 32}, spec: spec, state: st}
+
+	err = launch(ctx, app, false)
+	if err == nil {
+		t.Fatal("launch should fail when Elastic IP can't be associated")
+	}
+
+	if strings.Join(ec2Client.calls, ",") != "RunInstances,AssociateAddress,TerminateInstances" {
+		t.Errorf("existing key pair and Elastic IP shouldn't be rolled back, calls are %v", ec2Client.calls)
+	}
+}
+
+func TestLaunchKeepOnFailure(t *testing.T) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	ctx := context.TODO()
+	ec2Client := newLaunchMock()
+	ec2Client.failOn = map[string]error{"RunInstances": errors.New("InsufficientInstanceCapacity")}
+	app := &app{ec2Client: ec2Client, quotasClient: &mockQuotasClient{quota: 32}, spec: testSpec(), state: st}
+
+	err = launch(ctx, app, true)
+	if err == nil {
+		t.Fatal("launch should fail when instance can't be run")
+	}
+
+	if strings.Join(ec2Client.calls, ",") != "CreateKeyPair,CreateSecurityGroup,AuthorizeSecurityGroupIngress,RunInstances" {
+		t.Errorf("nothing should be rolled back with keepOnFailure, calls are %v", ec2Client.calls)
+	}
+
+	if len(st.find(resourceKeyPair, "")) != 1 || len(st.find(resourceSecurityGroup, "")) != 1 {
+		t.Errorf("kept resources should stay in state for teardown, state is %v", st.Resources)
+	}
+}
+
+func TestPrintLaunchReport(t *testing.T) {
+	var output bytes.Buffer
+	printLaunchReport(&output, launchReport{
+		finishedSteps: []string{"resolve image", "run instance"},
+		skippedSteps:  []string{"elastic IP"},
+		failedStep:    "volumes",
+		err:           errors.New("VolumeLimitExceeded"),
+		rolledBack:    []resource{{Type: resourceInstance, ID: "i-01", Name: "bastion"}},
+		notRolledBack: []resource{{Type: resourceSecurityGroup, ID: "sg-01", Name: "bastion-sg"}},
+		rollbackErrs:  []error{errors.New("DependencyViolation")},
+	})
+
+	expected := `Launch failed at "volumes" step: VolumeLimitExceeded
+Finished steps: resolve image, run instance
+Not started steps: elastic IP
+Rolled back:
+  instance i-01 (bastion)
+Failed to roll back, left in state, run teardown to retry:
+  security-group sg-01 (bastion-sg): DependencyViolation
+`
+	if output.String() != expected {
+		t.Errorf("report is:\n%s\nexpected:\n%s", output.String(), expected)
+	}
+}
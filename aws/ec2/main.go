@@ -2,18 +2,32 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"log/slog"
 	"os"
+	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/servicequotas"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
 
-const (
-	keyPairName           string = "ec2-key"
-	ubuntuImageNameFilter string = "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-*"
-	canonicalsId          string = "099720109477"
-)
+const keyPairName string = "ec2-key"
+
+// app is what every command works with
+type app struct {
+	ec2Client    ec2Client
+	quotasClient quotasClient
+	stsClient    stsClient
+	spec         launchSpec
+	// directory private keys are saved to and read from
+	keyDir string
+	policy launchPolicy
+	state  *state
+	now    func() time.Time
+}
 
 func main() {
 	// construct default logger
@@ -26,38 +40,176 @@ func main() {
 		programLevel.Set(slog.LevelDebug)
 	}
 
-	ctx := context.TODO()
-	cfg, err := config.LoadDefaultConfig(ctx)
+	// first argument names the command, launch is the default, so plain `go run *.go` works as before
+	command, args := "launch", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	statePath := flags.String("state", envOrDefault("EC2_STATE_FILE", defaultStateFile), "String, path to local state file, EC2_STATE_FILE env")
+	specPath := flags.String("spec", os.Getenv("EC2_SPEC_FILE"), "String, path to launch spec JSON, built-in defaults if empty, EC2_SPEC_FILE env")
+	osName := flags.String("os", "", "String, OS from the image catalog to launch, like ubuntu-24.04, overrides spec's image")
+	arch := flags.String("arch", "", "String, architecture of -os image, amd64 (default) or arm64")
+	catalogPath := flags.String("os-catalog", os.Getenv("EC2_OS_CATALOG"), "String, path to JSON with extra OS image families, EC2_OS_CATALOG env")
+	keyDir := flags.String("key-dir", envOrDefault("EC2_KEY_DIR", "."), "String, directory with private keys of key pairs, EC2_KEY_DIR env")
+	policyPath := flags.String("policy", os.Getenv("EC2_POLICY_FILE"), "String, path to policy JSON launch request is checked against, EC2_POLICY_FILE env")
+	timeout := flags.Duration("timeout", 30*time.Minute, "Duration, deadline for the whole command, 0 for none")
+	callTimeout := flags.Duration("call-timeout", time.Minute, "Duration, deadline for a single AWS API call, retries included")
+	awsOpts := awsOptions{}
+	awsOpts.register(flags)
+
+	var run func(ctx context.Context, app *app) error
+	// commands changing AWS resources print the account they run as first
+	mutating := false
+	// commands only looking at state don't lock it, console -follow would block other runs for long
+	readOnly := false
+	switch command {
+	case "launch":
+		run = launchCommand(flags)
+		mutating = true
+	case "import":
+		run = importCommand(flags)
+	case "state":
+		run = stateCommand
+		readOnly = true
+	case "plan", "diff":
+		run = planCommand(flags)
+		readOnly = true
+	case "image":
+		run = imageCommand(flags)
+		mutating = true
+	case "eip":
+		run = eipCommand(flags)
+		mutating = true
+	case "teardown":
+		run = teardownCommand(flags)
+		mutating = true
+	case "schedule":
+		run = scheduleCommand(flags)
+		mutating = true
+	case "resize":
+		run = resizeCommand(flags)
+		mutating = true
+	case "replace":
+		run = replaceCommand(flags)
+		mutating = true
+	case "rotate-key":
+		run = rotateKeyCommand(flags)
+		mutating = true
+	case "console":
+		run = consoleCommand(flags)
+		readOnly = true
+	case "whoami":
+		run = whoamiCommand
+		readOnly = true
+	default:
+		slog.Error("Unknown command " + command + ", expected one of: launch, import, state, plan, image, eip, teardown, schedule, resize, replace, rotate-key, console, whoami")
+		os.Exit(1)
+	}
+	flags.Parse(args)
+
+	err := loadOsCatalog(*catalogPath)
 	if err != nil {
-		slog.Error("Error constructing AWS config: " + err.Error())
+		slog.Error("Error loading OS catalog: " + err.Error())
+		os.Exit(1)
+	}
+
+	spec, err := loadSpec(*specPath)
+	if err == nil {
+		err = spec.selectOS(*osName, *arch)
+	}
+	if err != nil {
+		slog.Error("Error loading launch spec: " + err.Error())
+		os.Exit(1)
 	}
-	ec2Client := ec2.NewFromConfig(cfg)
 
-	ubuntuAmiId, err := getAmiId(ctx, ec2Client)
+	policy, err := loadPolicy(*policyPath)
 	if err != nil {
-		slog.Error("Error getting list of image IDs by filter: " + err.Error())
+		slog.Error("Error loading policy: " + err.Error())
+		os.Exit(1)
 	}
 
-	keyPairFound, err := lookUpKeyPair(ctx, ec2Client)
+	ctx, cancel := rootContext(*timeout)
+	defer cancel()
+
+	cfg, err := loadAwsConfig(ctx, awsOpts, *callTimeout)
 	if err != nil {
-		slog.Error("Error getting list of key pairs by filter: " + err.Error())
+		slog.Error("Error constructing AWS config: " + err.Error())
+		os.Exit(1)
 	}
+	ec2Client := ec2.NewFromConfig(cfg)
+	stsClient := sts.NewFromConfig(cfg)
 
-	if !keyPairFound {
-		keyPairCreatedOutput, err := createKeyPair(ctx, ec2Client)
+	if mutating {
+		_, err = whoami(ctx, stsClient)
 		if err != nil {
-			slog.Error("Error creating key pair: " + err.Error())
+			slog.Error("Error checking AWS identity: " + err.Error())
+			cancel()
+			os.Exit(1)
 		}
+	}
 
-		slog.Debug("Key pair created: " + *keyPairCreatedOutput.KeyName)
+	openFn := openState
+	if readOnly {
+		openFn = readState
+	}
+	st, err := openFn(*statePath)
+	if err != nil {
+		slog.Error("Error opening state: " + err.Error())
+		os.Exit(1)
 	}
 
-	ec2RunOutput, err := createEc2Instance(ctx, ec2Client, ubuntuAmiId)
+	err = run(ctx, &app{
+		ec2Client:    ec2Client,
+		quotasClient: servicequotas.NewFromConfig(cfg),
+		stsClient:    stsClient,
+		spec:         spec,
+		keyDir:       *keyDir,
+		policy:       policy,
+		state:        st,
+		now:          time.Now,
+	})
+	st.close()
+	if errors.Is(err, errDriftDetected) {
+		os.Exit(2)
+	}
+	if err != nil && ctx.Err() != nil {
+		slog.Error(command + " was aborted: " + context.Cause(ctx).Error())
+	}
 	if err != nil {
-		slog.Error("Error starting EC2 instance: " + err.Error())
+		slog.Error("Error running " + command + ": " + err.Error())
+		cancel()
+		os.Exit(1)
+	}
+}
+
+func envOrDefault(key string, defaultValue string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
 	}
 
-	for _, ec2instance := range ec2RunOutput.Instances {
-		slog.Debug("Instance started: " + *ec2instance.InstanceId)
+	return defaultValue
+}
+
+// keyValueFlag collects repeated -flag key=value pairs
+type keyValueFlag map[string]string
+
+func (f keyValueFlag) String() string {
+	pairs := []string{}
+	for key, value := range f {
+		pairs = append(pairs, key+"="+value)
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (f keyValueFlag) Set(pair string) error {
+	key, value, found := strings.Cut(pair, "=")
+	if !found || key == "" {
+		return errors.New("expected key=value, got " + pair)
 	}
+
+	f[key] = value
+	return nil
 }
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// errDriftDetected is returned by plan when live resources differ from spec, main exits with 2 on it
+var errDriftDetected = errors.New("drift detected")
+
+// resourceDiff lists attribute differences of a single resource, expected comes from spec, actual from AWS
+type resourceDiff struct {
+	Type    resourceType    `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Name    string          `json:"name"`
+	Changes []attributeDiff `json:"changes"`
+}
+
+type attributeDiff struct {
+	Attribute string `json:"attribute"`
+	Expected  string `json:"expected,omitempty"`
+	Actual    string `json:"actual,omitempty"`
+}
+
+func planCommand(flags *flag.FlagSet) func(ctx context.Context, app *app) error {
+	var jsonOutput bool
+	flags.BoolVar(&jsonOutput, "json", false, "Bool, print differences as JSON")
+
+	return func(ctx context.Context, app *app) error {
+		diffs, err := plan(ctx, app)
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput {
+			err = printDiffsJSON(os.Stdout, diffs)
+		} else {
+			err = printDiffs(os.Stdout, diffs)
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(diffs) > 0 {
+			return errDriftDetected
+		}
+
+		return nil
+	}
+}
+
+// plan compares spec against live instances and security group, instances come from state and from tags,
+// so resources renamed or launched by older spec versions are still checked
+func plan(ctx context.Context, app *app) ([]resourceDiff, error) {
+	diffs := []resourceDiff{}
+
+	securityGroupId := ""
+	if app.spec.SecurityGroup != nil {
+		securityGroup, err := findSecurityGroup(ctx, app)
+		if err != nil {
+			return nil, err
+		}
+
+		if securityGroup == nil {
+			recorded, _ := app.state.findByName(resourceSecurityGroup, app.spec.SecurityGroup.Name)
+			diffs = append(diffs, missingResource(resourceSecurityGroup, recorded.ID, app.spec.SecurityGroup.Name))
+		} else {
+			securityGroupId = aws.ToString(securityGroup.GroupId)
+			changes := diffSecurityGroup(app.spec, *securityGroup)
+			if len(changes) > 0 {
+				diffs = append(diffs, resourceDiff{Type: resourceSecurityGroup, ID: securityGroupId, Name: app.spec.SecurityGroup.Name, Changes: changes})
+			}
+		}
+	}
+
+	instances := []types.Instance{}
+	for _, r := range app.state.find(resourceInstance, "") {
+		if r.Name != app.spec.Name {
+			continue
+		}
+
+		instance, err := describeInstance(ctx, app.ec2Client, r.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if instance == nil || instance.State == nil || instance.State.Name == types.InstanceStateNameTerminated {
+			diffs = append(diffs, missingResource(resourceInstance, r.ID, r.Name))
+			continue
+		}
+		instances = append(instances, *instance)
+	}
+
+	err := eachInstance(ctx, app.ec2Client, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("tag:Name"), Values: []string{app.spec.Name}},
+			{Name: aws.String("tag:" + managedByTagKey), Values: []string{managedByTagValue}},
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}},
+		},
+	}, func(instance types.Instance) bool {
+		known := slices.ContainsFunc(instances, func(i types.Instance) bool {
+			return aws.ToString(i.InstanceId) == aws.ToString(instance.InstanceId)
+		})
+		if !known {
+			instances = append(instances, instance)
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(instances) == 0 && !slices.ContainsFunc(diffs, func(d resourceDiff) bool { return d.Type == resourceInstance }) {
+		diffs = append(diffs, missingResource(resourceInstance, "", app.spec.Name))
+	}
+
+	for _, instance := range instances {
+		changes := diffInstance(app.spec, instance, securityGroupId)
+		if len(changes) > 0 {
+			diffs = append(diffs, resourceDiff{Type: resourceInstance, ID: aws.ToString(instance.InstanceId), Name: app.spec.Name, Changes: changes})
+		}
+	}
+
+	return diffs, nil
+}
+
+// findSecurityGroup looks spec's security group up by ID from state, then by name,
+// group deleted behind the tool's back is nil, so it's reported missing
+func findSecurityGroup(ctx context.Context, app *app) (*types.SecurityGroup, error) {
+	input := &ec2.DescribeSecurityGroupsInput{
+		Filters: []types.Filter{{Name: aws.String("group-name"), Values: []string{app.spec.SecurityGroup.Name}}},
+	}
+	if recorded, found := app.state.findByName(resourceSecurityGroup, app.spec.SecurityGroup.Name); found {
+		input = &ec2.DescribeSecurityGroupsInput{GroupIds: []string{recorded.ID}}
+	}
+
+	var found *types.SecurityGroup
+	err := eachSecurityGroup(ctx, app.ec2Client, input, func(securityGroup types.SecurityGroup) bool {
+		found = &securityGroup
+		return false
+	})
+	if isNotFound(err) {
+		return nil, nil
+	}
+
+	return found, err
+}
+
+func missingResource(t resourceType, id string, name string) resourceDiff {
+	return resourceDiff{
+		Type:    t,
+		ID:      id,
+		Name:    name,
+		Changes: []attributeDiff{{Attribute: "exists", Expected: "true", Actual: "false"}},
+	}
+}
+
+// diffInstance compares live instance with spec, securityGroupId is spec's group, if it has one
+func diffInstance(spec launchSpec, instance types.Instance, securityGroupId string) []attributeDiff {
+	changes := []attributeDiff{}
+
+	if instance.State != nil && instance.State.Name != types.InstanceStateNameRunning {
+		changes = append(changes, attributeDiff{Attribute: "state", Expected: string(types.InstanceStateNameRunning), Actual: string(instance.State.Name)})
+	}
+
+	if string(instance.InstanceType) != spec.InstanceType {
+		changes = append(changes, attributeDiff{Attribute: "instance-type", Expected: spec.InstanceType, Actual: string(instance.InstanceType)})
+	}
+
+	changes = append(changes, diffTags(spec, spec.Name, instance.Tags)...)
+
+	if securityGroupId != "" {
+		attached := slices.ContainsFunc(instance.SecurityGroups, func(group types.GroupIdentifier) bool {
+			return aws.ToString(group.GroupId) == securityGroupId
+		})
+		if !attached {
+			changes = append(changes, attributeDiff{Attribute: "security-group", Expected: securityGroupId})
+		}
+	}
+
+	return changes
+}
+
+// diffTags compares tags the tool sets with live ones, spec hash and AWS own tags aren't compared
+func diffTags(spec launchSpec, name string, liveTags []types.Tag) []attributeDiff {
+	expected := map[string]string{
+		"Name":          name,
+		managedByTagKey: managedByTagValue,
+	}
+	for key, value := range spec.Tags {
+		expected[key] = value
+	}
+
+	actual := map[string]string{}
+	for _, tag := range liveTags {
+		key := aws.ToString(tag.Key)
+		if key == specHashTagKey || strings.HasPrefix(key, "aws:") {
+			continue
+		}
+		actual[key] = aws.ToString(tag.Value)
+	}
+
+	changes := []attributeDiff{}
+	for _, key := range sortedKeys(expected, actual) {
+		expectedValue, inSpec := expected[key]
+		actualValue, live := actual[key]
+		if inSpec && live && expectedValue == actualValue {
+			continue
+		}
+
+		change := attributeDiff{Attribute: "tag " + key}
+		if inSpec {
+			change.Expected = expectedValue
+		}
+		if live {
+			change.Actual = actualValue
+		}
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+// diffSecurityGroup compares ingress rules, every rule is flattened to "protocol from-to cidr"
+func diffSecurityGroup(spec launchSpec, securityGroup types.SecurityGroup) []attributeDiff {
+	expected := map[string]string{}
+	for _, rule := range spec.SecurityGroup.Ingress {
+		expected[fmt.Sprintf("%s %d-%d %s", rule.Protocol, rule.FromPort, rule.ToPort, rule.CidrIp)] = "present"
+	}
+
+	actual := map[string]string{}
+	for _, permission := range securityGroup.IpPermissions {
+		for _, ipRange := range permission.IpRanges {
+			rule := fmt.Sprintf("%s %d-%d %s", aws.ToString(permission.IpProtocol), aws.ToInt32(permission.FromPort), aws.ToInt32(permission.ToPort), aws.ToString(ipRange.CidrIp))
+			actual[rule] = "present"
+		}
+	}
+
+	changes := []attributeDiff{}
+	for _, rule := range sortedKeys(expected, actual) {
+		if expected[rule] != actual[rule] {
+			changes = append(changes, attributeDiff{Attribute: "ingress " + rule, Expected: expected[rule], Actual: actual[rule]})
+		}
+	}
+
+	return changes
+}
+
+// sortedKeys returns keys of both maps once, sorted, so output is stable between runs
+func sortedKeys(first map[string]string, second map[string]string) []string {
+	keys := []string{}
+	for key := range first {
+		keys = append(keys, key)
+	}
+	for key := range second {
+		if _, ok := first[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	return keys
+}
+
+func printDiffs(w io.Writer, diffs []resourceDiff) error {
+	if len(diffs) == 0 {
+		_, err := fmt.Fprintln(w, "No drift, live resources match the spec")
+		return err
+	}
+
+	fmt.Fprintln(w, "Drift detected, spec => live:")
+	for _, diff := range diffs {
+		fmt.Fprintf(w, "~ %s %s (%s)\n", diff.Type, diff.ID, diff.Name)
+		for _, change := range diff.Changes {
+			fmt.Fprintf(w, "    %s: %s => %s\n", change.Attribute, orAbsent(change.Expected), orAbsent(change.Actual))
+		}
+	}
+
+	return nil
+}
+
+func printDiffsJSON(w io.Writer, diffs []resourceDiff) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(struct {
+		Drift     bool           `json:"drift"`
+		Resources []resourceDiff `json:"resources"`
+	}{
+		Drift:     len(diffs) > 0,
+		Resources: diffs,
+	})
+}
+
+func orAbsent(value string) string {
+	if value == "" {
+		return "(absent)"
+	}
+
+	return `"` + value + `"`
+}
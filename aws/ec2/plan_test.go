@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestDiffInstance(t *testing.T) {
+	spec := testSpec()
+	spec.Tags = map[string]string{"owner": "vlad"}
+
+	instance := types.Instance{
+		InstanceId:     aws.String("i-01"),
+		InstanceType:   types.InstanceTypeT3Small,
+		State:          &types.InstanceState{Name: types.InstanceStateNameStopped},
+		SecurityGroups: []types.GroupIdentifier{{GroupId: aws.String("sg-other")}},
+		Tags: []types.Tag{
+			{Key: aws.String("Name"), Value: aws.String(spec.Name)},
+			{Key: aws.String(managedByTagKey), Value: aws.String(managedByTagValue)},
+			{Key: aws.String(specHashTagKey), Value: aws.String("outdated")},
+			{Key: aws.String("owner"), Value: aws.String("someone-else")},
+			{Key: aws.String("debug"), Value: aws.String("true")},
+		},
+	}
+
+	changes := diffInstance(spec, instance, "sg-0a1b2c3d")
+	expected := []attributeDiff{
+		{Attribute: "state", Expected: "running", Actual: "stopped"},
+		{Attribute: "instance-type", Expected: "t3.micro", Actual: "t3.small"},
+		{Attribute: "tag debug", Actual: "true"},
+		{Attribute: "tag owner", Expected: "vlad", Actual: "someone-else"},
+		{Attribute: "security-group", Expected: "sg-0a1b2c3d"},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("changes are %v, expected %v", changes, expected)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("change %d is %v, expected %v", i, changes[i], expected[i])
+		}
+	}
+}
+
+func TestDiffSecurityGroup(t *testing.T) {
+	securityGroup := types.SecurityGroup{
+		GroupId: aws.String("sg-0a1b2c3d"),
+		IpPermissions: []types.IpPermission{
+			{
+				IpProtocol: aws.String("tcp"),
+				FromPort:   aws.Int32(22),
+				ToPort:     aws.Int32(22),
+				IpRanges:   []types.IpRange{{CidrIp: aws.String("0.0.0.0/0")}},
+			},
+		},
+	}
+
+	changes := diffSecurityGroup(testSpec(), securityGroup)
+	if len(changes) != 2 {
+		t.Fatalf("expected one missing and one unexpected rule, got %v", changes)
+	}
+
+	if changes[0].Attribute != "ingress tcp 22-22 0.0.0.0/0" || changes[0].Expected != "" {
+		t.Errorf("hand-added rule should be reported as unexpected, got %v", changes[0])
+	}
+
+	if changes[1].Attribute != "ingress tcp 22-22 10.0.0.0/8" || changes[1].Actual != "" {
+		t.Errorf("rule from spec should be reported as missing, got %v", changes[1])
+	}
+}
+
+func TestPlan(t *testing.T) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	spec := defaultSpec()
+	liveInstance := types.Instance{
+		InstanceId:   aws.String("i-01"),
+		InstanceType: types.InstanceType(spec.InstanceType),
+		State:        &types.InstanceState{Name: types.InstanceStateNameRunning},
+		Tags: []types.Tag{
+			{Key: aws.String("Name"), Value: aws.String(spec.Name)},
+			{Key: aws.String(managedByTagKey), Value: aws.String(managedByTagValue)},
+		},
+	}
+	ec2Client := &mockEc2Client{
+		describeInstancesOutput: &ec2.DescribeInstancesOutput{
+			Reservations: []types.Reservation{{Instances: []types.Instance{liveInstance}}},
+		},
+	}
+
+	ctx := context.TODO()
+	app := &app{ec2Client: ec2Client, spec: spec, state: st}
+	diffs, err := plan(ctx, app)
+	if err != nil {
+		t.Fatal("Error planning: " + err.Error())
+	}
+	if len(diffs) != 0 {
+		t.Errorf("no drift expected, got %v", diffs)
+	}
+
+	liveInstance.State.Name = types.InstanceStateNameStopped
+	diffs, err = plan(ctx, app)
+	if err != nil {
+		t.Fatal("Error planning: " + err.Error())
+	}
+	if len(diffs) != 1 || diffs[0].ID != "i-01" {
+		t.Fatalf("stopped instance should drift, got %v", diffs)
+	}
+
+	var output bytes.Buffer
+	err = printDiffsJSON(&output, diffs)
+	if err != nil {
+		t.Fatal("Error printing JSON: " + err.Error())
+	}
+
+	var parsed struct {
+		Drift     bool           `json:"drift"`
+		Resources []resourceDiff `json:"resources"`
+	}
+	err = json.Unmarshal(output.Bytes(), &parsed)
+	if err != nil {
+		t.Fatal("Error parsing JSON output: " + err.Error())
+	}
+	if !parsed.Drift || parsed.Resources[0].Changes[0].Actual != "stopped" {
+		t.Errorf("JSON output doesn't match diffs: %s", output.String())
+	}
+
+	ec2Client.describeInstancesOutput = &ec2.DescribeInstancesOutput{}
+	diffs, err = plan(ctx, app)
+	if err != nil {
+		t.Fatal("Error planning: " + err.Error())
+	}
+	if len(diffs) != 1 || diffs[0].Changes[0].Attribute != "exists" {
+		t.Errorf("missing instance should be reported, got %v", diffs)
+	}
+}
+
+func TestPlanCommandDriftError(t *testing.T) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	app := &app{ec2Client: &mockEc2Client{describeInstancesOutput: &ec2.DescribeInstancesOutput{}}, spec: defaultSpec(), state: st}
+	run := planCommand(flag.NewFlagSet("plan", flag.ContinueOnError))
+
+	err = run(context.TODO(), app)
+	if !errors.Is(err, errDriftDetected) {
+		t.Errorf("expected errDriftDetected, got %v", err)
+	}
+}
+
+func TestPlanDeletedSecurityGroup(t *testing.T) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	spec := testSpec()
+	st.record(resource{Type: resourceSecurityGroup, ID: "sg-0deleted", Name: spec.SecurityGroup.Name})
+	app := &app{
+		ec2Client: &mockEc2Client{
+			describeInstancesOutput:      &ec2.DescribeInstancesOutput{},
+			describeSecurityGroupsOutput: &ec2.DescribeSecurityGroupsOutput{},
+		},
+		spec:  spec,
+		state: st,
+	}
+
+	diffs, err := plan(context.TODO(), app)
+	if err != nil {
+		t.Fatal("Error planning: " + err.Error())
+	}
+	if len(diffs) == 0 || diffs[0].Type != resourceSecurityGroup || diffs[0].ID != "sg-0deleted" || diffs[0].Changes[0].Attribute != "exists" {
+		t.Errorf("deleted security group should be reported missing, got %v", diffs)
+	}
+
+	err = planCommand(flag.NewFlagSet("plan", flag.ContinueOnError))(context.TODO(), app)
+	if !errors.Is(err, errDriftDetected) {
+		t.Errorf("expected errDriftDetected, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// errPolicyViolation is returned when launch request breaks rules of the policy file
+var errPolicyViolation = errors.New("launch request violates policy")
+
+// launchPolicy is set of rules resolved launch request has to follow, empty policy allows everything
+type launchPolicy struct {
+	RequiredTags []string `json:"requiredTags,omitempty"`
+	// glob patterns, like "t3.*"
+	AllowedInstanceTypes []string        `json:"allowedInstanceTypes,omitempty"`
+	DeniedIngress        []deniedIngress `json:"deniedIngress,omitempty"`
+	DenyPublicIp         bool            `json:"denyPublicIp,omitempty"`
+}
+
+// deniedIngress forbids opening port to CIDR, like SSH to 0.0.0.0/0
+type deniedIngress struct {
+	CidrIp string `json:"cidrIp"`
+	Port   int32  `json:"port"`
+}
+
+// loadPolicy reads policy from JSON file, empty path means no rules
+func loadPolicy(policyPath string) (launchPolicy, error) {
+	policy := launchPolicy{}
+	if policyPath == "" {
+		return policy, nil
+	}
+
+	policyFile, err := os.ReadFile(policyPath)
+	if err != nil {
+		return policy, err
+	}
+
+	err = json.Unmarshal(policyFile, &policy)
+	if err != nil {
+		return policy, fmt.Errorf("parsing policy file %s: %w", policyPath, err)
+	}
+
+	for _, pattern := range policy.AllowedInstanceTypes {
+		_, err = path.Match(pattern, "")
+		if err != nil {
+			return policy, fmt.Errorf("bad instance type pattern %q: %w", pattern, err)
+		}
+	}
+
+	return policy, nil
+}
+
+// check lists every rule input and security group break, error is nil when there are none
+func (p launchPolicy) check(input *ec2.RunInstancesInput, securityGroup *securityGroupSpec) error {
+	violations := []string{}
+
+	instanceTags := map[string]string{}
+	for _, tagSpecification := range input.TagSpecifications {
+		if tagSpecification.ResourceType != types.ResourceTypeInstance {
+			continue
+		}
+		for _, tag := range tagSpecification.Tags {
+			instanceTags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+	}
+	for _, key := range p.RequiredTags {
+		if instanceTags[key] == "" {
+			violations = append(violations, fmt.Sprintf("tag %s is required", key))
+		}
+	}
+
+	if len(p.AllowedInstanceTypes) > 0 {
+		allowed := false
+		for _, pattern := range p.AllowedInstanceTypes {
+			if matched, _ := path.Match(pattern, string(input.InstanceType)); matched {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			violations = append(violations, fmt.Sprintf("instance type %s isn't allowed, allowed are: %s", input.InstanceType, strings.Join(p.AllowedInstanceTypes, ", ")))
+		}
+	}
+
+	if securityGroup != nil {
+		for _, rule := range securityGroup.Ingress {
+			for _, denied := range p.DeniedIngress {
+				// protocol -1 opens all ports, whatever the range says
+				opensPort := rule.Protocol == "-1" || (rule.FromPort <= denied.Port && denied.Port <= rule.ToPort)
+				if rule.CidrIp == denied.CidrIp && opensPort {
+					violations = append(violations, fmt.Sprintf("security group %s opens port %d to %s", securityGroup.Name, denied.Port, denied.CidrIp))
+				}
+			}
+		}
+	}
+
+	if p.DenyPublicIp {
+		for _, networkInterface := range input.NetworkInterfaces {
+			if aws.ToBool(networkInterface.AssociatePublicIpAddress) {
+				violations = append(violations, "public IP isn't allowed")
+			}
+		}
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%w:\n  - %s", errPolicyViolation, strings.Join(violations, "\n  - "))
+}
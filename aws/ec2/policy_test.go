@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestRunInstancesInputDefaults(t *testing.T) {
+	image := types.Image{ImageId: aws.String(mockImageId), RootDeviceName: aws.String("/dev/sda1")}
+	input := runInstancesInput(defaultSpec(), defaultInstanceName, keyPairName, image, []string{"sg-0a1b2c3d"})
+
+	if input.MetadataOptions == nil || input.MetadataOptions.HttpTokens != types.HttpTokensStateRequired {
+		t.Error("IMDSv2 should be required")
+	}
+	if len(input.BlockDeviceMappings) != 1 || aws.ToString(input.BlockDeviceMappings[0].DeviceName) != "/dev/sda1" || !aws.ToBool(input.BlockDeviceMappings[0].Ebs.Encrypted) {
+		t.Errorf("root volume should be encrypted, block devices are %+v", input.BlockDeviceMappings)
+	}
+	if len(input.NetworkInterfaces) != 1 || aws.ToBool(input.NetworkInterfaces[0].AssociatePublicIpAddress) {
+		t.Error("public IP should be off by default")
+	}
+	if input.NetworkInterfaces[0].Groups[0] != "sg-0a1b2c3d" || input.SecurityGroupIds != nil {
+		t.Error("security groups should be set on network interface only")
+	}
+	if aws.ToBool(input.Monitoring.Enabled) {
+		t.Error("detailed monitoring should be off by default")
+	}
+
+	spec := defaultSpec()
+	spec.PublicIp = true
+	spec.Monitoring = true
+	input = runInstancesInput(spec, spec.Name, keyPairName, image, nil)
+	if !aws.ToBool(input.NetworkInterfaces[0].AssociatePublicIpAddress) || !aws.ToBool(input.Monitoring.Enabled) {
+		t.Error("public IP and monitoring should be on when spec asks for them")
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	policy := launchPolicy{
+		RequiredTags:         []string{"owner", "cost-center"},
+		AllowedInstanceTypes: []string{"t3.*", "t4g.*"},
+		DeniedIngress:        []deniedIngress{{CidrIp: "0.0.0.0/0", Port: 22}},
+		DenyPublicIp:         true,
+	}
+
+	spec := testSpec()
+	spec.Tags = map[string]string{"owner": "vlad", "cost-center": "42"}
+	err := policy.check(runInstancesInput(spec, spec.Name, keyPairName, types.Image{}, nil), spec.SecurityGroup)
+	if err != nil {
+		t.Errorf("compliant request failed the check: %v", err)
+	}
+
+	spec.Tags = map[string]string{"owner": "vlad"}
+	spec.InstanceType = "m5.large"
+	spec.PublicIp = true
+	spec.SecurityGroup.Ingress = []ingressRule{{Protocol: "tcp", FromPort: 0, ToPort: 1024, CidrIp: "0.0.0.0/0"}}
+	err = policy.check(runInstancesInput(spec, spec.Name, keyPairName, types.Image{}, nil), spec.SecurityGroup)
+	if !errors.Is(err, errPolicyViolation) {
+		t.Fatalf("err is %v, expected policy violation", err)
+	}
+
+	for _, expected := range []string{"tag cost-center is required", "instance type m5.large isn't allowed", "opens port 22 to 0.0.0.0/0", "public IP isn't allowed"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("violation %q isn't listed in %q", expected, err)
+		}
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	policyPath := filepath.Join(t.TempDir(), "policy.json")
+	err := os.WriteFile(policyPath, []byte(`{"requiredTags": ["owner"], "allowedInstanceTypes": ["t3.*"], "deniedIngress": [{"cidrIp": "0.0.0.0/0", "port": 22}]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := loadPolicy(policyPath)
+	if err != nil {
+		t.Fatal("Error loading policy: " + err.Error())
+	}
+	if len(policy.RequiredTags) != 1 || policy.AllowedInstanceTypes[0] != "t3.*" || policy.DeniedIngress[0].Port != 22 {
+		t.Errorf("policy is %+v", policy)
+	}
+
+	err = os.WriteFile(policyPath, []byte(`{"allowedInstanceTypes": ["t3.["]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadPolicy(policyPath)
+	if err == nil {
+		t.Error("bad instance type pattern should be rejected")
+	}
+}
+
+func TestLaunchBlockedByPolicy(t *testing.T) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	ec2Client := newLaunchMock()
+	app := &app{
+		ec2Client:    ec2Client,
+		quotasClient: &mockQuotasClient{quota: 32},
+		spec:         testSpec(),
+		policy:       launchPolicy{RequiredTags: []string{"owner"}},
+		state:        st,
+	}
+
+	err = launch(context.TODO(), app, false)
+	if !errors.Is(err, errPolicyViolation) {
+		t.Fatalf("err is %v, expected policy violation", err)
+	}
+	if len(ec2Client.calls) > 0 {
+		t.Errorf("nothing should be created when policy is violated, calls: %v", ec2Client.calls)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/servicequotas"
+	"github.com/aws/smithy-go"
+)
+
+// quotasClient is the part of Service Quotas API the tool needs
+type quotasClient interface {
+	GetServiceQuota(ctx context.Context, params *servicequotas.GetServiceQuotaInput, optFns ...func(*servicequotas.Options)) (*servicequotas.GetServiceQuotaOutput, error)
+}
+
+const (
+	ec2QuotaServiceCode string = "ec2"
+	// Running On-Demand Standard (A, C, D, H, I, M, R, T, Z) instances, in vCPUs
+	standardVcpuQuotaCode string = "L-1216C47A"
+)
+
+// errQuotaExceeded is returned when launch would go over running On-Demand vCPU quota
+var errQuotaExceeded = errors.New("vCPU quota exceeded")
+
+// vcpuQuotaCodes maps instance family prefix to its running On-Demand vCPU quota,
+// families not listed count against the standard one
+var vcpuQuotaCodes = map[string]string{
+	"f":   "L-74FC7D96",
+	"g":   "L-DB2E81BA",
+	"vt":  "L-DB2E81BA",
+	"inf": "L-1945791B",
+	"p":   "L-417A185B",
+	"x":   "L-7295265B",
+	"u":   "L-43DA4232",
+	"dl":  "L-6E869C2A",
+	"trn": "L-2C3B7624",
+	"hpc": "L-F7808C92",
+}
+
+// vcpuQuotaCode returns quota instance type counts against, "g5.xlarge" and "vt1.3xlarge" share one
+func vcpuQuotaCode(instanceType string) string {
+	prefix := strings.ToLower(instanceType)
+	if i := strings.IndexFunc(prefix, func(r rune) bool { return !unicode.IsLetter(r) }); i >= 0 {
+		prefix = prefix[:i]
+	}
+
+	if code, ok := vcpuQuotaCodes[prefix]; ok {
+		return code
+	}
+
+	return standardVcpuQuotaCode
+}
+
+// vcpuUsage sums vCPUs of pending and running On-Demand instances counting against quota code
+func vcpuUsage(ctx context.Context, ec2Client ec2Client, quotaCode string) (int32, error) {
+	var usage int32
+	err := eachInstance(ctx, ec2Client, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running"}},
+		},
+	}, func(instance types.Instance) bool {
+		// Spot instances have quotas of their own
+		if instance.InstanceLifecycle == types.InstanceLifecycleTypeSpot || vcpuQuotaCode(string(instance.InstanceType)) != quotaCode {
+			return true
+		}
+		if instance.CpuOptions != nil {
+			usage += aws.ToInt32(instance.CpuOptions.CoreCount) * aws.ToInt32(instance.CpuOptions.ThreadsPerCore)
+		}
+
+		return true
+	})
+
+	return usage, err
+}
+
+// instanceTypeVcpus returns default number of vCPUs of instance type
+func instanceTypeVcpus(ctx context.Context, ec2Client ec2Client, instanceType string) (int32, error) {
+	var vcpus *int32
+	err := eachInstanceType(ctx, ec2Client, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []types.InstanceType{types.InstanceType(instanceType)},
+	}, func(info types.InstanceTypeInfo) bool {
+		if info.VCpuInfo != nil {
+			vcpus = info.VCpuInfo.DefaultVCpus
+		}
+		return vcpus == nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if vcpus == nil {
+		return 0, fmt.Errorf("instance type %s not found", instanceType)
+	}
+
+	return aws.ToInt32(vcpus), nil
+}
+
+// quotaUnavailable tells if quota can't be read for good, missing permission or quota unknown in region,
+// throttling, timeouts and the rest aren't a reason to skip the check
+func quotaUnavailable(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	return apiErr.ErrorCode() == "AccessDeniedException" || apiErr.ErrorCode() == "NoSuchResourceException"
+}
+
+// checkVcpuQuota fails when count instances of instance type won't fit into running On-Demand vCPU quota,
+// so launch stops before creating anything instead of failing late with VcpuLimitExceeded
+func checkVcpuQuota(ctx context.Context, app *app, instanceType string, count int32) error {
+	vcpus, err := instanceTypeVcpus(ctx, app.ec2Client, instanceType)
+	if err != nil {
+		return fmt.Errorf("looking up vCPUs of %s: %w", instanceType, err)
+	}
+	requested := vcpus * count
+
+	quotaCode := vcpuQuotaCode(instanceType)
+	quotaOutput, err := app.quotasClient.GetServiceQuota(ctx, &servicequotas.GetServiceQuotaInput{
+		ServiceCode: aws.String(ec2QuotaServiceCode),
+		QuotaCode:   aws.String(quotaCode),
+	})
+	if err != nil && !quotaUnavailable(err) {
+		return fmt.Errorf("getting quota %s: %w", quotaCode, err)
+	}
+	if err != nil || quotaOutput.Quota == nil || quotaOutput.Quota.Value == nil {
+		// the check is only an early warning, RunInstances enforces the quota anyway,
+		// so missing servicequotas permissions shouldn't block launch
+		slog.Warn("Skipping vCPU quota check, quota " + quotaCode + " isn't available: " + fmt.Sprint(err))
+		return nil
+	}
+	quota := int32(*quotaOutput.Quota.Value)
+
+	usage, err := vcpuUsage(ctx, app.ec2Client, quotaCode)
+	if err != nil {
+		return fmt.Errorf("counting vCPUs in use: %w", err)
+	}
+
+	headroom := quota - usage
+	slog.Debug(fmt.Sprintf("vCPU quota %s: %d, in use: %d, requested: %d", quotaCode, quota, usage, requested))
+	if requested > headroom {
+		return fmt.Errorf("%w: %d x %s needs %d vCPUs, quota %s is %d vCPUs, %d in use, headroom is %d vCPUs",
+			errQuotaExceeded, count, instanceType, requested, quotaCode, quota, usage, max(headroom, 0))
+	}
+
+	return nil
+}
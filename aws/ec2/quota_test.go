@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/servicequotas"
+	quotatypes "github.com/aws/aws-sdk-go-v2/service/servicequotas/types"
+	"github.com/aws/smithy-go"
+)
+
+type mockQuotasClient struct {
+	quota float64
+	err   error
+	// last requested quota code
+	quotaCode string
+}
+
+func (m *mockQuotasClient) GetServiceQuota(ctx context.Context, params *servicequotas.GetServiceQuotaInput, optFns ...func(*servicequotas.Options)) (*servicequotas.GetServiceQuotaOutput, error) {
+	m.quotaCode = aws.ToString(params.QuotaCode)
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	return &servicequotas.GetServiceQuotaOutput{Quota: &quotatypes.ServiceQuota{Value: aws.Float64(m.quota)}}, nil
+}
+
+// runningInstance is On-Demand instance using cores x 2 vCPUs
+func runningInstance(id string, instanceType types.InstanceType, cores int32) types.Instance {
+	return types.Instance{
+		InstanceId:   aws.String(id),
+		InstanceType: instanceType,
+		State:        &types.InstanceState{Name: types.InstanceStateNameRunning},
+		CpuOptions:   &types.CpuOptions{CoreCount: aws.Int32(cores), ThreadsPerCore: aws.Int32(2)},
+	}
+}
+
+func TestVcpuQuotaCode(t *testing.T) {
+	cases := map[string]string{
+		"t3.micro":     standardVcpuQuotaCode,
+		"m7i.large":    standardVcpuQuotaCode,
+		"g5.xlarge":    "L-DB2E81BA",
+		"vt1.3xlarge":  "L-DB2E81BA",
+		"inf2.xlarge":  "L-1945791B",
+		"p4d.24xlarge": "L-417A185B",
+		"x2iedn.large": "L-7295265B",
+	}
+	for instanceType, expected := range cases {
+		if code := vcpuQuotaCode(instanceType); code != expected {
+			t.Errorf("quota code of %s is %s, expected %s", instanceType, code, expected)
+		}
+	}
+}
+
+func TestCheckVcpuQuota(t *testing.T) {
+	ec2Client := newLaunchMock()
+	ec2Client.describeInstancesOutput = &ec2.DescribeInstancesOutput{
+		Reservations: []types.Reservation{{Instances: []types.Instance{
+			runningInstance("i-standard", types.InstanceTypeM5Large, 2),
+			runningInstance("i-gpu", types.InstanceTypeG5Xlarge, 8),
+			func() types.Instance {
+				spot := runningInstance("i-spot", types.InstanceTypeC5Large, 2)
+				spot.InstanceLifecycle = types.InstanceLifecycleTypeSpot
+				return spot
+			}(),
+		}}},
+	}
+	quotas := &mockQuotasClient{quota: 6}
+	app := &app{ec2Client: ec2Client, quotasClient: quotas}
+
+	// 4 vCPUs in use by m5.large, g5 and Spot ones don't count, 2 more fit
+	err := checkVcpuQuota(context.TODO(), app, "t3.micro", 1)
+	if err != nil {
+		t.Error("Error checking quota: " + err.Error())
+	}
+	if quotas.quotaCode != standardVcpuQuotaCode {
+		t.Errorf("quota code is %s, expected %s", quotas.quotaCode, standardVcpuQuotaCode)
+	}
+
+	err = checkVcpuQuota(context.TODO(), app, "t3.micro", 2)
+	if !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("err is %v, expected quota exceeded", err)
+	}
+	if !strings.Contains(err.Error(), "needs 4 vCPUs") || !strings.Contains(err.Error(), "headroom is 2 vCPUs") {
+		t.Errorf("error %q doesn't show requested vCPUs and headroom", err)
+	}
+}
+
+func TestCheckVcpuQuotaUnavailable(t *testing.T) {
+	for _, code := range []string{"AccessDeniedException", "NoSuchResourceException"} {
+		app := &app{ec2Client: newLaunchMock(), quotasClient: &mockQuotasClient{err: &smithy.GenericAPIError{Code: code}}}
+
+		err := checkVcpuQuota(context.TODO(), app, "t3.micro", 1)
+		if err != nil {
+			t.Errorf("unavailable quota (%s) should skip the check, got %v", code, err)
+		}
+	}
+}
+
+func TestCheckVcpuQuotaError(t *testing.T) {
+	for _, quotaErr := range []error{&smithy.GenericAPIError{Code: "ThrottlingException"}, context.DeadlineExceeded, errors.New("connection reset")} {
+		app := &app{ec2Client: newLaunchMock(), quotasClient: &mockQuotasClient{err: quotaErr}}
+
+		err := checkVcpuQuota(context.TODO(), app, "t3.micro", 1)
+		if !errors.Is(err, quotaErr) {
+			t.Errorf("%v shouldn't skip the check, got %v", quotaErr, err)
+		}
+	}
+}
+
+func TestLaunchOverQuota(t *testing.T) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	ec2Client := newLaunchMock()
+	app := &app{ec2Client: ec2Client, quotasClient: &mockQuotasClient{quota: 1}, spec: testSpec(), state: st}
+
+	err = launch(context.TODO(), app, false)
+	if !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("err is %v, expected quota exceeded", err)
+	}
+	if len(ec2Client.calls) > 0 {
+		t.Errorf("nothing should be created over quota, calls: %v", ec2Client.calls)
+	}
+}
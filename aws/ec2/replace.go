@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// replacementSuffix marks Name tag of instance till it takes over, and of old instance after that
+const (
+	replacementSuffix string = "-replacement"
+	replacedSuffix    string = "-replaced"
+)
+
+func replaceCommand(flags *flag.FlagSet) func(ctx context.Context, app *app) error {
+	var instanceId string
+	flags.StringVar(&instanceId, "instance", "", "String, ID of instance launched by the tool to replace, the only one from state if empty")
+
+	return func(ctx context.Context, app *app) error {
+		instanceRecord, err := managedInstance(app, instanceId)
+		if err != nil {
+			return err
+		}
+
+		newInstanceId, err := replaceInstance(ctx, app, instanceRecord)
+		if err != nil {
+			return err
+		}
+
+		slog.Info("Instance " + instanceRecord.ID + " replaced with " + newInstanceId)
+		return nil
+	}
+}
+
+// replaceInstance launches replacement from the current spec, once its status checks pass it takes over
+// Name tag and Elastic IP and old instance is terminated with its volumes, replacement that doesn't get healthy
+// is terminated instead
+func replaceInstance(ctx context.Context, app *app, old resource) (string, error) {
+	err := forgetStaleReplacements(ctx, app)
+	if err != nil {
+		return "", err
+	}
+
+	instanceIds, err := launchInstances(ctx, app, app.spec.Name+replacementSuffix, false)
+	if err != nil {
+		return "", fmt.Errorf("launching replacement: %w", err)
+	}
+	if len(instanceIds) != 1 {
+		return "", fmt.Errorf("expected one replacement instance, launched %v", instanceIds)
+	}
+	newInstance, found := findInstance(app, instanceIds[0])
+	if !found {
+		return "", errors.New("replacement " + instanceIds[0] + " isn't in state")
+	}
+
+	slog.Info("Waiting for replacement " + newInstance.ID + " to pass status checks")
+	err = waitStatusOk(ctx, app.ec2Client, newInstance.ID)
+	if err != nil {
+		cleanupCtx, cancel := cleanupContext(ctx)
+		defer cancel()
+
+		slog.Info("Terminating unhealthy replacement " + newInstance.ID + ", " + old.ID + " stays in service")
+		destroyErr := destroyInstance(cleanupCtx, app, newInstance)
+		if destroyErr != nil {
+			return "", fmt.Errorf("%w, terminating replacement: %w", err, destroyErr)
+		}
+		return "", err
+	}
+
+	err = renameInstance(ctx, app, old, app.spec.Name+replacedSuffix)
+	if err != nil {
+		return "", err
+	}
+	err = renameInstance(ctx, app, newInstance, app.spec.Name)
+	if err != nil {
+		return "", err
+	}
+
+	if app.spec.ElasticIp {
+		_, _, err = attachElasticIp(ctx, app, newInstance.ID)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	slog.Info("Terminating replaced instance " + old.ID)
+	err = destroyInstance(ctx, app, old)
+	if err != nil {
+		return newInstance.ID, fmt.Errorf("terminating replaced instance %s, run teardown or terminate it by hand: %w", old.ID, err)
+	}
+
+	return newInstance.ID, nil
+}
+
+// forgetStaleReplacements drops replacement records left by earlier runs whose instance is gone,
+// a replacement that's still there stops replace, it may be serving already
+func forgetStaleReplacements(ctx context.Context, app *app) error {
+	for _, r := range app.state.find(resourceInstance, "") {
+		if r.Name != app.spec.Name+replacementSuffix {
+			continue
+		}
+		instance, err := describeInstance(ctx, app.ec2Client, r.ID)
+		if err != nil {
+			return fmt.Errorf("checking replacement %s left by earlier run: %w", r.ID, err)
+		}
+		if instance != nil && instance.State != nil && instance.State.Name != types.InstanceStateNameTerminated && instance.State.Name != types.InstanceStateNameShuttingDown {
+			return errors.New("replacement " + r.ID + " left by earlier run is still " + string(instance.State.Name) + ", terminate it or rename it to " + app.spec.Name + " by hand")
+		}
+
+		slog.Debug("Forgetting stale replacement " + r.ID)
+		app.state.forget(resourceInstance, r.ID)
+	}
+
+	return app.state.save()
+}
+
+// findInstance returns instance record by ID
+func findInstance(app *app, instanceId string) (resource, bool) {
+	for _, r := range app.state.find(resourceInstance, "") {
+		if r.ID == instanceId {
+			return r, true
+		}
+	}
+
+	return resource{}, false
+}
+
+// destroyInstance terminates instance, then deletes spec volumes that were attached to it,
+// they aren't deleted on termination and the other instance has its own ones
+func destroyInstance(ctx context.Context, app *app, instance resource) error {
+	volumeIds := []string{}
+	err := eachVolume(ctx, app.ec2Client, &ec2.DescribeVolumesInput{
+		Filters: []types.Filter{{Name: aws.String("attachment.instance-id"), Values: []string{instance.ID}}},
+	}, func(volume types.Volume) bool {
+		volumeIds = append(volumeIds, aws.ToString(volume.VolumeId))
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("listing volumes of %s: %w", instance.ID, err)
+	}
+
+	err = destroyResource(ctx, app.ec2Client, instance)
+	if err != nil {
+		return err
+	}
+	app.state.forget(resourceInstance, instance.ID)
+	err = app.state.save()
+	if err != nil {
+		return err
+	}
+
+	for _, volumeId := range volumeIds {
+		for _, r := range app.state.find(resourceVolume, "") {
+			if r.ID != volumeId {
+				continue
+			}
+			slog.Info("Deleting volume " + r.ID + " (" + r.Name + ") of " + instance.ID)
+			err = destroyResource(ctx, app.ec2Client, r)
+			if err != nil {
+				return fmt.Errorf("deleting volume %s: %w", r.ID, err)
+			}
+			app.state.forget(resourceVolume, r.ID)
+			err = app.state.save()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// renameInstance sets Name tag of instance and its name in state
+func renameInstance(ctx context.Context, app *app, instance resource, name string) error {
+	_, err := app.ec2Client.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: []string{instance.ID},
+		Tags:      []types.Tag{{Key: aws.String("Name"), Value: aws.String(name)}},
+	})
+	if err != nil {
+		return fmt.Errorf("renaming instance %s to %s: %w", instance.ID, name, err)
+	}
+
+	instance.Name = name
+	app.state.record(instance)
+	return app.state.save()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const (
+	replacementInstanceId string = "i-0a9b8c7d6e5f40312"
+	replacementVolumeId   string = "vol-0e5f6a7b"
+)
+
+// launchForReplace launches spec with Elastic IP and volumes and makes the next RunInstances return replacement
+// with its own volume
+func launchForReplace(t *testing.T, volumes []volumeSpec) (*app, *mockEc2Client, resource) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	t.Cleanup(func() { st.close() })
+
+	spec := defaultSpec()
+	spec.ElasticIp = true
+	spec.Volumes = volumes
+	ec2Client := newLaunchMock()
+	app := &app{ec2Client: ec2Client, quotasClient: &mockQuotasClient{quota: 32}, spec: spec, state: st}
+
+	err = launch(context.TODO(), app, false)
+	if err != nil {
+		t.Fatal("Error launching: " + err.Error())
+	}
+	old, err := managedInstance(app, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ec2Client.runInstancesOutput = &ec2.RunInstancesOutput{Instances: []types.Instance{{InstanceId: aws.String(replacementInstanceId)}}}
+	reservation := &ec2Client.describeInstancesOutput.Reservations[0]
+	reservation.Instances = append(reservation.Instances, types.Instance{
+		InstanceId: aws.String(replacementInstanceId),
+		State:      &types.InstanceState{Name: types.InstanceStateNameRunning},
+		Placement:  &types.Placement{AvailabilityZone: aws.String("eu-central-1a")},
+	})
+	ec2Client.createVolumeOutput = &ec2.CreateVolumeOutput{VolumeId: aws.String(replacementVolumeId)}
+	ec2Client.describeVolumesOutput.Volumes = append(ec2Client.describeVolumesOutput.Volumes, types.Volume{
+		VolumeId: aws.String(replacementVolumeId),
+		State:    types.VolumeStateAvailable,
+	})
+	ec2Client.calls = nil
+
+	return app, ec2Client, old
+}
+
+func TestReplaceInstance(t *testing.T) {
+	app, ec2Client, old := launchForReplace(t, nil)
+
+	newInstanceId, err := replaceInstance(context.TODO(), app, old)
+	if err != nil {
+		t.Fatal("Error replacing instance: " + err.Error())
+	}
+	if newInstanceId != replacementInstanceId {
+		t.Errorf("replacement is %s, expected %s", newInstanceId, replacementInstanceId)
+	}
+
+	calls := strings.Join(ec2Client.calls, ",")
+	if !strings.HasSuffix(calls, "RunInstances,CreateTags,CreateTags,AssociateAddress,TerminateInstances") {
+		t.Errorf("old instance should be renamed, Elastic IP moved and only then old one terminated, calls are %v", ec2Client.calls)
+	}
+
+	instance, _ := describeInstance(context.TODO(), ec2Client, replacementInstanceId)
+	if tagValue(instance.Tags, "Name") != app.spec.Name {
+		t.Errorf("replacement is named %q, expected %q", tagValue(instance.Tags, "Name"), app.spec.Name)
+	}
+	if aws.ToString(ec2Client.addresses[0].InstanceId) != replacementInstanceId {
+		t.Errorf("Elastic IP is associated with %s", aws.ToString(ec2Client.addresses[0].InstanceId))
+	}
+
+	current, err := managedInstance(app, "")
+	if err != nil || current.ID != replacementInstanceId {
+		t.Errorf("state should have only replacement under spec's name, got %v (%v)", current, err)
+	}
+}
+
+func TestReplaceUnhealthyInstance(t *testing.T) {
+	app, ec2Client, old := launchForReplace(t, nil)
+	ec2Client.failOn = map[string]error{"DescribeInstanceStatus": errors.New("InternalError")}
+
+	_, err := replaceInstance(context.TODO(), app, old)
+	if err == nil {
+		t.Fatal("unhealthy replacement should fail replace")
+	}
+
+	if !strings.HasSuffix(strings.Join(ec2Client.calls, ","), "RunInstances,TerminateInstances") {
+		t.Errorf("only replacement should be terminated, calls are %v", ec2Client.calls)
+	}
+	for _, r := range app.state.find(resourceInstance, "") {
+		if r.ID == replacementInstanceId {
+			t.Error("terminated replacement should be dropped from state")
+		}
+	}
+	if instance, _ := describeInstance(context.TODO(), ec2Client, old.ID); instance.State.Name != types.InstanceStateNameRunning {
+		t.Errorf("old instance should keep running, it's %s", instance.State.Name)
+	}
+}
+
+func TestReplaceInstanceVolumes(t *testing.T) {
+	app, ec2Client, old := launchForReplace(t, []volumeSpec{{Device: "/dev/sdf", SizeGiB: 10, Type: "gp3"}})
+
+	_, err := replaceInstance(context.TODO(), app, old)
+	if err != nil {
+		t.Fatal("Error replacing instance: " + err.Error())
+	}
+
+	if !strings.HasSuffix(strings.Join(ec2Client.calls, ","), "TerminateInstances,DeleteVolume") {
+		t.Errorf("old instance's volume should be deleted after it's terminated, calls are %v", ec2Client.calls)
+	}
+	volumes := app.state.find(resourceVolume, "")
+	if len(volumes) != 1 || volumes[0].ID != replacementVolumeId {
+		t.Errorf("state should keep only replacement's volume, got %v", volumes)
+	}
+}
+
+func TestReplaceForgetsStaleReplacement(t *testing.T) {
+	app, ec2Client, old := launchForReplace(t, nil)
+	app.state.record(resource{Type: resourceInstance, ID: "i-0deadbeef0000000", Name: app.spec.Name + replacementSuffix})
+
+	newInstanceId, err := replaceInstance(context.TODO(), app, old)
+	if err != nil {
+		t.Fatal("Error replacing instance: " + err.Error())
+	}
+	if newInstanceId != replacementInstanceId {
+		t.Errorf("replacement is %s, expected %s", newInstanceId, replacementInstanceId)
+	}
+	if _, found := findInstance(app, "i-0deadbeef0000000"); found {
+		t.Error("gone replacement of earlier run should be forgotten")
+	}
+
+	// replacement of earlier run that still runs stops replace
+	current, _ := managedInstance(app, "")
+	app.state.record(resource{Type: resourceInstance, ID: old.ID, Name: app.spec.Name + replacementSuffix})
+	ec2Client.setInstanceState([]string{old.ID}, types.InstanceStateNameRunning)
+	ec2Client.calls = nil
+	_, err = replaceInstance(context.TODO(), app, current)
+	if err == nil || !strings.Contains(err.Error(), old.ID) {
+		t.Errorf("expected running replacement of earlier run to stop replace, got %v", err)
+	}
+	if len(ec2Client.calls) != 0 {
+		t.Errorf("nothing should be launched, calls are %v", ec2Client.calls)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func resizeCommand(flags *flag.FlagSet) func(ctx context.Context, app *app) error {
+	var instanceId, instanceType string
+	flags.StringVar(&instanceId, "instance", "", "String, ID of instance launched by the tool, the only one from state if empty")
+	flags.StringVar(&instanceType, "type", "", "String, new instance type")
+
+	return func(ctx context.Context, app *app) error {
+		if instanceType == "" {
+			return errors.New("-type is required")
+		}
+
+		instanceRecord, err := managedInstance(app, instanceId)
+		if err != nil {
+			return err
+		}
+
+		err = resizeInstance(ctx, app, instanceRecord.ID, instanceType)
+		if err != nil {
+			return err
+		}
+
+		if instanceType != app.spec.InstanceType {
+			slog.Info("Set spec's instanceType to " + instanceType + ", otherwise plan reports drift and replace brings the old type back")
+		}
+		return nil
+	}
+}
+
+// resizeInstance stops running instance, changes its type and starts it again, waiting for status checks to pass,
+// if the type can't be changed instance is started with the old one. Stopped instance is started once
+// to check it boots as the new type and stopped again
+func resizeInstance(ctx context.Context, app *app, instanceId string, instanceType string) (err error) {
+	instance, err := describeInstance(ctx, app.ec2Client, instanceId)
+	if err != nil {
+		return err
+	}
+	if instance == nil || instance.State == nil {
+		return fmt.Errorf("instance %s is gone", instanceId)
+	}
+	if string(instance.InstanceType) == instanceType {
+		return fmt.Errorf("instance %s is already %s", instanceId, instanceType)
+	}
+
+	err = checkTypeCompatible(ctx, app.ec2Client, *instance, instanceType)
+	if err != nil {
+		return err
+	}
+
+	wasStopped := instance.State.Name == types.InstanceStateNameStopped
+	if !wasStopped {
+		slog.Info("Stopping instance " + instanceId)
+		_, err = app.ec2Client.StopInstances(ctx, &ec2.StopInstancesInput{InstanceIds: []string{instanceId}})
+		if err != nil {
+			return err
+		}
+
+		// whatever happens from here, instance shouldn't be left stopped
+		defer func() {
+			startCtx, cancel := cleanupContext(ctx)
+			defer cancel()
+
+			slog.Info("Starting instance " + instanceId)
+			_, startErr := app.ec2Client.StartInstances(startCtx, &ec2.StartInstancesInput{InstanceIds: []string{instanceId}})
+			if startErr == nil {
+				startErr = waitStatusOk(startCtx, app.ec2Client, instanceId)
+			}
+			if startErr != nil {
+				err = errors.Join(err, fmt.Errorf("starting instance %s again: %w", instanceId, startErr))
+			}
+		}()
+	}
+
+	err = ec2.NewInstanceStoppedWaiter(app.ec2Client).Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceId}}, waitTimeout)
+	if err != nil {
+		return fmt.Errorf("waiting for instance %s to stop: %w", instanceId, err)
+	}
+
+	_, err = app.ec2Client.ModifyInstanceAttribute(ctx, &ec2.ModifyInstanceAttributeInput{
+		InstanceId:   aws.String(instanceId),
+		InstanceType: &types.AttributeValue{Value: aws.String(instanceType)},
+	})
+	if err != nil {
+		return fmt.Errorf("changing type of %s to %s: %w", instanceId, instanceType, err)
+	}
+
+	slog.Info("Instance " + instanceId + " type changed from " + string(instance.InstanceType) + " to " + instanceType)
+	if wasStopped {
+		return checkBoots(ctx, app, instanceId)
+	}
+
+	return nil
+}
+
+// checkBoots starts stopped instance, waits for status checks to pass and stops it again, whatever happened
+func checkBoots(ctx context.Context, app *app, instanceId string) (err error) {
+	slog.Info("Starting instance " + instanceId + " to check it boots")
+	_, err = app.ec2Client.StartInstances(ctx, &ec2.StartInstancesInput{InstanceIds: []string{instanceId}})
+	if err != nil {
+		return fmt.Errorf("starting instance %s: %w", instanceId, err)
+	}
+
+	defer func() {
+		stopCtx, cancel := cleanupContext(ctx)
+		defer cancel()
+
+		slog.Info("Stopping instance " + instanceId + " again")
+		_, stopErr := app.ec2Client.StopInstances(stopCtx, &ec2.StopInstancesInput{InstanceIds: []string{instanceId}})
+		if stopErr == nil {
+			stopErr = ec2.NewInstanceStoppedWaiter(app.ec2Client).Wait(stopCtx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceId}}, waitTimeout)
+		}
+		if stopErr != nil {
+			err = errors.Join(err, fmt.Errorf("stopping instance %s again: %w", instanceId, stopErr))
+		}
+	}()
+
+	return waitStatusOk(ctx, app.ec2Client, instanceId)
+}
+
+// checkTypeCompatible tells if instance can run as instance type: same architecture, EBS root and ENA when instance uses it
+func checkTypeCompatible(ctx context.Context, ec2Client ec2Client, instance types.Instance, instanceType string) error {
+	var found *types.InstanceTypeInfo
+	err := eachInstanceType(ctx, ec2Client, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []types.InstanceType{types.InstanceType(instanceType)},
+	}, func(info types.InstanceTypeInfo) bool {
+		found = &info
+		return false
+	})
+	if err != nil {
+		return fmt.Errorf("looking up instance type %s: %w", instanceType, err)
+	}
+	if found == nil {
+		return fmt.Errorf("instance type %s isn't offered in this region", instanceType)
+	}
+	info := *found
+
+	if info.ProcessorInfo != nil && instance.Architecture != "" {
+		architecture := types.ArchitectureType(instance.Architecture)
+		if !slices.Contains(info.ProcessorInfo.SupportedArchitectures, architecture) {
+			return fmt.Errorf("instance type %s doesn't support %s architecture of instance %s", instanceType, architecture, aws.ToString(instance.InstanceId))
+		}
+	}
+
+	if instance.RootDeviceType == types.DeviceTypeEbs && !slices.Contains(info.SupportedRootDeviceTypes, types.RootDeviceTypeEbs) {
+		return fmt.Errorf("instance type %s doesn't support EBS root volume", instanceType)
+	}
+
+	if aws.ToBool(instance.EnaSupport) && info.NetworkInfo != nil && info.NetworkInfo.EnaSupport == types.EnaSupportUnsupported {
+		return fmt.Errorf("instance %s uses ENA, instance type %s doesn't support it", aws.ToString(instance.InstanceId), instanceType)
+	}
+
+	return nil
+}
+
+// waitStatusOk blocks till instance and system status checks pass
+func waitStatusOk(ctx context.Context, ec2Client ec2Client, instanceId string) error {
+	err := ec2.NewInstanceStatusOkWaiter(ec2Client).Wait(ctx, &ec2.DescribeInstanceStatusInput{InstanceIds: []string{instanceId}}, waitTimeout)
+	if err != nil {
+		return fmt.Errorf("waiting for status checks of %s: %w", instanceId, err)
+	}
+
+	return nil
+}
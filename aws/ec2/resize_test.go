@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// newResizeMock returns fake client with running x86_64 t3.micro and t3.small offered
+func newResizeMock() *mockEc2Client {
+	ec2Client := newLaunchMock()
+	instance := &ec2Client.describeInstancesOutput.Reservations[0].Instances[0]
+	instance.InstanceType = types.InstanceTypeT3Micro
+	instance.Architecture = types.ArchitectureValuesX8664
+	instance.RootDeviceType = types.DeviceTypeEbs
+	instance.EnaSupport = aws.Bool(true)
+
+	ec2Client.describeInstanceTypesOutput = &ec2.DescribeInstanceTypesOutput{
+		InstanceTypes: []types.InstanceTypeInfo{{
+			InstanceType:             types.InstanceTypeT3Small,
+			ProcessorInfo:            &types.ProcessorInfo{SupportedArchitectures: []types.ArchitectureType{types.ArchitectureTypeX8664}},
+			SupportedRootDeviceTypes: []types.RootDeviceType{types.RootDeviceTypeEbs},
+			NetworkInfo:              &types.NetworkInfo{EnaSupport: types.EnaSupportRequired},
+		}},
+	}
+
+	return ec2Client
+}
+
+func TestResizeInstance(t *testing.T) {
+	ec2Client := newResizeMock()
+	app := &app{ec2Client: ec2Client}
+
+	err := resizeInstance(context.TODO(), app, "i-0f3f71c5c31adaae2", "t3.small")
+	if err != nil {
+		t.Fatal("Error resizing instance: " + err.Error())
+	}
+
+	if strings.Join(ec2Client.calls, ",") != "StopInstances,ModifyInstanceAttribute,StartInstances" {
+		t.Errorf("calls are %v", ec2Client.calls)
+	}
+	instance, _ := describeInstance(context.TODO(), ec2Client, "i-0f3f71c5c31adaae2")
+	if instance.InstanceType != types.InstanceTypeT3Small || instance.State.Name != types.InstanceStateNameRunning {
+		t.Errorf("instance is %s and %s, expected running t3.small", instance.InstanceType, instance.State.Name)
+	}
+}
+
+func TestResizeInstanceStartsAfterFailure(t *testing.T) {
+	ec2Client := newResizeMock()
+	ec2Client.failOn = map[string]error{"ModifyInstanceAttribute": errors.New("IncorrectInstanceState")}
+	app := &app{ec2Client: ec2Client}
+
+	err := resizeInstance(context.TODO(), app, "i-0f3f71c5c31adaae2", "t3.small")
+	if err == nil {
+		t.Fatal("failed type change should be reported")
+	}
+
+	if strings.Join(ec2Client.calls, ",") != "StopInstances,ModifyInstanceAttribute,StartInstances" {
+		t.Errorf("instance should be started with the old type, calls are %v", ec2Client.calls)
+	}
+}
+
+func TestResizeStoppedInstance(t *testing.T) {
+	ec2Client := newResizeMock()
+	ec2Client.setInstanceState([]string{"i-0f3f71c5c31adaae2"}, types.InstanceStateNameStopped)
+	app := &app{ec2Client: ec2Client}
+
+	err := resizeInstance(context.TODO(), app, "i-0f3f71c5c31adaae2", "t3.small")
+	if err != nil {
+		t.Fatal("Error resizing instance: " + err.Error())
+	}
+
+	if strings.Join(ec2Client.calls, ",") != "ModifyInstanceAttribute,StartInstances,StopInstances" {
+		t.Errorf("stopped instance should be started to check the new type boots, calls are %v", ec2Client.calls)
+	}
+	instance, _ := describeInstance(context.TODO(), ec2Client, "i-0f3f71c5c31adaae2")
+	if instance.InstanceType != types.InstanceTypeT3Small || instance.State.Name != types.InstanceStateNameStopped {
+		t.Errorf("instance is %s and %s, expected stopped t3.small", instance.InstanceType, instance.State.Name)
+	}
+
+	// failed status checks are reported, instance is stopped anyway
+	ec2Client.calls = nil
+	ec2Client.failOn = map[string]error{"DescribeInstanceStatus": errors.New("InternalError")}
+	err = resizeInstance(context.TODO(), app, "i-0f3f71c5c31adaae2", "t3.micro")
+	if err == nil {
+		t.Error("new type that doesn't pass status checks should fail resize")
+	}
+	if strings.Join(ec2Client.calls, ",") != "ModifyInstanceAttribute,StartInstances,StopInstances" {
+		t.Errorf("instance should be stopped again, calls are %v", ec2Client.calls)
+	}
+}
+
+func TestResizeIncompatibleType(t *testing.T) {
+	ec2Client := newResizeMock()
+	ec2Client.describeInstanceTypesOutput.InstanceTypes[0].ProcessorInfo.SupportedArchitectures = []types.ArchitectureType{types.ArchitectureTypeArm64}
+	app := &app{ec2Client: ec2Client}
+
+	err := resizeInstance(context.TODO(), app, "i-0f3f71c5c31adaae2", "t4g.small")
+	if err == nil || !strings.Contains(err.Error(), "architecture") {
+		t.Errorf("arm64 type for x86_64 instance should be rejected, got %v", err)
+	}
+	if len(ec2Client.calls) > 0 {
+		t.Errorf("incompatible instance shouldn't be stopped, calls are %v", ec2Client.calls)
+	}
+}
+
+func TestResizeCommandNeedsType(t *testing.T) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	err = resizeCommand(flag.NewFlagSet("resize", flag.ContinueOnError))(context.TODO(), &app{ec2Client: newResizeMock(), spec: defaultSpec(), state: st})
+	if err == nil {
+		t.Error("resize without -type should fail")
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const sshTimeout time.Duration = 30 * time.Second
+
+// sshSession is SSH connection to a host, as much of it as key rotation needs
+type sshSession interface {
+	// addAuthorizedKey appends line to authorized_keys unless it's there already
+	addAuthorizedKey(line string) error
+	// removeAuthorizedKey drops every authorized_keys line with base64 public key
+	removeAuthorizedKey(publicKey string) error
+	close() error
+}
+
+// sshDialer logs in to address as user with private key
+type sshDialer func(ctx context.Context, address string, user string, signer ssh.Signer) (sshSession, error)
+
+// hostRotation is what happened on a single instance
+type hostRotation struct {
+	InstanceId string
+	Address    string
+	Pushed     bool
+	Verified   bool
+	OldRemoved bool
+	Err        error
+}
+
+type rotateOptions struct {
+	oldKeyPath string
+	user       string
+}
+
+func rotateKeyCommand(flags *flag.FlagSet) func(ctx context.Context, app *app) error {
+	var (
+		opts                  rotateOptions
+		knownHostsPath        string
+		insecureIgnoreHostKey bool
+	)
+	flags.StringVar(&opts.oldKeyPath, "old-key", "", "String, private key of the current key pair, <key-dir>/<key name>.pem if empty")
+	flags.StringVar(&opts.user, "user", "", "String, SSH user, default user of spec's image if empty")
+	flags.StringVar(&knownHostsPath, "known-hosts", "", "String, known_hosts file to verify host keys with, required unless -insecure-ignore-host-key")
+	flags.BoolVar(&insecureIgnoreHostKey, "insecure-ignore-host-key", false, "Bool, don't verify host keys, a host in the middle gets the new key then")
+
+	return func(ctx context.Context, app *app) error {
+		dial, err := newSSHDialer(knownHostsPath, insecureIgnoreHostKey)
+		if err != nil {
+			return err
+		}
+
+		hosts, err := rotateKey(ctx, app, opts, dial)
+		printErr := printHostRotations(os.Stdout, hosts)
+
+		return errors.Join(err, printErr)
+	}
+}
+
+// rotateKey creates new key pair and moves every running managed instance to it: new key is added with the old one,
+// login with the new key is checked, then the old key is removed. New key pair stays pending till all hosts moved,
+// launches keep using the old one meanwhile, and the next run goes on with it. Then the old key pair is deleted,
+// unless some managed instances aren't running, they can't be moved and would be locked out
+func rotateKey(ctx context.Context, app *app, opts rotateOptions, dial sshDialer) ([]hostRotation, error) {
+	oldKeyName := app.keyName()
+	if opts.oldKeyPath == "" {
+		opts.oldKeyPath = app.keyPath(oldKeyName)
+	}
+	if opts.user == "" {
+		opts.user = app.spec.Image.sshUser()
+	}
+
+	oldSigner, err := readSigner(opts.oldKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading old private key: %w", err)
+	}
+
+	instances := []types.Instance{}
+	notRunning := []string{}
+	err = eachInstance(ctx, app.ec2Client, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("tag:" + managedByTagKey), Values: []string{managedByTagValue}},
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}},
+		},
+	}, func(instance types.Instance) bool {
+		if instance.State != nil && instance.State.Name == types.InstanceStateNameRunning {
+			instances = append(instances, instance)
+		} else {
+			notRunning = append(notRunning, aws.ToString(instance.InstanceId))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	newKeyPair, newSigner, resuming, err := startRotation(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+	newLine := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(newSigner.PublicKey()))) + " " + newKeyPair.Name
+	oldPublicKey := authorizedKeyBlob(oldSigner.PublicKey())
+
+	hosts := []hostRotation{}
+	failed := 0
+	for _, instance := range instances {
+		host := hostRotation{InstanceId: aws.ToString(instance.InstanceId), Address: instanceAddress(instance)}
+		host.Err = rotateHost(ctx, dial, &host, opts.user, oldSigner, newSigner, newLine, oldPublicKey, resuming)
+		if host.Err != nil {
+			failed++
+		}
+		hosts = append(hosts, host)
+	}
+
+	if failed > 0 {
+		return hosts, fmt.Errorf("%d of %d hosts weren't moved to %s, old key pair %s stays in use, run rotate-key again to finish", failed, len(hosts), newKeyPair.Name, oldKeyName)
+	}
+	if len(notRunning) > 0 {
+		return hosts, fmt.Errorf("instances %s aren't running, so they still use only old key pair %s, start them and run rotate-key again to finish", strings.Join(notRunning, ", "), oldKeyName)
+	}
+
+	newKeyPair.Pending = false
+	app.state.record(newKeyPair)
+	err = app.state.save()
+	if err != nil {
+		return hosts, err
+	}
+
+	oldKeyPair, found := app.state.findByName(resourceKeyPair, oldKeyName)
+	if !found {
+		oldKeyPair = resource{Type: resourceKeyPair, ID: oldKeyName, Name: oldKeyName}
+	}
+	err = destroyResource(ctx, app.ec2Client, oldKeyPair)
+	if err != nil {
+		return hosts, fmt.Errorf("deleting old key pair %s: %w", oldKeyName, err)
+	}
+	app.state.forget(resourceKeyPair, oldKeyPair.ID)
+	slog.Info("Key pair " + oldKeyName + " replaced with " + newKeyPair.Name)
+
+	return hosts, app.state.save()
+}
+
+// startRotation goes on with key pair of unfinished rotation or creates new pending one, resuming tells which
+func startRotation(ctx context.Context, app *app) (resource, ssh.Signer, bool, error) {
+	if keyPair, found := app.pendingKeyPair(); found {
+		signer, err := readSigner(app.keyPath(keyPair.Name))
+		if err != nil {
+			return resource{}, nil, false, fmt.Errorf("reading private key of unfinished rotation to %s: %w", keyPair.Name, err)
+		}
+		slog.Info("Continuing rotation to key pair " + keyPair.Name)
+		return keyPair, signer, true, nil
+	}
+
+	newKeyName := keyPairName + "-" + app.now().UTC().Format(imageTimestampLayout)
+	created, err := createKeyPair(ctx, app.ec2Client, newKeyName)
+	if err != nil {
+		return resource{}, nil, false, fmt.Errorf("creating key pair %s: %w", newKeyName, err)
+	}
+	keyPair := resource{Type: resourceKeyPair, ID: aws.ToString(created.KeyPairId), Name: newKeyName, SpecHash: app.spec.hash(), Pending: true}
+	app.state.record(keyPair)
+	err = errors.Join(app.state.save(), app.saveKeyMaterial(created))
+	if err != nil {
+		return resource{}, nil, false, err
+	}
+
+	signer, err := ssh.ParsePrivateKey([]byte(aws.ToString(created.KeyMaterial)))
+	if err != nil {
+		return resource{}, nil, false, fmt.Errorf("parsing private key of %s: %w", newKeyName, err)
+	}
+
+	// record set CreatedAt, keep it when the key pair is recorded again
+	keyPair, _ = app.state.findByName(resourceKeyPair, newKeyName)
+	return keyPair, signer, false, nil
+}
+
+// rotateHost adds new key logging in with the old one, then logs in with the new key and removes the old one,
+// when resuming, host the previous run moved already only gets the old key removed
+func rotateHost(ctx context.Context, dial sshDialer, host *hostRotation, user string, oldSigner ssh.Signer, newSigner ssh.Signer, newLine string, oldPublicKey string, resuming bool) error {
+	if host.Address == "" {
+		return errors.New("instance has no IP address")
+	}
+
+	if resuming {
+		session, err := dial(ctx, host.Address, user, newSigner)
+		if err == nil {
+			defer session.close()
+			host.Pushed, host.Verified = true, true
+			return removeOldKey(session, host, oldPublicKey)
+		}
+	}
+
+	session, err := dial(ctx, host.Address, user, oldSigner)
+	if err != nil {
+		return fmt.Errorf("logging in with old key: %w", err)
+	}
+	err = session.addAuthorizedKey(newLine)
+	session.close()
+	if err != nil {
+		return fmt.Errorf("adding new key: %w", err)
+	}
+	host.Pushed = true
+
+	session, err = dial(ctx, host.Address, user, newSigner)
+	if err != nil {
+		return fmt.Errorf("logging in with new key: %w", err)
+	}
+	defer session.close()
+	host.Verified = true
+
+	return removeOldKey(session, host, oldPublicKey)
+}
+
+func removeOldKey(session sshSession, host *hostRotation, oldPublicKey string) error {
+	err := session.removeAuthorizedKey(oldPublicKey)
+	if err != nil {
+		return fmt.Errorf("removing old key: %w", err)
+	}
+	host.OldRemoved = true
+
+	return nil
+}
+
+func readSigner(path string) (ssh.Signer, error) {
+	privateKey, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(privateKey)
+}
+
+// authorizedKeyBlob is base64 part of authorized_keys line, it identifies the key whatever the comment
+func authorizedKeyBlob(publicKey ssh.PublicKey) string {
+	fields := strings.Fields(string(ssh.MarshalAuthorizedKey(publicKey)))
+	return fields[1]
+}
+
+// instanceAddress prefers public IP, private one works from inside the VPC or over VPN
+func instanceAddress(instance types.Instance) string {
+	if instance.PublicIpAddress != nil {
+		return *instance.PublicIpAddress
+	}
+
+	return aws.ToString(instance.PrivateIpAddress)
+}
+
+func printHostRotations(w io.Writer, hosts []hostRotation) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tADDRESS\tNEW KEY ADDED\tNEW KEY WORKS\tOLD KEY REMOVED\tERROR")
+	for _, host := range hosts {
+		errText := "-"
+		if host.Err != nil {
+			errText = host.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%t\t%t\t%s\n", host.InstanceId, host.Address, host.Pushed, host.Verified, host.OldRemoved, errText)
+	}
+
+	return tw.Flush()
+}
+
+// newSSHDialer returns dialer checking host keys against known_hosts file, or not checking them only if asked so
+// explicitly, as authorized_keys of a host which identity wasn't checked may be someone else's
+func newSSHDialer(knownHostsPath string, insecureIgnoreHostKey bool) (sshDialer, error) {
+	var hostKeyCallback ssh.HostKeyCallback
+	switch {
+	case knownHostsPath != "" && insecureIgnoreHostKey:
+		return nil, errors.New("-known-hosts and -insecure-ignore-host-key can't be used together")
+	case knownHostsPath != "":
+		var err error
+		hostKeyCallback, err = knownhosts.New(knownHostsPath)
+		if err != nil {
+			return nil, err
+		}
+	case insecureIgnoreHostKey:
+		slog.Warn("Host keys aren't verified, keys are pushed to whatever host answers at instance addresses")
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	default:
+		return nil, errors.New("-known-hosts is required to verify host keys, -insecure-ignore-host-key skips the check")
+	}
+
+	return func(ctx context.Context, address string, user string, signer ssh.Signer) (sshSession, error) {
+		config := &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         sshTimeout,
+		}
+
+		conn, err := (&net.Dialer{Timeout: sshTimeout}).DialContext(ctx, "tcp", net.JoinHostPort(address, "22"))
+		if err != nil {
+			return nil, err
+		}
+		sshConn, channels, requests, err := ssh.NewClientConn(conn, address, config)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return &remoteSession{client: ssh.NewClient(sshConn, channels, requests)}, nil
+	}, nil
+}
+
+// remoteSession edits ~/.ssh/authorized_keys with shell commands, keys and comments never contain single quotes
+type remoteSession struct {
+	client *ssh.Client
+}
+
+func (s *remoteSession) run(command string) error {
+	session, err := s.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	output, err := session.CombinedOutput(command)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+func (s *remoteSession) addAuthorizedKey(line string) error {
+	return s.run(fmt.Sprintf(`mkdir -p ~/.ssh && chmod 700 ~/.ssh && touch ~/.ssh/authorized_keys && (grep -qxF '%[1]s' ~/.ssh/authorized_keys || echo '%[1]s' >> ~/.ssh/authorized_keys)`, line))
+}
+
+func (s *remoteSession) removeAuthorizedKey(publicKey string) error {
+	// rewriting the file in place keeps its owner and mode
+	return s.run(fmt.Sprintf(`f=~/.ssh/authorized_keys; { grep -vF '%s' "$f" || true; } > "$f.rotate" && cat "$f.rotate" > "$f" && rm "$f.rotate"`, publicKey))
+}
+
+func (s *remoteSession) close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeHost keeps authorized_keys of a host, login works with any key listed there
+type fakeHost struct {
+	authorizedKeys []string
+	// removing old key fails when set
+	removeErr error
+}
+
+type fakeSession struct {
+	host *fakeHost
+}
+
+func (s *fakeSession) addAuthorizedKey(line string) error {
+	for _, existing := range s.host.authorizedKeys {
+		if existing == line {
+			return nil
+		}
+	}
+	s.host.authorizedKeys = append(s.host.authorizedKeys, line)
+	return nil
+}
+
+func (s *fakeSession) removeAuthorizedKey(publicKey string) error {
+	if s.host.removeErr != nil {
+		return s.host.removeErr
+	}
+	kept := []string{}
+	for _, line := range s.host.authorizedKeys {
+		if !strings.Contains(line, publicKey) {
+			kept = append(kept, line)
+		}
+	}
+	s.host.authorizedKeys = kept
+	return nil
+}
+
+func (s *fakeSession) close() error {
+	return nil
+}
+
+func fakeDialer(hosts map[string]*fakeHost) sshDialer {
+	return func(ctx context.Context, address string, user string, signer ssh.Signer) (sshSession, error) {
+		host, ok := hosts[address]
+		if !ok {
+			return nil, errors.New("connection refused")
+		}
+		publicKey := authorizedKeyBlob(signer.PublicKey())
+		for _, line := range host.authorizedKeys {
+			if strings.Contains(line, publicKey) {
+				return &fakeSession{host: host}, nil
+			}
+		}
+		return nil, errors.New("permission denied (publickey)")
+	}
+}
+
+func generatePrivateKey(t *testing.T) ([]byte, string) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(privateKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(block), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+}
+
+// rotateSetup has two running managed instances authorizing the old key, saved to key dir
+func rotateSetup(t *testing.T) (*app, *mockEc2Client, map[string]*fakeHost, string) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	t.Cleanup(func() { st.close() })
+	st.record(resource{Type: resourceKeyPair, ID: "key-0123456789abcdef0", Name: keyPairName})
+
+	keyDir := t.TempDir()
+	oldPrivateKey, oldLine := generatePrivateKey(t)
+	err = os.WriteFile(filepath.Join(keyDir, keyPairName+".pem"), oldPrivateKey, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPrivateKey, _ := generatePrivateKey(t)
+
+	ec2Client := &mockEc2Client{
+		createKeyPairOutput: &ec2.CreateKeyPairOutput{
+			KeyName:     aws.String(keyPairName + "-20240301-120000"),
+			KeyPairId:   aws.String("key-0fedcba9876543210"),
+			KeyMaterial: aws.String(string(newPrivateKey)),
+		},
+		describeInstancesOutput: &ec2.DescribeInstancesOutput{
+			Reservations: []types.Reservation{{Instances: []types.Instance{
+				{InstanceId: aws.String("i-0123456789abcdef0"), PublicIpAddress: aws.String("198.51.100.10"), State: &types.InstanceState{Name: types.InstanceStateNameRunning}},
+				{InstanceId: aws.String("i-0123456789abcdef1"), PrivateIpAddress: aws.String("10.0.0.11"), State: &types.InstanceState{Name: types.InstanceStateNameRunning}},
+			}}},
+		},
+	}
+	hosts := map[string]*fakeHost{
+		"198.51.100.10": {authorizedKeys: []string{oldLine + " " + keyPairName}},
+		"10.0.0.11":     {authorizedKeys: []string{"ssh-ed25519 AAAAother admin", oldLine + " " + keyPairName}},
+	}
+	app := &app{
+		ec2Client: ec2Client,
+		spec:      defaultSpec(),
+		keyDir:    keyDir,
+		state:     st,
+		now:       func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) },
+	}
+
+	return app, ec2Client, hosts, oldLine
+}
+
+func TestRotateKey(t *testing.T) {
+	app, ec2Client, hosts, oldLine := rotateSetup(t)
+
+	rotations, err := rotateKey(context.TODO(), app, rotateOptions{}, fakeDialer(hosts))
+	if err != nil {
+		t.Fatal("Error rotating key: " + err.Error())
+	}
+	if len(rotations) != 2 {
+		t.Fatalf("expected 2 hosts in report, got %d", len(rotations))
+	}
+	for _, rotation := range rotations {
+		if !rotation.Pushed || !rotation.Verified || !rotation.OldRemoved {
+			t.Errorf("host %s wasn't fully rotated: %+v", rotation.Address, rotation)
+		}
+	}
+
+	for address, host := range hosts {
+		for _, line := range host.authorizedKeys {
+			if strings.HasPrefix(line, oldLine) {
+				t.Errorf("old key is still authorized on %s", address)
+			}
+		}
+	}
+	if hosts["10.0.0.11"].authorizedKeys[0] != "ssh-ed25519 AAAAother admin" {
+		t.Errorf("unrelated keys should be kept, got %v", hosts["10.0.0.11"].authorizedKeys)
+	}
+
+	if strings.Join(ec2Client.calls, ",") != "CreateKeyPair,DeleteKeyPair" {
+		t.Errorf("expected new key pair created and old one deleted, calls are %v", ec2Client.calls)
+	}
+	if app.keyName() != keyPairName+"-20240301-120000" {
+		t.Errorf("new key pair should be current one, got %s", app.keyName())
+	}
+	if _, found := app.state.findByName(resourceKeyPair, keyPairName); found {
+		t.Error("old key pair should be forgotten")
+	}
+	if _, err := os.Stat(app.keyPath(app.keyName())); err != nil {
+		t.Error("new private key should be saved: " + err.Error())
+	}
+}
+
+func TestRotateKeyKeepsOldKeyPairOnFailure(t *testing.T) {
+	app, ec2Client, hosts, oldLine := rotateSetup(t)
+	hosts["10.0.0.11"].removeErr = errors.New("read-only file system")
+
+	rotations, err := rotateKey(context.TODO(), app, rotateOptions{}, fakeDialer(hosts))
+	if err == nil {
+		t.Fatal("expected error when a host fails")
+	}
+	if !rotations[0].OldRemoved || rotations[1].OldRemoved || !rotations[1].Verified || rotations[1].Err == nil {
+		t.Errorf("unexpected report %+v", rotations)
+	}
+	if !strings.HasPrefix(hosts["10.0.0.11"].authorizedKeys[1], oldLine) {
+		t.Error("old key should still be authorized on failed host")
+	}
+
+	for _, call := range ec2Client.calls {
+		if call == "DeleteKeyPair" {
+			t.Error("old key pair shouldn't be deleted while a host still uses it")
+		}
+	}
+	if _, found := app.state.findByName(resourceKeyPair, keyPairName); !found {
+		t.Error("old key pair should stay in state")
+	}
+	if app.keyName() != keyPairName {
+		t.Errorf("launches should keep using old key pair, got %s", app.keyName())
+	}
+	if pending, found := app.pendingKeyPair(); !found || pending.Name != keyPairName+"-20240301-120000" {
+		t.Errorf("new key pair should be pending, got %+v", pending)
+	}
+
+	// re-run goes on with the pending key pair, moved host only gets checked
+	hosts["10.0.0.11"].removeErr = nil
+	ec2Client.calls = nil
+	rotations, err = rotateKey(context.TODO(), app, rotateOptions{}, fakeDialer(hosts))
+	if err != nil {
+		t.Fatal("Error finishing rotation: " + err.Error())
+	}
+	for _, rotation := range rotations {
+		if !rotation.OldRemoved {
+			t.Errorf("host %s wasn't fully rotated: %+v", rotation.Address, rotation)
+		}
+	}
+	if strings.Join(ec2Client.calls, ",") != "DeleteKeyPair" {
+		t.Errorf("expected no new key pair and old one deleted, calls are %v", ec2Client.calls)
+	}
+	if strings.HasPrefix(hosts["10.0.0.11"].authorizedKeys[1], oldLine) {
+		t.Error("old key should be removed from failed host")
+	}
+	if _, found := app.pendingKeyPair(); found || app.keyName() != keyPairName+"-20240301-120000" {
+		t.Errorf("new key pair should be current one, got %s", app.keyName())
+	}
+}
+
+func TestRotateKeyKeepsOldKeyPairForStoppedInstances(t *testing.T) {
+	app, ec2Client, hosts, _ := rotateSetup(t)
+	reservation := &ec2Client.describeInstancesOutput.Reservations[0]
+	reservation.Instances = append(reservation.Instances, types.Instance{
+		InstanceId:       aws.String("i-0123456789abcdef2"),
+		PrivateIpAddress: aws.String("10.0.0.12"),
+		State:            &types.InstanceState{Name: types.InstanceStateNameStopped},
+	})
+
+	rotations, err := rotateKey(context.TODO(), app, rotateOptions{}, fakeDialer(hosts))
+	if err == nil || !strings.Contains(err.Error(), "i-0123456789abcdef2") {
+		t.Fatalf("stopped instance should be named in error, got %v", err)
+	}
+	if len(rotations) != 2 || !rotations[0].OldRemoved || !rotations[1].OldRemoved {
+		t.Errorf("running hosts should still be moved, got %+v", rotations)
+	}
+	if strings.Join(ec2Client.calls, ",") != "CreateKeyPair" {
+		t.Errorf("old key pair shouldn't be deleted while stopped instance uses it, calls are %v", ec2Client.calls)
+	}
+	if _, found := app.pendingKeyPair(); !found || app.keyName() != keyPairName {
+		t.Errorf("new key pair should stay pending, current one is %s", app.keyName())
+	}
+}
+
+func TestPrintHostRotations(t *testing.T) {
+	buf := bytes.Buffer{}
+	err := printHostRotations(&buf, []hostRotation{
+		{InstanceId: "i-0123456789abcdef0", Address: "198.51.100.10", Pushed: true, Verified: true, OldRemoved: true},
+		{InstanceId: "i-0123456789abcdef1", Address: "10.0.0.11", Err: errors.New("connection refused")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "INSTANCE") || !strings.Contains(lines[2], "connection refused") {
+		t.Errorf("unexpected report:\n%s", buf.String())
+	}
+}
+
+func TestNewSSHDialer(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	err := os.WriteFile(knownHosts, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newSSHDialer("", false); err == nil {
+		t.Error("dialer without known_hosts should need -insecure-ignore-host-key")
+	}
+	if _, err := newSSHDialer(knownHosts, true); err == nil {
+		t.Error("-known-hosts and -insecure-ignore-host-key shouldn't go together")
+	}
+	if _, err := newSSHDialer(knownHosts, false); err != nil {
+		t.Error("Error creating dialer with known_hosts: " + err.Error())
+	}
+	if _, err := newSSHDialer("", true); err != nil {
+		t.Error("Error creating insecure dialer: " + err.Error())
+	}
+}
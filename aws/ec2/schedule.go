@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	_ "time/tzdata" // schedules name IANA zones, don't depend on zoneinfo being installed
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const (
+	scheduleTagKey string = "schedule"
+
+	// how far back to look for the last start or stop, a week plus a day covers any weekly schedule
+	scheduleLookback time.Duration = 8 * 24 * time.Hour
+)
+
+// cronField is set of allowed values of one cron field, indexed by value
+type cronField []bool
+
+// cronExpr is classic 5-field cron expression: minute hour day-of-month month day-of-week
+type cronExpr struct {
+	minutes cronField
+	hours   cronField
+	days    cronField
+	months  cronField
+	weekday cronField
+	// as in cron, when both day fields are restricted either of them matching is enough
+	daysRestricted    bool
+	weekdayRestricted bool
+}
+
+// parseCron supports *, single values, ranges, lists and steps, like "*/15 8-18 * * 1-5", Sunday is 0 or 7
+func parseCron(expr string) (cronExpr, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronExpr{}, fmt.Errorf("cron expression %q should have 5 fields, has %d", expr, len(fields))
+	}
+
+	var (
+		c   cronExpr
+		err error
+	)
+	bounds := []struct {
+		field *cronField
+		min   int
+		max   int
+	}{
+		{&c.minutes, 0, 59},
+		{&c.hours, 0, 23},
+		{&c.days, 1, 31},
+		{&c.months, 1, 12},
+		{&c.weekday, 0, 7},
+	}
+	for i, bound := range bounds {
+		*bound.field, err = parseCronField(fields[i], bound.min, bound.max)
+		if err != nil {
+			return cronExpr{}, fmt.Errorf("cron expression %q: %w", expr, err)
+		}
+	}
+
+	// 7 is another way to write Sunday
+	if c.weekday[7] {
+		c.weekday[0] = true
+	}
+	c.daysRestricted = fields[2] != "*"
+	c.weekdayRestricted = fields[4] != "*"
+
+	return c, nil
+}
+
+func parseCronField(field string, min int, max int) (cronField, error) {
+	values := make(cronField, max+1)
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("bad step in %q", part)
+			}
+		}
+
+		from, to := min, max
+		if rangePart != "*" {
+			fromPart, toPart, isRange := strings.Cut(rangePart, "-")
+			var err error
+			from, err = strconv.Atoi(fromPart)
+			if err != nil {
+				return nil, fmt.Errorf("bad value in %q", part)
+			}
+
+			to = from
+			if isRange {
+				to, err = strconv.Atoi(toPart)
+				if err != nil {
+					return nil, fmt.Errorf("bad range in %q", part)
+				}
+			} else if hasStep {
+				// "5/15" means from 5 till the end with step 15
+				to = max
+			}
+		}
+
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for value := from; value <= to; value += step {
+			values[value] = true
+		}
+	}
+
+	return values, nil
+}
+
+func (c cronExpr) matches(t time.Time) bool {
+	if !c.minutes[t.Minute()] || !c.hours[t.Hour()] || !c.months[int(t.Month())] {
+		return false
+	}
+
+	dayMatches := c.days[t.Day()]
+	weekdayMatches := c.weekday[int(t.Weekday())]
+	if c.daysRestricted && c.weekdayRestricted {
+		return dayMatches || weekdayMatches
+	}
+
+	return dayMatches && weekdayMatches
+}
+
+// lastAt returns the latest minute not after t matching expression, looking back up to lookback
+func (c cronExpr) lastAt(t time.Time, lookback time.Duration) (time.Time, bool) {
+	earliest := t.Add(-lookback)
+	for minute := t.Truncate(time.Minute); !minute.Before(earliest); minute = minute.Add(-time.Minute) {
+		if c.matches(minute) {
+			return minute, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// instanceSchedule is parsed schedule tag, like "start=0 8 * * 1-5; stop=0 19 * * 1-5; tz=Europe/Berlin",
+// either start or stop may be left out, time zone is UTC by default
+type instanceSchedule struct {
+	start    *cronExpr
+	stop     *cronExpr
+	location *time.Location
+}
+
+func parseSchedule(value string) (instanceSchedule, error) {
+	schedule := instanceSchedule{location: time.UTC}
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		key, expr, found := strings.Cut(part, "=")
+		if !found {
+			return schedule, fmt.Errorf("expected key=value in %q", part)
+		}
+		expr = strings.TrimSpace(expr)
+
+		switch strings.TrimSpace(key) {
+		case "start", "stop":
+			c, err := parseCron(expr)
+			if err != nil {
+				return schedule, err
+			}
+
+			if strings.TrimSpace(key) == "start" {
+				schedule.start = &c
+			} else {
+				schedule.stop = &c
+			}
+
+		case "tz":
+			location, err := time.LoadLocation(expr)
+			if err != nil {
+				return schedule, err
+			}
+			schedule.location = location
+
+		default:
+			return schedule, fmt.Errorf("unknown schedule key %q, expected start, stop or tz", key)
+		}
+	}
+
+	if schedule.start == nil && schedule.stop == nil {
+		return schedule, errors.New("schedule has neither start nor stop")
+	}
+
+	return schedule, nil
+}
+
+// desiredState is running or stopped, whichever of start and stop happened last,
+// ok is false when neither happened within lookback, then instance is left as it is
+func (s instanceSchedule) desiredState(now time.Time) (state types.InstanceStateName, ok bool) {
+	local := now.In(s.location)
+
+	var lastStart, lastStop time.Time
+	if s.start != nil {
+		lastStart, _ = s.start.lastAt(local, scheduleLookback)
+	}
+	if s.stop != nil {
+		lastStop, _ = s.stop.lastAt(local, scheduleLookback)
+	}
+
+	switch {
+	case lastStart.IsZero() && lastStop.IsZero():
+		return "", false
+	case lastStart.After(lastStop):
+		return types.InstanceStateNameRunning, true
+	default:
+		return types.InstanceStateNameStopped, true
+	}
+}
+
+// scheduleAction is what scheduler decided for one instance
+type scheduleAction struct {
+	InstanceId string
+	Name       string
+	Current    types.InstanceStateName
+	Desired    types.InstanceStateName
+	Action     string
+	Err        error
+}
+
+func scheduleCommand(flags *flag.FlagSet) func(ctx context.Context, app *app) error {
+	var dryRun bool
+	flags.BoolVar(&dryRun, "dry-run", false, "Bool, only print what would be started and stopped")
+
+	return func(ctx context.Context, app *app) error {
+		actions, err := scheduleInstances(ctx, app, dryRun)
+		printErr := printScheduleActions(os.Stdout, actions, dryRun)
+
+		return errors.Join(err, printErr)
+	}
+}
+
+// scheduleInstances starts and stops managed instances with schedule tag, so they match their schedule at app.now()
+func scheduleInstances(ctx context.Context, app *app, dryRun bool) ([]scheduleAction, error) {
+	now := app.now()
+	actions := []scheduleAction{}
+	err := eachInstance(ctx, app.ec2Client, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("tag:" + managedByTagKey), Values: []string{managedByTagValue}},
+			{Name: aws.String("tag-key"), Values: []string{scheduleTagKey}},
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}},
+		},
+	}, func(instance types.Instance) bool {
+		action := scheduleAction{
+			InstanceId: aws.ToString(instance.InstanceId),
+			Name:       tagValue(instance.Tags, "Name"),
+			Action:     "none",
+		}
+		if instance.State != nil {
+			action.Current = instance.State.Name
+		}
+
+		schedule, err := parseSchedule(tagValue(instance.Tags, scheduleTagKey))
+		if err != nil {
+			action.Err = err
+			actions = append(actions, action)
+			return true
+		}
+
+		desired, ok := schedule.desiredState(now)
+		if ok {
+			action.Desired = desired
+			switch {
+			case desired == types.InstanceStateNameRunning && action.Current == types.InstanceStateNameStopped:
+				action.Action = "start"
+			case desired == types.InstanceStateNameStopped && action.Current == types.InstanceStateNameRunning:
+				action.Action = "stop"
+			}
+		}
+		actions = append(actions, action)
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// instances with bad schedule tag are left as they are, but still fail the run
+	errs := []error{}
+	for _, action := range actions {
+		if action.Err != nil {
+			errs = append(errs, fmt.Errorf("schedule of %s: %w", action.InstanceId, action.Err))
+		}
+	}
+	if dryRun {
+		return actions, errors.Join(errs...)
+	}
+
+	toStart, toStop := []string{}, []string{}
+	for _, action := range actions {
+		switch action.Action {
+		case "start":
+			toStart = append(toStart, action.InstanceId)
+		case "stop":
+			toStop = append(toStop, action.InstanceId)
+		}
+	}
+
+	if len(toStart) > 0 {
+		slog.Info("Starting instances: " + strings.Join(toStart, ", "))
+		_, err = app.ec2Client.StartInstances(ctx, &ec2.StartInstancesInput{InstanceIds: toStart})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("starting instances: %w", err))
+		}
+	}
+	if len(toStop) > 0 {
+		slog.Info("Stopping instances: " + strings.Join(toStop, ", "))
+		_, err = app.ec2Client.StopInstances(ctx, &ec2.StopInstancesInput{InstanceIds: toStop})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stopping instances: %w", err))
+		}
+	}
+
+	return actions, errors.Join(errs...)
+}
+
+func printScheduleActions(w io.Writer, actions []scheduleAction, dryRun bool) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	header := "INSTANCE\tNAME\tCURRENT\tDESIRED\tACTION"
+	if dryRun {
+		header += " (dry run)"
+	}
+	fmt.Fprintln(tw, header)
+
+	for _, action := range actions {
+		desired := string(action.Desired)
+		if action.Err != nil {
+			desired = "bad schedule: " + action.Err.Error()
+		} else if desired == "" {
+			desired = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", action.InstanceId, action.Name, action.Current, desired, action.Action)
+	}
+
+	return tw.Flush()
+}
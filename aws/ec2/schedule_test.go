@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestParseCron(t *testing.T) {
+	c, err := parseCron("*/15 8-18 * * 1-5")
+	if err != nil {
+		t.Fatal("Error parsing cron: " + err.Error())
+	}
+
+	matching := time.Date(2024, 8, 15, 8, 45, 0, 0, time.UTC) // Thursday
+	if !c.matches(matching) {
+		t.Errorf("%v should match", matching)
+	}
+
+	for _, notMatching := range []time.Time{
+		time.Date(2024, 8, 15, 8, 50, 0, 0, time.UTC), // not on 15 minute step
+		time.Date(2024, 8, 15, 19, 0, 0, 0, time.UTC), // after hours
+		time.Date(2024, 8, 17, 10, 0, 0, 0, time.UTC), // Saturday
+	} {
+		if c.matches(notMatching) {
+			t.Errorf("%v shouldn't match", notMatching)
+		}
+	}
+
+	sunday, err := parseCron("0 0 * * 7")
+	if err != nil {
+		t.Fatal("Error parsing cron: " + err.Error())
+	}
+	if !sunday.matches(time.Date(2024, 8, 18, 0, 0, 0, 0, time.UTC)) {
+		t.Error("7 should mean Sunday")
+	}
+
+	// day of month and weekday both restricted match either, a step counts as restriction
+	everyOtherDay, err := parseCron("0 8 */2 * 1")
+	if err != nil {
+		t.Fatal("Error parsing cron: " + err.Error())
+	}
+	for day, matches := range map[int]bool{
+		26: true,  // Monday, even day
+		27: true,  // Tuesday, odd day
+		28: false, // Wednesday, even day
+	} {
+		if everyOtherDay.matches(time.Date(2024, 8, day, 8, 0, 0, 0, time.UTC)) != matches {
+			t.Errorf("August %d should match: %v", day, matches)
+		}
+	}
+
+	for _, bad := range []string{"0 8 * *", "60 8 * * *", "0 8-25 * * *", "0 8 * * mon", "*/0 * * * *"} {
+		if _, err := parseCron(bad); err == nil {
+			t.Errorf("%q should be rejected", bad)
+		}
+	}
+}
+
+func TestDesiredState(t *testing.T) {
+	schedule, err := parseSchedule("start=0 8 * * 1-5; stop=0 19 * * 1-5; tz=Europe/Berlin")
+	if err != nil {
+		t.Fatal("Error parsing schedule: " + err.Error())
+	}
+
+	cases := []struct {
+		now      time.Time
+		expected types.InstanceStateName
+	}{
+		// 07:30 UTC is 09:30 in Berlin in summer
+		{time.Date(2024, 8, 15, 7, 30, 0, 0, time.UTC), types.InstanceStateNameRunning},
+		// 05:30 UTC is 07:30 in Berlin, still stopped since last evening
+		{time.Date(2024, 8, 15, 5, 30, 0, 0, time.UTC), types.InstanceStateNameStopped},
+		{time.Date(2024, 8, 15, 17, 0, 0, 0, time.UTC), types.InstanceStateNameStopped},
+		// stays stopped over the weekend
+		{time.Date(2024, 8, 18, 12, 0, 0, 0, time.UTC), types.InstanceStateNameStopped},
+	}
+	for _, c := range cases {
+		desired, ok := schedule.desiredState(c.now)
+		if !ok || desired != c.expected {
+			t.Errorf("at %v desired state is %s (%v), expected %s", c.now, desired, ok, c.expected)
+		}
+	}
+
+	for _, bad := range []string{"", "tz=Europe/Berlin", "start=0 8 * * *; tz=Mars/Olympus", "begin=0 8 * * *"} {
+		if _, err := parseSchedule(bad); err == nil {
+			t.Errorf("schedule %q should be rejected", bad)
+		}
+	}
+}
+
+func TestScheduleInstances(t *testing.T) {
+	instance := func(id string, state types.InstanceStateName, schedule string) types.Instance {
+		return types.Instance{
+			InstanceId: aws.String(id),
+			State:      &types.InstanceState{Name: state},
+			Tags:       []types.Tag{{Key: aws.String(scheduleTagKey), Value: aws.String(schedule)}},
+		}
+	}
+	office := "start=0 8 * * 1-5; stop=0 19 * * 1-5"
+	newMock := func() *mockEc2Client {
+		return &mockEc2Client{
+			describeInstancesOutput: &ec2.DescribeInstancesOutput{
+				Reservations: []types.Reservation{
+					{
+						Instances: []types.Instance{
+							instance("i-running", types.InstanceStateNameRunning, office),
+							instance("i-stopped", types.InstanceStateNameStopped, office),
+							instance("i-broken", types.InstanceStateNameRunning, "start=whenever"),
+						},
+					},
+				},
+			},
+		}
+	}
+
+	ctx := context.TODO()
+	evening := func() time.Time { return time.Date(2024, 8, 15, 20, 0, 0, 0, time.UTC) }
+	ec2Client := newMock()
+	scheduler := &app{ec2Client: ec2Client, now: evening}
+
+	actions, err := scheduleInstances(ctx, scheduler, true)
+	if err == nil || !strings.Contains(err.Error(), "i-broken") {
+		t.Errorf("bad schedule tag should fail the run, got %v", err)
+	}
+	if len(ec2Client.calls) != 0 {
+		t.Errorf("dry run shouldn't start or stop anything, calls are %v", ec2Client.calls)
+	}
+	if actions[0].Action != "stop" || actions[1].Action != "none" || actions[2].Err == nil {
+		t.Errorf("unexpected actions %+v", actions)
+	}
+
+	_, err = scheduleInstances(ctx, scheduler, false)
+	if err == nil {
+		t.Error("bad schedule tag should fail the run")
+	}
+	if strings.Join(ec2Client.calls, ",") != "StopInstances" {
+		t.Errorf("only running instance should be stopped in the evening, calls are %v", ec2Client.calls)
+	}
+
+	ec2Client = newMock()
+	scheduler = &app{ec2Client: ec2Client, now: func() time.Time { return time.Date(2024, 8, 16, 9, 0, 0, 0, time.UTC) }}
+	_, err = scheduleInstances(ctx, scheduler, false)
+	if err == nil {
+		t.Error("bad schedule tag should fail the run")
+	}
+	if strings.Join(ec2Client.calls, ",") != "StartInstances" {
+		t.Errorf("stopped instance should be started in the morning, calls are %v", ec2Client.calls)
+	}
+}
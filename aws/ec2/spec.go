@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+const (
+	defaultInstanceName string = "ec2-instance"
+	defaultInstanceType string = "t3.micro"
+)
+
+// launchSpec describes everything the tool launches, its hash ties created resources to the spec that produced them
+type launchSpec struct {
+	Name          string             `json:"name"`
+	InstanceType  string             `json:"instanceType"`
+	Tags          map[string]string  `json:"tags,omitempty"`
+	Image         imageSelector      `json:"image"`
+	SecurityGroup *securityGroupSpec `json:"securityGroup,omitempty"`
+	Volumes       []volumeSpec       `json:"volumes,omitempty"`
+	ElasticIp     bool               `json:"elasticIp,omitempty"`
+	// instances get no public IP unless asked for, Elastic IP is given regardless
+	PublicIp   bool `json:"publicIp,omitempty"`
+	Monitoring bool `json:"monitoring,omitempty"`
+}
+
+// imageSelector picks AMI to launch from, the newest image matching all of owner, name pattern and tags wins,
+// OS from the catalog sets owner and name pattern for the architecture instead
+type imageSelector struct {
+	Owner string            `json:"owner"`
+	Name  string            `json:"name,omitempty"`
+	Tags  map[string]string `json:"tags,omitempty"`
+	OS    string            `json:"os,omitempty"`
+	Arch  string            `json:"arch,omitempty"`
+}
+
+type securityGroupSpec struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Ingress     []ingressRule `json:"ingress,omitempty"`
+}
+
+type ingressRule struct {
+	Protocol string `json:"protocol"`
+	FromPort int32  `json:"fromPort"`
+	ToPort   int32  `json:"toPort"`
+	CidrIp   string `json:"cidrIp"`
+}
+
+type volumeSpec struct {
+	Device  string `json:"device"`
+	SizeGiB int32  `json:"sizeGiB"`
+	Type    string `json:"type"`
+}
+
+// defaultSpec launches default OS, its selector is spelled out as owner and name, so the spec hash
+// stays the same as before the catalog and already launched instances are still recognized
+func defaultSpec() launchSpec {
+	image, namePattern, _ := lookupOS(defaultOS, defaultArch)
+
+	return launchSpec{
+		Name:         defaultInstanceName,
+		InstanceType: defaultInstanceType,
+		Image: imageSelector{
+			Owner: image.Owner,
+			Name:  namePattern,
+		},
+	}
+}
+
+// loadSpec reads spec from JSON file on top of defaults, empty path means defaults only
+func loadSpec(path string) (launchSpec, error) {
+	spec := defaultSpec()
+	if path == "" {
+		return spec, nil
+	}
+
+	specFile, err := os.ReadFile(path)
+	if err != nil {
+		return spec, err
+	}
+
+	err = json.Unmarshal(specFile, &spec)
+	if err != nil {
+		return spec, err
+	}
+
+	return spec, nil
+}
+
+// selectOS applies -os and -arch to spec's image and checks OS is in the catalog
+func (s *launchSpec) selectOS(osName string, arch string) error {
+	if osName != "" {
+		s.Image = imageSelector{OS: osName}
+	}
+	if arch != "" {
+		if s.Image.OS == "" {
+			return errors.New("-arch needs OS, set -os or spec's image os")
+		}
+		s.Image.Arch = arch
+	}
+
+	if s.Image.OS == "" {
+		return nil
+	}
+
+	_, _, err := lookupOS(s.Image.OS, s.Image.Arch)
+	return err
+}
+
+// hash is short hex of SHA-256 over spec JSON, encoding/json sorts map keys, so it's stable between runs
+func (s launchSpec) hash() string {
+	specJSON, _ := json.Marshal(s)
+	sum := sha256.Sum256(specJSON)
+	return hex.EncodeToString(sum[:])[:16]
+}
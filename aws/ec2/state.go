@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	defaultStateFile string        = "ec2-state.json"
+	stateLockTimeout time.Duration = 10 * time.Second
+)
+
+type resourceType string
+
+const (
+	resourceKeyPair       resourceType = "key-pair"
+	resourceSecurityGroup resourceType = "security-group"
+	resourceInstance      resourceType = "instance"
+	resourceVolume        resourceType = "volume"
+	resourceImage         resourceType = "image"
+	resourceElasticIp     resourceType = "elastic-ip"
+)
+
+// resource is a single AWS resource tracked by the tool
+type resource struct {
+	Type      resourceType `json:"type"`
+	ID        string       `json:"id"`
+	Name      string       `json:"name,omitempty"`
+	SpecHash  string       `json:"specHash,omitempty"`
+	Imported  bool         `json:"imported,omitempty"`
+	CreatedAt time.Time    `json:"createdAt"`
+	// key pair of unfinished rotate-key, instances aren't launched with it till every host moves to it
+	Pending bool `json:"pending,omitempty"`
+}
+
+// state is local JSON file with resources created or imported by the tool,
+// it's held under lock file from openState till close, so concurrent runs don't overwrite each other
+type state struct {
+	Resources []resource `json:"resources"`
+
+	path string
+	// empty for state read without lock, it can't be saved
+	lockPath string
+}
+
+// openState takes the lock and reads state file, missing file is an empty state
+func openState(path string) (*state, error) {
+	lockPath := path + ".lock"
+	err := acquireLock(lockPath, stateLockTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := readState(path)
+	if err != nil {
+		os.Remove(lockPath)
+		return nil, err
+	}
+	st.lockPath = lockPath
+
+	return st, nil
+}
+
+// readState reads state file without the lock for commands only looking at it, so they don't block other runs,
+// save replaces the file at once, so it's never seen half-written
+func readState(path string) (*state, error) {
+	st := &state{
+		Resources: []resource{},
+		path:      path,
+	}
+
+	stateFile, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(stateFile, st)
+	if err != nil {
+		return nil, fmt.Errorf("parsing state file %s: %w", path, err)
+	}
+
+	return st, nil
+}
+
+// acquireLock creates lock file exclusively, waiting for other run to release it up to timeout
+func acquireLock(lockPath string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = lockFile.WriteString(strconv.Itoa(os.Getpid()))
+			lockFile.Close()
+			return err
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			owner, _ := os.ReadFile(lockPath)
+			return fmt.Errorf("state is locked by process %s, remove %s if that run is gone", string(owner), lockPath)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// save writes state to temp file and renames it over the old one, so a crash never leaves half-written state
+func (s *state) save() error {
+	if s.lockPath == "" {
+		return errors.New("state was read without lock, it can't be saved")
+	}
+
+	stateJSON, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	err = os.WriteFile(tmpPath, stateJSON, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, s.path)
+}
+
+// close releases the lock, state can't be saved after that
+func (s *state) close() error {
+	if s.lockPath == "" {
+		return nil
+	}
+
+	return os.Remove(s.lockPath)
+}
+
+// record adds resource to state, replacing previous record with the same type and ID
+func (s *state) record(r resource) {
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now().UTC()
+	}
+
+	s.forget(r.Type, r.ID)
+	s.Resources = append(s.Resources, r)
+}
+
+// forget drops resource from state, it's a no-op for unknown resource
+func (s *state) forget(t resourceType, id string) {
+	resources := s.Resources[:0]
+	for _, r := range s.Resources {
+		if r.Type != t || r.ID != id {
+			resources = append(resources, r)
+		}
+	}
+	s.Resources = resources
+}
+
+// find returns resources of given type, optionally narrowed to ones produced by spec hash
+func (s *state) find(t resourceType, specHash string) []resource {
+	found := []resource{}
+	for _, r := range s.Resources {
+		if r.Type == t && (specHash == "" || r.SpecHash == specHash) {
+			found = append(found, r)
+		}
+	}
+
+	return found
+}
+
+// findByName returns first resource of given type with the name
+func (s *state) findByName(t resourceType, name string) (resource, bool) {
+	for _, r := range s.Resources {
+		if r.Type == t && r.Name == name {
+			return r, true
+		}
+	}
+
+	return resource{}, false
+}
+
+// importResource starts tracking existing resource, it's verified in AWS and tied to the current spec
+func importResource(ctx context.Context, app *app, t resourceType, id string) error {
+	name, err := describeResource(ctx, app.ec2Client, t, id)
+	if err != nil {
+		return err
+	}
+
+	app.state.record(resource{
+		Type:     t,
+		ID:       id,
+		Name:     name,
+		SpecHash: app.spec.hash(),
+		Imported: true,
+	})
+
+	return app.state.save()
+}
+
+func importCommand(flags *flag.FlagSet) func(ctx context.Context, app *app) error {
+	var t, id string
+	flags.StringVar(&t, "type", string(resourceInstance), "Resource type to import: key-pair, security-group, instance, volume or image")
+	flags.StringVar(&id, "id", "", "ID of existing resource, key pair is imported by name")
+
+	return func(ctx context.Context, app *app) error {
+		if id == "" {
+			return errors.New("-id is required")
+		}
+
+		err := importResource(ctx, app, resourceType(t), id)
+		if err != nil {
+			return err
+		}
+
+		slog.Info("Imported " + t + " " + id)
+		return nil
+	}
+}
+
+func stateCommand(ctx context.Context, app *app) error {
+	return printState(os.Stdout, app.state)
+}
+
+func printState(w io.Writer, st *state) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tID\tNAME\tSPEC\tCREATED")
+	for _, r := range st.Resources {
+		created := r.CreatedAt.Format(time.RFC3339)
+		if r.Imported {
+			created += " (imported)"
+		}
+		if r.Pending {
+			created += " (pending)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Type, r.ID, r.Name, r.SpecHash, created)
+	}
+
+	return tw.Flush()
+}
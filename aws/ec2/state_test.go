@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestStateSaveAndReopen(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	st, err := openState(statePath)
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+
+	st.record(resource{Type: resourceInstance, ID: "i-01", SpecHash: "abc"})
+	st.record(resource{Type: resourceKeyPair, ID: "key-01", Name: keyPairName, SpecHash: "abc"})
+	st.record(resource{Type: resourceInstance, ID: "i-02", SpecHash: "def"})
+	// recording the same resource again replaces it
+	st.record(resource{Type: resourceInstance, ID: "i-01", SpecHash: "abc", Name: "renamed"})
+
+	err = st.save()
+	if err != nil {
+		t.Fatal("Error saving state: " + err.Error())
+	}
+	st.close()
+
+	st, err = openState(statePath)
+	if err != nil {
+		t.Fatal("Error reopening state: " + err.Error())
+	}
+	defer st.close()
+
+	if len(st.Resources) != 3 {
+		t.Errorf("state should have 3 resources, got %d", len(st.Resources))
+	}
+
+	instances := st.find(resourceInstance, "abc")
+	if len(instances) != 1 || instances[0].Name != "renamed" {
+		t.Errorf("expected single renamed instance for spec abc, got %v", instances)
+	}
+
+	if len(st.find(resourceInstance, "")) != 2 {
+		t.Error("find without spec hash should return instances of all specs")
+	}
+
+	if _, found := st.findByName(resourceKeyPair, keyPairName); !found {
+		t.Error("key pair should be found by name")
+	}
+
+	st.forget(resourceInstance, "i-02")
+	if len(st.find(resourceInstance, "")) != 1 {
+		t.Error("forgotten instance is still in state")
+	}
+}
+
+func TestStateLock(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	st, err := openState(statePath)
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+
+	err = acquireLock(statePath+".lock", 200*time.Millisecond)
+	if err == nil {
+		t.Error("second run shouldn't get the lock while state is open")
+	}
+
+	st.close()
+
+	err = acquireLock(statePath+".lock", 200*time.Millisecond)
+	if err != nil {
+		t.Error("lock should be free after close: " + err.Error())
+	}
+}
+
+func TestReadStateWithoutLock(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	st, err := openState(statePath)
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+	st.record(resource{Type: resourceInstance, ID: "i-01"})
+	err = st.save()
+	if err != nil {
+		t.Fatal("Error saving state: " + err.Error())
+	}
+
+	// console -follow runs meanwhile
+	readOnly, err := readState(statePath)
+	if err != nil {
+		t.Fatal("state held by other run should be readable: " + err.Error())
+	}
+	if len(readOnly.find(resourceInstance, "")) != 1 {
+		t.Errorf("expected instance read from state, got %v", readOnly.Resources)
+	}
+	if readOnly.save() == nil {
+		t.Error("state read without lock shouldn't be saved")
+	}
+	readOnly.close()
+
+	if _, err := os.Stat(statePath + ".lock"); err != nil {
+		t.Error("closing read-only state shouldn't release other run's lock: " + err.Error())
+	}
+}
+
+func TestImportResource(t *testing.T) {
+	var mockInstanceId string = "i-0f3f71c5c31adaae2"
+
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	ctx := context.TODO()
+	app := &app{
+		ec2Client: &mockEc2Client{
+			describeInstancesOutput: &ec2.DescribeInstancesOutput{
+				Reservations: []types.Reservation{
+					{
+						Instances: []types.Instance{
+							{
+								InstanceId: aws.String(mockInstanceId),
+								Tags:       []types.Tag{{Key: aws.String("Name"), Value: aws.String("bastion")}},
+							},
+						},
+					},
+				},
+			},
+		},
+		spec:  defaultSpec(),
+		state: st,
+	}
+
+	err = importResource(ctx, app, resourceInstance, mockInstanceId)
+	if err != nil {
+		t.Error("Error importing instance: " + err.Error())
+	}
+
+	imported := st.find(resourceInstance, defaultSpec().hash())
+	if len(imported) != 1 || imported[0].Name != "bastion" || !imported[0].Imported {
+		t.Errorf("expected imported bastion instance tied to current spec, got %v", imported)
+	}
+
+	app.ec2Client = &mockEc2Client{describeInstancesOutput: &ec2.DescribeInstancesOutput{}}
+	err = importResource(ctx, app, resourceInstance, "i-missing")
+	if err == nil {
+		t.Error("import of missing instance should fail")
+	}
+}
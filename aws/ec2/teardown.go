@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// teardownOrder is order resources are destroyed in, dependants go before what they depend on,
+// baked images aren't torn down, they're managed by image -keep retention
+var teardownOrder = []resourceType{
+	resourceElasticIp,
+	resourceInstance,
+	resourceVolume,
+	resourceSecurityGroup,
+	resourceKeyPair,
+}
+
+func teardownCommand(flags *flag.FlagSet) func(ctx context.Context, app *app) error {
+	var dryRun bool
+	flags.BoolVar(&dryRun, "dry-run", false, "Bool, only list resources that would be destroyed")
+
+	return func(ctx context.Context, app *app) error {
+		return teardown(ctx, app, dryRun)
+	}
+}
+
+// teardown destroys every resource tracked in state, resources already gone are just forgotten,
+// so it's safe to run again after a partial failure or interruption
+func teardown(ctx context.Context, app *app, dryRun bool) error {
+	destroyed, notDestroyed := []resource{}, []resource{}
+	errs := []error{}
+	for _, t := range teardownOrder {
+		for _, r := range app.state.find(t, "") {
+			if dryRun {
+				fmt.Printf("would destroy %s %s (%s)\n", r.Type, r.ID, r.Name)
+				continue
+			}
+
+			// once interrupted, the rest isn't even tried
+			if ctx.Err() != nil {
+				notDestroyed = append(notDestroyed, r)
+				continue
+			}
+
+			err := destroyResource(ctx, app.ec2Client, r)
+			if err != nil {
+				notDestroyed = append(notDestroyed, r)
+				errs = append(errs, fmt.Errorf("destroying %s %s: %w", r.Type, r.ID, err))
+				continue
+			}
+
+			slog.Info("Destroyed " + string(r.Type) + " " + r.ID)
+			destroyed = append(destroyed, r)
+			app.state.forget(r.Type, r.ID)
+			err = app.state.save()
+			if err != nil {
+				return fmt.Errorf("saving state: %w", err)
+			}
+		}
+	}
+
+	if len(notDestroyed) > 0 {
+		printTeardownReport(os.Stdout, destroyed, notDestroyed)
+	}
+	if ctx.Err() != nil {
+		errs = append(errs, ctx.Err())
+	}
+
+	return errors.Join(errs...)
+}
+
+func printTeardownReport(w io.Writer, destroyed []resource, notDestroyed []resource) {
+	fmt.Fprintln(w, "Teardown didn't finish")
+	if len(destroyed) > 0 {
+		fmt.Fprintln(w, "Destroyed:")
+		for _, r := range destroyed {
+			fmt.Fprintf(w, "  %s %s (%s)\n", r.Type, r.ID, r.Name)
+		}
+	}
+
+	fmt.Fprintln(w, "Left in state, run teardown again:")
+	for _, r := range notDestroyed {
+		fmt.Fprintf(w, "  %s %s (%s)\n", r.Type, r.ID, r.Name)
+	}
+}
+
+// destroyResource deletes single resource and waits where the next one depends on it being gone
+func destroyResource(ctx context.Context, ec2Client ec2Client, r resource) error {
+	var err error
+	switch r.Type {
+	case resourceElasticIp:
+		return releaseElasticIp(ctx, ec2Client, r.ID)
+
+	case resourceInstance:
+		_, err = ec2Client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{InstanceIds: []string{r.ID}})
+		if err == nil {
+			// volumes and security group stay in use till instance is fully gone
+			err = ec2.NewInstanceTerminatedWaiter(ec2Client).Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{r.ID}}, waitTimeout)
+		}
+
+	case resourceVolume:
+		err = ec2.NewVolumeAvailableWaiter(ec2Client).Wait(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{r.ID}}, waitTimeout)
+		if err == nil {
+			_, err = ec2Client.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: aws.String(r.ID)})
+		}
+
+	case resourceSecurityGroup:
+		_, err = ec2Client.DeleteSecurityGroup(ctx, &ec2.DeleteSecurityGroupInput{GroupId: aws.String(r.ID)})
+
+	case resourceKeyPair:
+		// created key pairs are recorded by ID, imported ones by name
+		input := &ec2.DeleteKeyPairInput{KeyName: aws.String(r.ID)}
+		if strings.HasPrefix(r.ID, "key-") {
+			input = &ec2.DeleteKeyPairInput{KeyPairId: aws.String(r.ID)}
+		}
+		_, err = ec2Client.DeleteKeyPair(ctx, input)
+
+	default:
+		return fmt.Errorf("can't destroy %s", r.Type)
+	}
+
+	if isNotFound(err) {
+		return nil
+	}
+
+	return err
+}
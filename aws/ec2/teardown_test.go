@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTeardown(t *testing.T) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	ctx := context.TODO()
+	ec2Client := newLaunchMock()
+	app := &app{ec2Client: ec2Client, quotasClient: &mockQuotasClient{quota: 32}, spec: testSpec(), state: st}
+
+	err = launch(ctx, app, false)
+	if err != nil {
+		t.Fatal("Error launching: " + err.Error())
+	}
+	st.record(resource{Type: resourceImage, ID: "ami-0baked"})
+	ec2Client.calls = nil
+
+	err = teardown(ctx, app, false)
+	if err != nil {
+		t.Fatal("Error tearing down: " + err.Error())
+	}
+
+	expectedCalls := "DisassociateAddress,ReleaseAddress,TerminateInstances,DeleteVolume,DeleteSecurityGroup,DeleteKeyPair"
+	if strings.Join(ec2Client.calls, ",") != expectedCalls {
+		t.Errorf("calls are %v, expected %s", ec2Client.calls, expectedCalls)
+	}
+
+	if len(st.Resources) != 1 || st.Resources[0].Type != resourceImage {
+		t.Errorf("only baked image should stay in state, state is %v", st.Resources)
+	}
+}
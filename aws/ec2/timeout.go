@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aws/smithy-go/middleware"
+)
+
+// cleanupTimeout bounds work that has to finish even after the run was interrupted, like rollback
+const cleanupTimeout time.Duration = 15 * time.Minute
+
+// rootContext is cancelled on SIGINT/SIGTERM or when timeout passes, 0 means no timeout,
+// once it's cancelled signals are let through again, so a second Ctrl-C kills the tool
+func rootContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
+
+	if timeout <= 0 {
+		return ctx, stop
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// cleanupContext outlives cancellation of ctx, for compensating work after interruption
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+}
+
+// withCallTimeout bounds every single API call, retries included, overall deadline comes from the root context
+func withCallTimeout(timeout time.Duration) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("CallTimeout", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			return next.HandleInitialize(ctx, in)
+		}), middleware.Before)
+	}
+}
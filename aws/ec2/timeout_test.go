@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// blockingHTTPClient never answers, request only ends when its context is done
+type blockingHTTPClient struct{}
+
+func (c blockingHTTPClient) Do(request *http.Request) (*http.Response, error) {
+	<-request.Context().Done()
+	return nil, request.Context().Err()
+}
+
+func TestWithCallTimeout(t *testing.T) {
+	ec2Client := ec2.New(ec2.Options{
+		Region:           "eu-central-1",
+		Credentials:      aws.AnonymousCredentials{},
+		HTTPClient:       blockingHTTPClient{},
+		RetryMaxAttempts: 1,
+		APIOptions:       []func(*middleware.Stack) error{withCallTimeout(50 * time.Millisecond)},
+	})
+
+	started := time.Now()
+	_, err := lookUpKeyPair(context.Background(), ec2Client, keyPairName)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("hung call should end with deadline exceeded, got %v", err)
+	}
+
+	if time.Since(started) > 5*time.Second {
+		t.Errorf("call took %v, call timeout didn't apply", time.Since(started))
+	}
+}
+
+func TestRootContextSignal(t *testing.T) {
+	ctx, cancel := rootContext(0)
+	defer cancel()
+
+	err := syscall.Kill(os.Getpid(), syscall.SIGINT)
+	if err != nil {
+		t.Fatal("Error sending SIGINT: " + err.Error())
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("root context wasn't cancelled by SIGINT")
+	}
+}
+
+func TestLaunchCancelled(t *testing.T) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	ec2Client := newLaunchMock()
+	ec2Client.blockOn = "CreateVolume"
+	app := &app{ec2Client: ec2Client, quotasClient: &mockQuotasClient{quota: 32}, spec: testSpec(), state: st}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err = launch(ctx, app, false)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("launch should fail with deadline exceeded, got %v", err)
+	}
+
+	// rollback still runs after the deadline passed
+	expectedCalls := "CreateKeyPair,CreateSecurityGroup,AuthorizeSecurityGroupIngress,RunInstances,CreateVolume,TerminateInstances,DeleteSecurityGroup,DeleteKeyPair"
+	if strings.Join(ec2Client.calls, ",") != expectedCalls {
+		t.Errorf("calls are %v, expected %s", ec2Client.calls, expectedCalls)
+	}
+}
+
+func TestTeardownCancelled(t *testing.T) {
+	st, err := openState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal("Error opening state: " + err.Error())
+	}
+	defer st.close()
+
+	ec2Client := newLaunchMock()
+	ec2Client.blockOn = "TerminateInstances"
+	app := &app{ec2Client: ec2Client, quotasClient: &mockQuotasClient{quota: 32}, spec: testSpec(), state: st}
+	st.record(resource{Type: resourceInstance, ID: "i-0f3f71c5c31adaae2"})
+	st.record(resource{Type: resourceKeyPair, ID: "key-0a1b2c3d"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err = teardown(ctx, app, false)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("teardown should fail with deadline exceeded, got %v", err)
+	}
+
+	if strings.Join(ec2Client.calls, ",") != "TerminateInstances" {
+		t.Errorf("nothing should be tried after interruption, calls are %v", ec2Client.calls)
+	}
+
+	if len(st.Resources) != 2 {
+		t.Errorf("resources not destroyed should stay in state, state is %v", st.Resources)
+	}
+}
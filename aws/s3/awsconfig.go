@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// awsOptions pick account, region and endpoint, empty ones are left to SDK defaults,
+// so AWS_PROFILE, AWS_REGION and AWS_ENDPOINT_URL keep working
+type awsOptions struct {
+	profile     string
+	region      string
+	endpointURL string
+	// emulators usually serve buckets on paths, not on subdomains
+	pathStyle bool
+	// role to assume on top of profile credentials
+	roleArn         string
+	roleSessionName string
+	externalId      string
+	mfaSerial       string
+}
+
+type stsClient interface {
+	GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+func (o *awsOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.profile, "profile", "", "String, shared config profile, AWS_PROFILE env")
+	flags.StringVar(&o.region, "region", "", "String, AWS region, AWS_REGION env")
+	flags.StringVar(&o.endpointURL, "endpoint-url", "", "String, endpoint URL override, e.g. of local emulator, AWS_ENDPOINT_URL env")
+	flags.BoolVar(&o.pathStyle, "path-style", os.Getenv("AWS_S3_PATH_STYLE") == "true", "Bool, address buckets as path instead of subdomain, AWS_S3_PATH_STYLE=true env")
+	flags.StringVar(&o.roleArn, "role-arn", os.Getenv("AWS_ASSUME_ROLE_ARN"), "String, ARN of role to assume, AWS_ASSUME_ROLE_ARN env")
+	flags.StringVar(&o.roleSessionName, "role-session-name", roleSessionName(), "String, session name of assumed role, AWS_ROLE_SESSION_NAME env")
+	flags.StringVar(&o.externalId, "external-id", os.Getenv("AWS_EXTERNAL_ID"), "String, external ID required by assumed role, AWS_EXTERNAL_ID env")
+	flags.StringVar(&o.mfaSerial, "mfa-serial", os.Getenv("AWS_MFA_SERIAL"), "String, MFA device serial or ARN, token code is asked on stdin, AWS_MFA_SERIAL env")
+}
+
+func roleSessionName() string {
+	if name := os.Getenv("AWS_ROLE_SESSION_NAME"); name != "" {
+		return name
+	}
+
+	return "golang-s3"
+}
+
+// loadAwsConfig builds SDK config from options, assumed role credentials are cached and refreshed by SDK,
+// path style is S3 client option, see s3Options
+func loadAwsConfig(ctx context.Context, o awsOptions, callTimeout time.Duration) (aws.Config, error) {
+	loadOptions := []func(*config.LoadOptions) error{}
+	if o.profile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(o.profile))
+	}
+	if o.region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(o.region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return cfg, err
+	}
+	if o.endpointURL != "" {
+		cfg.BaseEndpoint = aws.String(o.endpointURL)
+	}
+	// every client built from config gets it, STS one assuming role included
+	if callTimeout > 0 {
+		cfg.APIOptions = append(cfg.APIOptions, withCallTimeout(callTimeout))
+	}
+
+	if o.roleArn != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), o.roleArn, func(options *stscreds.AssumeRoleOptions) {
+			options.RoleSessionName = o.roleSessionName
+			if o.externalId != "" {
+				options.ExternalID = aws.String(o.externalId)
+			}
+			if o.mfaSerial != "" {
+				options.SerialNumber = aws.String(o.mfaSerial)
+				options.TokenProvider = stscreds.StdinTokenProvider
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	return cfg, nil
+}
+
+// whoami logs account and ARN requests are made as, so it's clear where objects will land
+func whoami(ctx context.Context, stsClient stsClient) (*sts.GetCallerIdentityOutput, error) {
+	identity, err := stsClient.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, fmt.Errorf("getting caller identity: %w", err)
+	}
+
+	slog.Info("Running as account " + aws.ToString(identity.Account) + ", " + aws.ToString(identity.Arn))
+	return identity, nil
+}
+
+// s3Options applies S3 specific options on top of config
+func (o awsOptions) s3Options(s3Options *s3.Options) {
+	s3Options.UsePathStyle = o.pathStyle
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+type mockStsClient struct {
+	calls int
+}
+
+func (m *mockStsClient) GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	m.calls++
+	return &sts.GetCallerIdentityOutput{
+		Account: aws.String("123456789012"),
+		Arn:     aws.String("arn:aws:sts::123456789012:assumed-role/deployer/golang-s3"),
+	}, nil
+}
+
+func TestLoadAwsConfig(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	cfg, err := loadAwsConfig(context.TODO(), awsOptions{region: "eu-central-1", endpointURL: "http://localhost:4566"}, 0)
+	if err != nil {
+		t.Fatal("Error loading AWS config: " + err.Error())
+	}
+	if cfg.Region != "eu-central-1" || aws.ToString(cfg.BaseEndpoint) != "http://localhost:4566" {
+		t.Errorf("region is %s and endpoint is %s", cfg.Region, aws.ToString(cfg.BaseEndpoint))
+	}
+
+	s3Options := s3.Options{}
+	awsOptions{pathStyle: true}.s3Options(&s3Options)
+	if !s3Options.UsePathStyle {
+		t.Error("path style should be set on S3 options")
+	}
+
+	cfg, err = loadAwsConfig(context.TODO(), awsOptions{region: "eu-central-1", roleArn: "arn:aws:iam::123456789012:role/deployer"}, 0)
+	if err != nil {
+		t.Fatal("Error loading AWS config: " + err.Error())
+	}
+	if _, ok := cfg.Credentials.(*aws.CredentialsCache); !ok {
+		t.Errorf("assumed role credentials should be cached, got %T", cfg.Credentials)
+	}
+}
+
+func TestLoadAwsConfigCallTimeout(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	// STS that never answers, body is read, so client hanging up is noticed
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	cfg, err := loadAwsConfig(context.TODO(), awsOptions{
+		region:      "eu-central-1",
+		endpointURL: server.URL,
+		roleArn:     "arn:aws:iam::123456789012:role/deployer",
+	}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal("Error loading AWS config: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	started := time.Now()
+	_, err = cfg.Credentials.Retrieve(ctx)
+	if err == nil || time.Since(started) > 5*time.Second {
+		t.Errorf("hung AssumeRole should end by call timeout, got %v after %v", err, time.Since(started))
+	}
+}
+
+func TestWhoami(t *testing.T) {
+	stsClient := &mockStsClient{}
+	identity, err := whoami(context.TODO(), stsClient)
+	if err != nil {
+		t.Fatal("Error getting identity: " + err.Error())
+	}
+
+	if aws.ToString(identity.Account) != "123456789012" || stsClient.calls != 1 {
+		t.Errorf("account is %s after %d calls", aws.ToString(identity.Account), stsClient.calls)
+	}
+}
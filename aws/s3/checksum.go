@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var (
+	errChecksumMismatch = errors.New("checksum mismatch")
+	errNoChecksum       = errors.New("object has no checksum")
+)
+
+// checksumAlgorithm maps -checksum value to SDK algorithm, none sends no checksum
+func checksumAlgorithm(name string) (types.ChecksumAlgorithm, error) {
+	switch name {
+	case "sha256":
+		return types.ChecksumAlgorithmSha256, nil
+	case "crc32c":
+		return types.ChecksumAlgorithmCrc32c, nil
+	case "none":
+		return "", nil
+	}
+
+	return "", errors.New("unknown checksum " + name + ", expected sha256, crc32c or none")
+}
+
+// withChecksum asks SDK to compute checksum of upload, S3 rejects the upload if content doesn't match it,
+// multipart uploads get checksum of every part
+func withChecksum(algorithm types.ChecksumAlgorithm) func(*s3.PutObjectInput) {
+	return func(input *s3.PutObjectInput) {
+		input.ChecksumAlgorithm = algorithm
+	}
+}
+
+func withChecksumMode(input *s3.HeadObjectInput) {
+	input.ChecksumMode = types.ChecksumModeEnabled
+}
+
+// remoteChecksum picks the checksum object was uploaded with, empty algorithm if there's none
+func remoteChecksum(headOutput *s3.HeadObjectOutput) (types.ChecksumAlgorithm, string) {
+	switch {
+	case headOutput.ChecksumSHA256 != nil:
+		return types.ChecksumAlgorithmSha256, *headOutput.ChecksumSHA256
+	case headOutput.ChecksumCRC32C != nil:
+		return types.ChecksumAlgorithmCrc32c, *headOutput.ChecksumCRC32C
+	case headOutput.ChecksumSHA1 != nil:
+		return types.ChecksumAlgorithmSha1, *headOutput.ChecksumSHA1
+	case headOutput.ChecksumCRC32 != nil:
+		return types.ChecksumAlgorithmCrc32, *headOutput.ChecksumCRC32
+	}
+
+	return "", ""
+}
+
+func newChecksumHash(algorithm types.ChecksumAlgorithm) func() hash.Hash {
+	switch algorithm {
+	case types.ChecksumAlgorithmSha256:
+		return sha256.New
+	case types.ChecksumAlgorithmCrc32c:
+		return func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }
+	case types.ChecksumAlgorithmSha1:
+		return sha1.New
+	case types.ChecksumAlgorithmCrc32:
+		return func() hash.Hash { return crc32.NewIEEE() }
+	}
+
+	return nil
+}
+
+// verifyChecksum compares checksum of local file at path with the one S3 keeps for key, without downloading it
+func verifyChecksum(ctx context.Context, s3Client s3Client, bucket string, key string, path string, optFns ...func(*s3.HeadObjectInput)) error {
+	headOutput, err := headObject(ctx, s3Client, bucket, key, append(optFns, withChecksumMode)...)
+	if err != nil {
+		return err
+	}
+
+	return matchesChecksum(ctx, s3Client, bucket, key, path, headOutput, optFns...)
+}
+
+// matchesChecksum is verifyChecksum with object already headed with checksum mode
+func matchesChecksum(ctx context.Context, s3Client s3Client, bucket string, key string, path string, headOutput *s3.HeadObjectOutput, optFns ...func(*s3.HeadObjectInput)) error {
+	algorithm, checksum := remoteChecksum(headOutput)
+	if algorithm == "" {
+		return errNoChecksum
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() != aws.ToInt64(headOutput.ContentLength) {
+		return fmt.Errorf("%w: size is %d, object has %d", errChecksumMismatch, info.Size(), aws.ToInt64(headOutput.ContentLength))
+	}
+
+	partSize := int64(0)
+	if strings.Contains(checksum, "-") {
+		partSize, err = firstPartSize(ctx, s3Client, bucket, key, optFns...)
+		if err != nil {
+			return err
+		}
+	}
+	matches, err := matchesDigest(path, info.Size(), checksum, partSize, newChecksumHash(algorithm), base64.StdEncoding.EncodeToString)
+	if err != nil {
+		return err
+	}
+	if !matches {
+		return fmt.Errorf("%w: local file doesn't match %s %s", errChecksumMismatch, algorithm, checksum)
+	}
+
+	return nil
+}
+
+// firstPartSize is size of part 1 of multipart object, every part but the last one has it,
+// for object uploaded at once it's the object size
+func firstPartSize(ctx context.Context, s3Client s3Client, bucket string, key string, optFns ...func(*s3.HeadObjectInput)) (int64, error) {
+	headOutput, err := headObject(ctx, s3Client, bucket, key, append(optFns, func(input *s3.HeadObjectInput) {
+		input.PartNumber = aws.Int32(1)
+	})...)
+	if err != nil {
+		return 0, fmt.Errorf("reading part size of %s: %w", key, err)
+	}
+
+	return aws.ToInt64(headOutput.ContentLength), nil
+}
+
+// matchesDigest tells if file content produces remote digest, digest of multipart upload is digest of part digests
+// followed by "-<parts>", it can be rebuilt only with partSize the object was uploaded with, errNoChecksum if that
+// isn't known
+func matchesDigest(path string, size int64, remote string, partSize int64, newHash func() hash.Hash, encode func([]byte) string) (bool, error) {
+	_, partsText, multipart := strings.Cut(remote, "-")
+	if !multipart {
+		digest, _, err := compositeDigest(path, 0, newHash)
+		return encode(digest) == remote, err
+	}
+
+	parts, err := strconv.ParseInt(partsText, 10, 64)
+	if err != nil || parts < 1 {
+		return false, nil
+	}
+	if partSize <= 0 || (size+partSize-1)/partSize != parts {
+		return false, fmt.Errorf("%w: part size of %d part upload isn't known", errNoChecksum, parts)
+	}
+
+	digest, _, err := compositeDigest(path, partSize, newHash)
+	if err != nil {
+		return false, err
+	}
+
+	return encode(digest)+"-"+partsText == remote, nil
+}
+
+// compositeDigest hashes the whole file if partSize is 0, otherwise hashes concatenated digests of partSize parts
+func compositeDigest(path string, partSize int64, newHash func() hash.Hash) ([]byte, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	if partSize == 0 {
+		whole := newHash()
+		_, err = io.Copy(whole, file)
+		return whole.Sum(nil), 0, err
+	}
+
+	partDigests := newHash()
+	parts := 0
+	for {
+		part := newHash()
+		n, err := io.CopyN(part, file, partSize)
+		if n > 0 {
+			partDigests.Write(part.Sum(nil))
+			parts++
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return partDigests.Sum(nil), parts, nil
+}
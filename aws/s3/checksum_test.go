@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestChecksumAlgorithm(t *testing.T) {
+	for name, expected := range map[string]types.ChecksumAlgorithm{"sha256": types.ChecksumAlgorithmSha256, "crc32c": types.ChecksumAlgorithmCrc32c, "none": ""} {
+		algorithm, err := checksumAlgorithm(name)
+		if err != nil || algorithm != expected {
+			t.Errorf("%s is %q (%v), expected %q", name, algorithm, err, expected)
+		}
+	}
+
+	if _, err := checksumAlgorithm("md5"); err == nil {
+		t.Error("md5 should be refused")
+	}
+}
+
+// uploadWithChecksum uploads files of dir under reports prefix
+func uploadWithChecksum(t *testing.T, bucket *fakeBucket, dir string, algorithm types.ChecksumAlgorithm) []localFile {
+	files, err := collectFiles(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range uploadAll(context.TODO(), bucket, defaultBucketName, "reports", files, 2, uploadHeaders{}, withChecksum(algorithm)) {
+		if result.err != nil {
+			t.Fatal("Error uploading: " + result.err.Error())
+		}
+	}
+
+	return files
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, "small.txt")
+	big := bytes.Repeat([]byte("0123456789abcdef"), 400*1024)
+	err := os.WriteFile(filepath.Join(dir, "big.bin"), big, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, algorithm := range []types.ChecksumAlgorithm{types.ChecksumAlgorithmSha256, types.ChecksumAlgorithmCrc32c} {
+		bucket := newFakeBucket()
+		uploadWithChecksum(t, bucket, dir, algorithm)
+		if !strings.HasSuffix(bucket.objects["reports/big.bin"].checksum, "-2") {
+			t.Fatalf("big.bin should have composite checksum of 2 parts, got %s", bucket.objects["reports/big.bin"].checksum)
+		}
+
+		for _, rel := range []string{"small.txt", "big.bin"} {
+			err := verifyChecksum(context.TODO(), bucket, defaultBucketName, "reports/"+rel, filepath.Join(dir, rel))
+			if err != nil {
+				t.Errorf("%s %s: %v", algorithm, rel, err)
+			}
+		}
+	}
+}
+
+// object uploaded with part size no uploader defaults to, like -resumable -part-size 6 makes
+func TestVerifyChecksumPartSize(t *testing.T) {
+	dir := t.TempDir()
+	big := bytes.Repeat([]byte("0123456789abcdef"), 20*64*1024)
+	err := os.WriteFile(filepath.Join(dir, "big.bin"), big, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := newFakeBucket()
+	bucket.partSize = 6 * 1024 * 1024
+	uploadWithChecksum(t, bucket, dir, types.ChecksumAlgorithmSha256)
+	if !strings.HasSuffix(bucket.objects["reports/big.bin"].checksum, "-4") {
+		t.Fatalf("big.bin should have composite checksum of 4 parts, got %s", bucket.objects["reports/big.bin"].checksum)
+	}
+
+	err = verifyChecksum(context.TODO(), bucket, defaultBucketName, "reports/big.bin", filepath.Join(dir, "big.bin"))
+	if err != nil {
+		t.Errorf("big.bin should match its checksum: %v", err)
+	}
+	dest := filepath.Join(t.TempDir(), "big.bin")
+	err = downloadTo(context.TODO(), bucket, bucket, defaultBucketName, "reports/big.bin", dest, time.Time{}, encryptionOptions{})
+	if err != nil {
+		t.Errorf("download of big.bin should be verified: %v", err)
+	}
+}
+
+func TestVerifyChecksumFailures(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, "a.txt")
+	bucket := newFakeBucket()
+	uploadWithChecksum(t, bucket, dir, types.ChecksumAlgorithmSha256)
+	bucket.put("reports/plain.txt", []byte("a.txt"), nil)
+
+	// same size, other content
+	err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("b.txt"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyChecksum(context.TODO(), bucket, defaultBucketName, "reports/a.txt", filepath.Join(dir, "a.txt"))
+	if !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("changed file: err is %v, expected mismatch", err)
+	}
+
+	err = verifyChecksum(context.TODO(), bucket, defaultBucketName, "reports/plain.txt", filepath.Join(dir, "a.txt"))
+	if !errors.Is(err, errNoChecksum) {
+		t.Errorf("object without checksum: err is %v", err)
+	}
+
+	var notFound *objectNotFoundError
+	err = verifyChecksum(context.TODO(), bucket, defaultBucketName, "reports/missing.txt", filepath.Join(dir, "a.txt"))
+	if !errors.As(err, &notFound) {
+		t.Errorf("missing object: err is %v", err)
+	}
+}
+
+func TestDownloadChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, "a.txt")
+	bucket := newFakeBucket()
+	uploadWithChecksum(t, bucket, dir, types.ChecksumAlgorithmSha256)
+
+	// content is damaged after upload, checksum stays
+	object := bucket.objects["reports/a.txt"]
+	object.body = []byte("x.txt")
+	bucket.objects["reports/a.txt"] = object
+
+	dest := t.TempDir()
+	err := downloadTo(context.TODO(), bucket, bucket, defaultBucketName, "reports/a.txt", filepath.Join(dest, "a.txt"), time.Time{}, encryptionOptions{})
+	if !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("err is %v, expected mismatch", err)
+	}
+	entries, _ := os.ReadDir(dest)
+	if len(entries) != 0 {
+		t.Errorf("nothing should be left of failed download, found %v", entries)
+	}
+}
+
+func TestVerifyFiles(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, "ok.txt", "changed.txt", "nested/plain.txt", "missing.txt")
+	bucket := newFakeBucket()
+	files := uploadWithChecksum(t, bucket, dir, types.ChecksumAlgorithmCrc32c)
+	bucket.put("reports/nested/plain.txt", []byte("nested/plain.txt"), nil)
+	delete(bucket.objects, "reports/missing.txt")
+	err := os.WriteFile(filepath.Join(dir, "changed.txt"), []byte("CHANGED.txt"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := verifyFiles(context.TODO(), bucket, defaultBucketName, "reports", files, encryptionOptions{}, 2)
+	statuses := map[string]string{}
+	for _, result := range results {
+		statuses[result.rel] = result.status()
+	}
+	expected := map[string]string{"ok.txt": "ok", "changed.txt": "mismatch", "nested/plain.txt": "no checksum", "missing.txt": "missing"}
+	for rel, status := range expected {
+		if statuses[rel] != status {
+			t.Errorf("%s is %q, expected %q", rel, statuses[rel], status)
+		}
+	}
+
+	var out bytes.Buffer
+	err = printVerifyResults(&out, results)
+	if err != nil || !strings.HasPrefix(out.String(), "FILE") || !strings.HasSuffix(out.String(), "Verified 1 of 4 files\n") {
+		t.Errorf("unexpected report (%v):\n%s", err, out.String())
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	sseS3       string = "s3"
+	sseKMS      string = "kms"
+	sseCustomer string = "c"
+)
+
+// encryptionOptions is server-side encryption uploads ask for, empty mode leaves it to bucket default
+type encryptionOptions struct {
+	mode      string
+	kmsKeyId  string
+	bucketKey bool
+	// file with 256-bit customer key, raw or base64
+	customerKeyPath string
+	customerKey     []byte
+}
+
+func (o *encryptionOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.mode, "sse", os.Getenv("S3_SSE"), "String, server-side encryption of uploads, s3 (SSE-S3), kms (SSE-KMS) or c (SSE-C), S3_SSE env")
+	flags.StringVar(&o.kmsKeyId, "sse-kms-key-id", os.Getenv("S3_SSE_KMS_KEY_ID"), "String, KMS key ID, ARN or alias for -sse kms, AWS managed key if empty, S3_SSE_KMS_KEY_ID env")
+	flags.BoolVar(&o.bucketKey, "sse-bucket-key", os.Getenv("S3_SSE_BUCKET_KEY") == "true", "Bool, use S3 Bucket Key with -sse kms, S3_SSE_BUCKET_KEY=true env")
+	flags.StringVar(&o.customerKeyPath, "sse-c-key-file", os.Getenv("S3_SSE_C_KEY_FILE"), "String, file with 256-bit key for -sse c, needed to download such objects too, S3_SSE_C_KEY_FILE env")
+}
+
+// load checks options fit together and reads customer key, the key is also loaded without -sse c,
+// as downloads of SSE-C objects need it
+func (o *encryptionOptions) load() error {
+	switch o.mode {
+	case "", sseS3, sseKMS, sseCustomer:
+	default:
+		return errors.New("unknown -sse " + o.mode + ", expected s3, kms or c")
+	}
+	if o.mode != sseKMS && (o.kmsKeyId != "" || o.bucketKey) {
+		return errors.New("-sse-kms-key-id and -sse-bucket-key need -sse kms")
+	}
+	if o.mode == sseCustomer && o.customerKeyPath == "" {
+		return errors.New("-sse c needs -sse-c-key-file")
+	}
+	if o.customerKeyPath == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(o.customerKeyPath)
+	if err != nil {
+		return err
+	}
+	o.customerKey = content
+	if len(content) != 32 {
+		o.customerKey, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil || len(o.customerKey) != 32 {
+			return errors.New("customer key in " + o.customerKeyPath + " should be 32 bytes, raw or base64")
+		}
+	}
+
+	return nil
+}
+
+// customerKeyHeaders are base64 key and its MD5 S3 expects in SSE-C requests
+func (o encryptionOptions) customerKeyHeaders() (*string, *string, *string) {
+	if o.customerKey == nil {
+		return nil, nil, nil
+	}
+	sum := md5.Sum(o.customerKey)
+
+	return aws.String(string(types.ServerSideEncryptionAes256)),
+		aws.String(base64.StdEncoding.EncodeToString(o.customerKey)),
+		aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// withEncryption sets encryption of the upload, manager's uploader copies it to multipart requests
+func withEncryption(o encryptionOptions) func(*s3.PutObjectInput) {
+	return func(input *s3.PutObjectInput) {
+		switch o.mode {
+		case sseS3:
+			input.ServerSideEncryption = types.ServerSideEncryptionAes256
+		case sseKMS:
+			input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+			if o.kmsKeyId != "" {
+				input.SSEKMSKeyId = aws.String(o.kmsKeyId)
+			}
+			if o.bucketKey {
+				input.BucketKeyEnabled = aws.Bool(true)
+			}
+		case sseCustomer:
+			input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = o.customerKeyHeaders()
+		}
+	}
+}
+
+// withCustomerKey adds SSE-C headers to download, objects encrypted with customer key can't be read without them
+func withCustomerKey(o encryptionOptions) func(*s3.GetObjectInput) {
+	return func(input *s3.GetObjectInput) {
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = o.customerKeyHeaders()
+	}
+}
+
+// withCustomerKeyHead adds SSE-C headers to HeadObject
+func withCustomerKeyHead(o encryptionOptions) func(*s3.HeadObjectInput) {
+	return func(input *s3.HeadObjectInput) {
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = o.customerKeyHeaders()
+	}
+}
+
+// opaqueETag tells if object is encrypted so, that its ETag isn't MD5 of content
+func opaqueETag(headOutput *s3.HeadObjectOutput) bool {
+	switch headOutput.ServerSideEncryption {
+	case types.ServerSideEncryptionAwsKms, types.ServerSideEncryptionAwsKmsDsse:
+		return true
+	}
+
+	return headOutput.SSECustomerAlgorithm != nil
+}
+
+// checkEncryption compares encryption HeadObject reports with what options ask for
+func (o encryptionOptions) checkEncryption(headOutput *s3.HeadObjectOutput) error {
+	switch o.mode {
+	case sseS3:
+		if headOutput.ServerSideEncryption != types.ServerSideEncryptionAes256 {
+			return fmt.Errorf("encryption is %q, expected SSE-S3", headOutput.ServerSideEncryption)
+		}
+	case sseKMS:
+		if headOutput.ServerSideEncryption != types.ServerSideEncryptionAwsKms {
+			return fmt.Errorf("encryption is %q, expected SSE-KMS", headOutput.ServerSideEncryption)
+		}
+		// S3 reports key ARN, aliases can't be matched with it
+		keyArn := aws.ToString(headOutput.SSEKMSKeyId)
+		if o.kmsKeyId != "" && !strings.HasPrefix(o.kmsKeyId, "alias/") && keyArn != o.kmsKeyId && !strings.HasSuffix(keyArn, "/"+o.kmsKeyId) {
+			return fmt.Errorf("KMS key is %s, expected %s", keyArn, o.kmsKeyId)
+		}
+		if o.bucketKey && !aws.ToBool(headOutput.BucketKeyEnabled) {
+			return errors.New("bucket key isn't enabled")
+		}
+	case sseCustomer:
+		_, _, keyMD5 := o.customerKeyHeaders()
+		if aws.ToString(headOutput.SSECustomerAlgorithm) != string(types.ServerSideEncryptionAes256) || aws.ToString(headOutput.SSECustomerKeyMD5) != aws.ToString(keyMD5) {
+			return errors.New("object isn't encrypted with the customer key")
+		}
+	default:
+		return errors.New("no encryption to verify, set -sse")
+	}
+
+	return nil
+}
+
+// verifyEncryption heads every key and checks its encryption, errors are in order of keys
+func verifyEncryption(ctx context.Context, s3Client s3Client, bucket string, keys []string, o encryptionOptions, concurrency int) []error {
+	errs := make([]error, len(keys))
+	parallel(concurrency, len(keys), func(index int) {
+		headOutput, err := headObject(ctx, s3Client, bucket, keys[index], withCustomerKeyHead(o))
+		if err == nil {
+			err = o.checkEncryption(headOutput)
+		}
+		errs[index] = err
+	})
+
+	return errs
+}
+
+// printEncryptionCheck prints keys which encryption doesn't match and how many do
+func printEncryptionCheck(w io.Writer, keys []string, errs []error) {
+	verified := 0
+	for index, err := range errs {
+		if err != nil {
+			fmt.Fprintln(w, "Encryption check failed: "+keys[index]+": "+err.Error())
+			continue
+		}
+		verified++
+	}
+	fmt.Fprintf(w, "Encryption verified for %d of %d objects\n", verified, len(keys))
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func writeCustomerKey(t *testing.T, content []byte) string {
+	path := filepath.Join(t.TempDir(), "sse-c.key")
+	err := os.WriteFile(path, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestEncryptionLoad(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+
+	for name, content := range map[string][]byte{"raw": key, "base64": []byte(base64.StdEncoding.EncodeToString(key) + "\n")} {
+		o := encryptionOptions{mode: sseCustomer, customerKeyPath: writeCustomerKey(t, content)}
+		err := o.load()
+		if err != nil || !bytes.Equal(o.customerKey, key) {
+			t.Errorf("%s key: loaded %v (%v)", name, o.customerKey, err)
+		}
+	}
+
+	for name, o := range map[string]encryptionOptions{
+		"unknown mode":       {mode: "aes"},
+		"key id without kms": {mode: sseS3, kmsKeyId: "1234abcd"},
+		"sse-c without key":  {mode: sseCustomer},
+		"short key":          {mode: sseCustomer, customerKeyPath: writeCustomerKey(t, []byte("short"))},
+	} {
+		if err := o.load(); err == nil {
+			t.Errorf("%s should be refused", name)
+		}
+	}
+}
+
+// uploadEncrypted uploads a file with upload options and verifies it with verify options
+func uploadEncrypted(t *testing.T, bucket *fakeBucket, upload encryptionOptions, verify encryptionOptions) error {
+	dir := t.TempDir()
+	makeTree(t, dir, "a.txt")
+	files, err := collectFiles(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := uploadAll(context.TODO(), bucket, defaultBucketName, "reports", files, 1, uploadHeaders{}, withEncryption(upload))
+	if results[0].err != nil {
+		t.Fatal("Error uploading: " + results[0].err.Error())
+	}
+
+	return verifyEncryption(context.TODO(), bucket, defaultBucketName, []string{results[0].key}, verify, 1)[0]
+}
+
+func TestVerifyEncryption(t *testing.T) {
+	customer := encryptionOptions{mode: sseCustomer, customerKeyPath: writeCustomerKey(t, bytes.Repeat([]byte{7}, 32))}
+	otherCustomer := encryptionOptions{mode: sseCustomer, customerKeyPath: writeCustomerKey(t, bytes.Repeat([]byte{8}, 32))}
+	for _, o := range []*encryptionOptions{&customer, &otherCustomer} {
+		if err := o.load(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kms := encryptionOptions{mode: sseKMS, kmsKeyId: "1234abcd-12ab-34cd-56ef-1234567890ab", bucketKey: true}
+
+	cases := []struct {
+		name   string
+		upload encryptionOptions
+		verify encryptionOptions
+		ok     bool
+	}{
+		{"sse-s3", encryptionOptions{mode: sseS3}, encryptionOptions{mode: sseS3}, true},
+		{"sse-kms", kms, kms, true},
+		{"sse-c", customer, customer, true},
+		{"no encryption", encryptionOptions{}, encryptionOptions{mode: sseS3}, false},
+		{"sse-s3 instead of kms", encryptionOptions{mode: sseS3}, kms, false},
+		{"other kms key", encryptionOptions{mode: sseKMS, kmsKeyId: "other"}, encryptionOptions{mode: sseKMS, kmsKeyId: kms.kmsKeyId}, false},
+		{"no bucket key", encryptionOptions{mode: sseKMS, kmsKeyId: kms.kmsKeyId}, kms, false},
+		{"other customer key", customer, otherCustomer, false},
+	}
+
+	for _, c := range cases {
+		err := uploadEncrypted(t, newFakeBucket(), c.upload, c.verify)
+		if c.ok != (err == nil) {
+			t.Errorf("%s: verification error is %v", c.name, err)
+		}
+	}
+}
+
+func TestDownloadWithCustomerKey(t *testing.T) {
+	customer := encryptionOptions{mode: sseCustomer, customerKeyPath: writeCustomerKey(t, bytes.Repeat([]byte{7}, 32))}
+	if err := customer.load(); err != nil {
+		t.Fatal(err)
+	}
+	bucket := newFakeBucket()
+	if err := uploadEncrypted(t, bucket, customer, customer); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "a.txt")
+	err := downloadTo(context.TODO(), bucket, bucket, defaultBucketName, "reports/a.txt", path, time.Time{}, encryptionOptions{})
+	if err == nil {
+		t.Error("SSE-C object shouldn't be downloaded without the key")
+	}
+	err = downloadTo(context.TODO(), bucket, bucket, defaultBucketName, "reports/a.txt", path, time.Time{}, customer)
+	if err != nil {
+		t.Error("Error downloading with customer key: " + err.Error())
+	}
+}
+
+// ETags of SSE-KMS and SSE-C objects aren't MD5 of content, sync compares their checksums instead
+func TestSyncEncrypted(t *testing.T) {
+	customer := encryptionOptions{mode: sseCustomer, customerKeyPath: writeCustomerKey(t, bytes.Repeat([]byte{7}, 32))}
+	if err := customer.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, encryption := range map[string]encryptionOptions{"sse-kms": {mode: sseKMS}, "sse-c": customer} {
+		for _, algorithm := range []types.ChecksumAlgorithm{types.ChecksumAlgorithmSha256, ""} {
+			dir := t.TempDir()
+			makeTree(t, dir, "a.txt", "nested/b.txt")
+			bucket := newFakeBucket()
+			upOpts := syncTestOptions(dir, syncUp)
+			upOpts.encryption, upOpts.checksum = encryption, algorithm
+			downOpts := syncTestOptions(dir, syncDown)
+			downOpts.encryption = encryption
+
+			if actions := runSync(t, bucket, upOpts); len(actions) != 2 {
+				t.Fatalf("%s %q: expected 2 uploads, planned %v", name, algorithm, actions)
+			}
+			if again := runSync(t, bucket, upOpts); len(again) != 0 {
+				t.Errorf("%s %q: nothing should be uploaded again, planned %v", name, algorithm, again)
+			}
+			if again := runSync(t, bucket, downOpts); len(again) != 0 {
+				t.Errorf("%s %q: nothing should be downloaded, planned %v", name, algorithm, again)
+			}
+			if algorithm == "" {
+				continue
+			}
+
+			// same size, other content
+			err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("x.txt"), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			changed := runSync(t, bucket, upOpts)
+			if len(changed) != 1 || changed[0].rel != "a.txt" || changed[0].reason != "checksum" {
+				t.Errorf("%s: changed a.txt should be uploaded, planned %v", name, changed)
+			}
+		}
+	}
+}
+
+func TestPrintEncryptionCheck(t *testing.T) {
+	var out bytes.Buffer
+	printEncryptionCheck(&out, []string{"reports/a.txt", "reports/b.txt"}, []error{nil, errors.New("bucket key isn't enabled")})
+
+	expected := "Encryption check failed: reports/b.txt: bucket key isn't enabled\nEncryption verified for 1 of 2 objects\n"
+	if out.String() != expected {
+		t.Errorf("output is %q, expected %q", out.String(), expected)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// contentTypes is checked before OS mime table, which differs between machines
+var contentTypes = map[string]string{
+	".html":  "text/html; charset=utf-8",
+	".htm":   "text/html; charset=utf-8",
+	".css":   "text/css; charset=utf-8",
+	".js":    "text/javascript; charset=utf-8",
+	".mjs":   "text/javascript; charset=utf-8",
+	".json":  "application/json",
+	".xml":   "application/xml",
+	".txt":   "text/plain; charset=utf-8",
+	".md":    "text/markdown; charset=utf-8",
+	".csv":   "text/csv; charset=utf-8",
+	".svg":   "image/svg+xml",
+	".png":   "image/png",
+	".jpg":   "image/jpeg",
+	".jpeg":  "image/jpeg",
+	".gif":   "image/gif",
+	".webp":  "image/webp",
+	".ico":   "image/x-icon",
+	".pdf":   "application/pdf",
+	".zip":   "application/zip",
+	".gz":    "application/gzip",
+	".wasm":  "application/wasm",
+	".woff2": "font/woff2",
+}
+
+// headerRule sets headers, metadata and tags of files matching pattern, pattern without slash matches file name
+// in any folder, with slash the path relative to source folder
+type headerRule struct {
+	Pattern            string            `json:"pattern"`
+	ContentType        string            `json:"contentType,omitempty"`
+	CacheControl       string            `json:"cacheControl,omitempty"`
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	Tags               map[string]string `json:"tags,omitempty"`
+}
+
+// uploadHeaders are what uploads get on top of content: metadata and tags from flags go to every object,
+// matching rules are applied in order, so later ones win
+type uploadHeaders struct {
+	rules    []headerRule
+	metadata map[string]string
+	tags     map[string]string
+}
+
+func (r headerRule) matches(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	if !strings.Contains(r.Pattern, "/") {
+		rel = path.Base(rel)
+	}
+	matched, _ := path.Match(r.Pattern, rel)
+
+	return matched
+}
+
+// loadHeaderRules reads JSON list of rules, no rules without path
+func loadHeaderRules(rulesPath string) ([]headerRule, error) {
+	if rulesPath == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(rulesPath)
+	if err != nil {
+		return nil, err
+	}
+	rules := []headerRule{}
+	err = json.Unmarshal(content, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+			return nil, errors.New("bad pattern " + rule.Pattern + " in " + rulesPath)
+		}
+	}
+
+	return rules, nil
+}
+
+// forFile sets headers, metadata and tags of file with relative path rel
+func (h uploadHeaders) forFile(rel string) func(*s3.PutObjectInput) {
+	return func(input *s3.PutObjectInput) {
+		metadata := map[string]string{}
+		tags := url.Values{}
+		for key, value := range h.metadata {
+			metadata[key] = value
+		}
+		for key, value := range h.tags {
+			tags.Set(key, value)
+		}
+
+		for _, rule := range h.rules {
+			if !rule.matches(rel) {
+				continue
+			}
+			if rule.ContentType != "" {
+				input.ContentType = aws.String(rule.ContentType)
+			}
+			if rule.CacheControl != "" {
+				input.CacheControl = aws.String(rule.CacheControl)
+			}
+			if rule.ContentDisposition != "" {
+				input.ContentDisposition = aws.String(rule.ContentDisposition)
+			}
+			for key, value := range rule.Metadata {
+				metadata[key] = value
+			}
+			for key, value := range rule.Tags {
+				tags.Set(key, value)
+			}
+		}
+
+		if len(metadata) > 0 {
+			if input.Metadata == nil {
+				input.Metadata = map[string]string{}
+			}
+			for key, value := range metadata {
+				input.Metadata[key] = value
+			}
+		}
+		if len(tags) > 0 {
+			input.Tagging = aws.String(tags.Encode())
+		}
+	}
+}
+
+// contentTypeByExtension is empty for unknown extensions
+func contentTypeByExtension(rel string) string {
+	ext := strings.ToLower(filepath.Ext(rel))
+	if contentType, found := contentTypes[ext]; found {
+		return contentType
+	}
+
+	return mime.TypeByExtension(ext)
+}
+
+// detectContentType goes by extension, content is sniffed for unknown ones, file is rewound afterwards
+func detectContentType(rel string, file io.ReadSeeker) (string, error) {
+	if contentType := contentTypeByExtension(rel); contentType != "" {
+		return contentType, nil
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	return http.DetectContentType(head[:n]), nil
+}
+
+// withContentType sets detected content type, rules may replace it
+func withContentType(contentType string) func(*s3.PutObjectInput) {
+	return func(input *s3.PutObjectInput) {
+		input.ContentType = aws.String(contentType)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestDetectContentType(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.HTML":     "<p>hi</p>",
+		"app.js":         "console.log(1)",
+		"notes":          "plain text without extension",
+		"page-no-ext":    "<!DOCTYPE html><html></html>",
+		"image.unknown1": "\x89PNG\r\n\x1a\n0000",
+	}
+	expected := map[string]string{
+		"index.HTML":     "text/html; charset=utf-8",
+		"app.js":         "text/javascript; charset=utf-8",
+		"notes":          "text/plain; charset=utf-8",
+		"page-no-ext":    "text/html; charset=utf-8",
+		"image.unknown1": "image/png",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err := os.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		contentType, err := detectContentType(name, file)
+		if err != nil || contentType != expected[name] {
+			t.Errorf("%s: content type is %q (%v), expected %q", name, contentType, err, expected[name])
+		}
+		// sniffing rewinds, so upload gets the whole file
+		rest := make([]byte, len(content))
+		n, _ := file.Read(rest)
+		if string(rest[:n]) != content {
+			t.Errorf("%s: file isn't rewound, read %q", name, rest[:n])
+		}
+		file.Close()
+	}
+}
+
+func TestHeadersForFile(t *testing.T) {
+	rulesPath := filepath.Join(t.TempDir(), "rules.json")
+	err := os.WriteFile(rulesPath, []byte(`[
+		{"pattern": "*", "cacheControl": "public, max-age=86400"},
+		{"pattern": "*.html", "cacheControl": "no-cache", "metadata": {"layout": "page"}},
+		{"pattern": "downloads/*.pdf", "contentDisposition": "attachment", "contentType": "application/octet-stream", "tags": {"class": "public"}}
+	]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := loadHeaderRules(rulesPath)
+	if err != nil {
+		t.Fatal("Error loading rules: " + err.Error())
+	}
+	headers := uploadHeaders{rules: rules, metadata: map[string]string{"team": "web"}, tags: map[string]string{"env": "prod", "class": "internal"}}
+
+	cases := []struct {
+		rel                string
+		cacheControl       string
+		contentDisposition string
+		contentType        string
+		metadata           map[string]string
+		tagging            string
+	}{
+		{filepath.Join("blog", "index.html"), "no-cache", "", "text/html; charset=utf-8", map[string]string{"team": "web", "layout": "page"}, "class=internal&env=prod"},
+		{filepath.Join("downloads", "report.pdf"), "public, max-age=86400", "attachment", "application/octet-stream", map[string]string{"team": "web"}, "class=public&env=prod"},
+		{filepath.Join("other", "downloads", "report.pdf"), "public, max-age=86400", "", "application/pdf", map[string]string{"team": "web"}, "class=internal&env=prod"},
+	}
+
+	for _, c := range cases {
+		input := &s3.PutObjectInput{}
+		withContentType(contentTypes[strings.ToLower(filepath.Ext(c.rel))])(input)
+		headers.forFile(c.rel)(input)
+
+		if aws.ToString(input.CacheControl) != c.cacheControl || aws.ToString(input.ContentDisposition) != c.contentDisposition || aws.ToString(input.ContentType) != c.contentType {
+			t.Errorf("%s: cache control %q, disposition %q, type %q", c.rel, aws.ToString(input.CacheControl), aws.ToString(input.ContentDisposition), aws.ToString(input.ContentType))
+		}
+		if len(input.Metadata) != len(c.metadata) || input.Metadata["layout"] != c.metadata["layout"] || input.Metadata["team"] != "web" {
+			t.Errorf("%s: metadata is %v, expected %v", c.rel, input.Metadata, c.metadata)
+		}
+		if aws.ToString(input.Tagging) != c.tagging {
+			t.Errorf("%s: tagging is %q, expected %q", c.rel, aws.ToString(input.Tagging), c.tagging)
+		}
+	}
+}
+
+func TestLoadHeaderRulesBadPattern(t *testing.T) {
+	rulesPath := filepath.Join(t.TempDir(), "rules.json")
+	err := os.WriteFile(rulesPath, []byte(`[{"pattern": "[", "cacheControl": "no-cache"}]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = loadHeaderRules(rulesPath)
+	if err == nil {
+		t.Error("bad pattern should be refused")
+	}
+}
+
+// recordingS3Uploader keeps upload requests
+type recordingS3Uploader struct {
+	inputs []*s3.PutObjectInput
+}
+
+func (m *recordingS3Uploader) Upload(ctx context.Context, input *s3.PutObjectInput, opts ...func(*manager.Uploader)) (*manager.UploadOutput, error) {
+	m.inputs = append(m.inputs, input)
+	return &manager.UploadOutput{Key: input.Key}, nil
+}
+
+func TestUploadSetsHeaders(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, "index.html")
+	files, err := collectFiles(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploader := &recordingS3Uploader{}
+	headers := uploadHeaders{metadata: map[string]string{"team": "web"}, tags: map[string]string{"env": "prod"}}
+	results := uploadAll(context.TODO(), uploader, defaultBucketName, "reports", files, 1, headers)
+	if results[0].err != nil {
+		t.Fatal("Error uploading: " + results[0].err.Error())
+	}
+
+	input := uploader.inputs[0]
+	if aws.ToString(input.ContentType) != "text/html; charset=utf-8" || aws.ToString(input.Tagging) != "env=prod" {
+		t.Errorf("content type %q, tagging %q", aws.ToString(input.ContentType), aws.ToString(input.Tagging))
+	}
+	if input.Metadata["team"] != "web" || input.Metadata[mtimeMetadataKey] == "" {
+		t.Errorf("metadata should have both user keys and mtime, got %v", input.Metadata)
+	}
+}
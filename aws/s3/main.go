@@ -2,23 +2,25 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io/fs"
+	"io"
 	"log/slog"
 	"os"
-	"path/filepath"
-	"strconv"
+	"slices"
+	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
 
 const (
-	filesDir    string = "uploads"
-	uploadToDir string = "reports"
-	bucketName  string = "vladsanyuk-b961745f-fa36-4cfa-b9eb-7457e4c012fd"
+	defaultFilesDir    string = "uploads"
+	defaultUploadToDir string = "reports"
+	defaultBucketName  string = "vladsanyuk-b961745f-fa36-4cfa-b9eb-7457e4c012fd"
 )
 
 func main() {
@@ -32,94 +34,395 @@ func main() {
 		programLevel.Set(slog.LevelDebug)
 	}
 
+	// first argument may name a command, without one -upload and -download flags do the work
+	command, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	if command != "" && command != "sync" && command != "download" && command != "verify" && command != "cleanup" && command != "presign" {
+		slog.Error("Unknown command " + command + ", expected sync, download, verify, cleanup or presign")
+		os.Exit(1)
+	}
+
 	var (
-		upload   bool
-		download string
+		syncOpts       syncOptions
+		dryRun         bool
+		verifySSE      bool
+		rulesPath      string
+		resumable      bool
+		partSize       int64
+		checkpointDir  string
+		olderThan      time.Duration
+		presignOpts    presignOptions
+		checksum       string
+		dest           string
+		upload         bool
+		download       string
+		source         string
+		bucket         string
+		prefix         string
+		followSymlinks bool
+		concurrency    int
+		showWhoami     bool
+		awsOpts        awsOptions
+		timeout        time.Duration
+		callTimeout    time.Duration
 	)
 
 	flag.BoolVar(&upload, "upload", false, "Bool, upload files from folder")
 	flag.StringVar(&download, "download", "", "String, download specified file")
-	flag.Parse()
+	flag.StringVar(&source, "source", defaultFilesDir, "String, local folder to upload or sync, nested folders included")
+	flag.StringVar(&bucket, "bucket", defaultBucketName, "String, bucket to upload to and download from")
+	flag.StringVar(&prefix, "prefix", defaultUploadToDir, "String, key prefix files are uploaded under and downloaded from, empty for bucket root")
+	flag.IntVar(&concurrency, "concurrency", 4, "Int, number of files uploaded at once")
+	flag.BoolVar(&followSymlinks, "follow-symlinks", false, "Bool, upload what symlinks point to instead of skipping them")
+	flag.DurationVar(&timeout, "timeout", time.Hour, "Duration, deadline for the whole run, 0 for none")
+	flag.DurationVar(&callTimeout, "call-timeout", 5*time.Minute, "Duration, deadline for a single AWS API call, retries included")
+	flag.BoolVar(&showWhoami, "whoami", false, "Bool, only print account and ARN requests are made as")
+	flag.StringVar(&syncOpts.direction, "direction", syncUp, "String, sync direction, up from -source to bucket or down from bucket to -source")
+	flag.StringVar(&syncOpts.compare, "compare", compareChecksum, "String, how sync compares files of equal size, checksum (MD5/ETag) or mtime kept in object metadata")
+	flag.BoolVar(&syncOpts.delete, "delete", false, "Bool, sync deletes files missing on the source side")
+	flag.StringVar(&dest, "dest", "downloads", "String, folder download command recreates -prefix in")
+	flag.BoolVar(&dryRun, "dry-run", false, "Bool, only print actions sync would take or uploads cleanup would abort")
+	flag.BoolVar(&verifySSE, "verify-sse", false, "Bool, check encryption of uploaded objects with HeadObject after upload or sync")
+	flag.StringVar(&checksum, "checksum", "sha256", "String, checksum uploads send and S3 checks, sha256, crc32c or none")
+	flag.BoolVar(&resumable, "resumable", false, "Bool, upload big files part by part with a checkpoint, so interrupted upload resumes on the next run")
+	flag.Int64Var(&partSize, "part-size", 8, "Int, part size of -resumable uploads in MiB, 5 at least")
+	flag.StringVar(&checkpointDir, "checkpoint-dir", ".s3-checkpoints", "String, folder -resumable keeps checkpoints of unfinished uploads in")
+	flag.DurationVar(&olderThan, "older-than", 24*time.Hour, "Duration, cleanup aborts multipart uploads started longer ago")
+	flag.StringVar(&presignOpts.method, "method", "GET", "String, what presign URLs allow, GET to download or PUT to upload")
+	flag.DurationVar(&presignOpts.expires, "expires", time.Hour, "Duration, how long presign URLs work, 168h at most")
+	flag.StringVar(&presignOpts.contentDisposition, "content-disposition", "", "String, Content-Disposition downloads with presigned GET URL get, like attachment")
+	flag.StringVar(&presignOpts.contentType, "content-type", "", "String, content type presigned PUT URL requires, detected by key extension if empty")
+	flag.Int64Var(&presignOpts.size, "size", 0, "Int, size in bytes presigned PUT URL requires, any if 0")
+	flag.StringVar(&rulesPath, "rules", os.Getenv("S3_UPLOAD_RULES"), "String, JSON file with headers, metadata and tags of uploads by path pattern, S3_UPLOAD_RULES env")
+	syncOpts.headers.metadata, syncOpts.headers.tags = keyValueFlag{}, keyValueFlag{}
+	flag.Var(keyValueFlag(syncOpts.headers.metadata), "meta", "key=value, user metadata of every upload, repeatable")
+	flag.Var(keyValueFlag(syncOpts.headers.tags), "tag", "key=value, tag of every upload, repeatable")
+	syncOpts.encryption.register(flag.CommandLine)
+	awsOpts.register(flag.CommandLine)
+	flag.CommandLine.Parse(args)
+
+	err := syncOpts.encryption.load()
+	if err == nil && verifySSE && syncOpts.encryption.mode == "" {
+		err = errors.New("-verify-sse needs -sse")
+	}
+	if err != nil {
+		slog.Error("Error setting up encryption: " + err.Error())
+		os.Exit(1)
+	}
+	encryption := syncOpts.encryption
+
+	syncOpts.checksum, err = checksumAlgorithm(checksum)
+	if err != nil {
+		slog.Error("Error setting up checksum: " + err.Error())
+		os.Exit(1)
+	}
+
+	syncOpts.headers.rules, err = loadHeaderRules(rulesPath)
+	if err != nil {
+		slog.Error("Error loading upload rules: " + err.Error())
+		os.Exit(1)
+	}
+
+	partSize *= 1024 * 1024
+	if resumable && partSize < manager.MinUploadPartSize {
+		slog.Error("Error setting up resumable upload: -part-size should be 5 MiB at least")
+		os.Exit(1)
+	}
+
+	ctx, cancel := rootContext(timeout)
+	defer cancel()
 
-	ctx := context.TODO()
-	cfg, err := config.LoadDefaultConfig(ctx)
+	cfg, err := loadAwsConfig(ctx, awsOpts, callTimeout)
 	if err != nil {
 		slog.Error("Error constructing AWS config: " + err.Error())
+		cancel()
+		os.Exit(1)
+	}
+	s3Client := s3.NewFromConfig(cfg, awsOpts.s3Options)
+	stsClient := sts.NewFromConfig(cfg)
+
+	// upload (resumable one too), sync and cleanup change objects, downloads overwrite local files with them,
+	// so account is printed before them
+	changing := upload || download != "" || command == "sync" || command == "download" || command == "cleanup"
+	if showWhoami || changing {
+		_, err = whoami(ctx, stsClient)
+		if err != nil {
+			slog.Error("Error checking AWS identity: " + err.Error())
+			cancel()
+			os.Exit(1)
+		}
+	}
+	if showWhoami {
+		return
+	}
+
+	var s3Uploader s3Uploader = manager.NewUploader(s3Client)
+	if resumable {
+		s3Uploader = &resumableUploader{client: s3Client, fallback: s3Uploader, partSize: partSize, checkpointDir: checkpointDir}
+	}
+
+	if command == "presign" {
+		presignOpts.method = strings.ToUpper(presignOpts.method)
+		err = presignOpts.check()
+		if err != nil {
+			slog.Error("Error checking presign options: " + err.Error())
+			cancel()
+			os.Exit(1)
+		}
+
+		// keys follow flags, relative to -prefix
+		keys, err := presignKeysOf(ctx, s3Client, bucket, prefix, flag.Args(), presignOpts.method)
+		if err != nil {
+			slog.Error("Error listing keys to presign: " + err.Error())
+			cancel()
+			os.Exit(1)
+		}
+		urls, err := presignKeys(ctx, s3.NewPresignClient(s3Client), bucket, keys, presignOpts, time.Now())
+		if err != nil {
+			slog.Error("Error presigning URLs: " + err.Error())
+			cancel()
+			os.Exit(1)
+		}
+		printPresignedURLs(os.Stdout, urls)
+		return
+	}
+
+	if command == "cleanup" {
+		stale, err := cleanupUploads(ctx, s3Client, bucket, objectKey(prefix, ""), olderThan, time.Now(), dryRun)
+		if err != nil {
+			slog.Error("Error listing multipart uploads: " + err.Error())
+			cancel()
+			os.Exit(1)
+		}
+		printStaleUploads(os.Stdout, stale, dryRun)
+		for _, upload := range stale {
+			err = errors.Join(err, upload.err)
+		}
+		if err != nil {
+			cancel()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if command == "verify" {
+		files, err := collectFiles(source, followSymlinks)
+		if err != nil {
+			slog.Error("Error listing files in " + source + ": " + err.Error())
+			cancel()
+			os.Exit(1)
+		}
+
+		results := verifyFiles(ctx, s3Client, bucket, prefix, files, encryption, concurrency)
+		err = printVerifyResults(os.Stdout, results)
+		for _, result := range results {
+			err = errors.Join(err, result.err)
+		}
+		if err != nil {
+			cancel()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if command == "sync" || command == "download" {
+		syncOpts.dir, syncOpts.bucket, syncOpts.prefix = source, bucket, prefix
+		syncOpts.followSymlinks, syncOpts.concurrency = followSymlinks, concurrency
+		// download is a one-way sync, files matching by size and ETag are skipped and nothing is deleted
+		if command == "download" {
+			syncOpts.dir, syncOpts.direction, syncOpts.compare, syncOpts.delete = dest, syncDown, compareChecksum, false
+		}
+
+		actions, err := planSync(ctx, s3Client, syncOpts)
+		if err != nil {
+			slog.Error("Error planning " + command + ": " + err.Error())
+			cancel()
+			os.Exit(1)
+		}
+		if dryRun {
+			printSyncPlan(os.Stdout, actions)
+			return
+		}
+
+		started := time.Now()
+		errs := applySync(ctx, s3Client, s3Uploader, manager.NewDownloader(s3Client), syncOpts, actions)
+		printSyncResult(os.Stdout, actions, errs, time.Since(started))
+		if verifySSE {
+			keys := []string{}
+			for index, action := range actions {
+				if action.kind == "upload" && errs[index] == nil {
+					keys = append(keys, action.key)
+				}
+			}
+			sseErrs := verifyEncryption(ctx, s3Client, bucket, keys, encryption, concurrency)
+			printEncryptionCheck(os.Stdout, keys, sseErrs)
+			errs = append(errs, sseErrs...)
+		}
+		if errors.Join(errs...) != nil {
+			cancel()
+			os.Exit(1)
+		}
+		return
 	}
-	s3Client := s3.NewFromConfig(cfg)
 
 	if upload {
-		bucketFound, err := lookupBucket(ctx, s3Client)
+		bucketFound, err := lookupBucket(ctx, s3Client, bucket)
 		if err != nil {
 			slog.Error("Error looking up bucket: " + err.Error())
+			cancel()
+			os.Exit(1)
 		}
 
 		if !bucketFound {
-			bucketCreatedOutput, err := createBucket(ctx, s3Client)
+			bucketCreatedOutput, err := createBucket(ctx, s3Client, bucket)
 			if err != nil {
 				slog.Error("Error creating bucket: " + err.Error())
+				cancel()
+				os.Exit(1)
 			}
 
 			slog.Debug("bucketCreatedOutput is: " + fmt.Sprintf("%v", bucketCreatedOutput.ResultMetadata))
 		}
 
-		s3Uploader := manager.NewUploader(s3Client)
-
-		files := make([]string, 0)
-		_ = filepath.WalkDir(filesDir, func(path string, d fs.DirEntry, err error) error {
-			if !d.IsDir() {
-				slog.Debug("File is: " + d.Name())
-				files = append(files, d.Name())
-			}
-
-			return nil
-		})
+		files, err := collectFiles(source, followSymlinks)
+		if err != nil {
+			slog.Error("Error listing files in " + source + ": " + err.Error())
+			cancel()
+			os.Exit(1)
+		}
 
-		for index, file := range files {
-			indexStr := strconv.Itoa(index)
-			slog.Debug("file " + indexStr + " is: " + file)
+		started := time.Now()
+		results := uploadAll(ctx, s3Uploader, bucket, prefix, files, concurrency, syncOpts.headers, withEncryption(encryption), withChecksum(syncOpts.checksum))
+		printUploadSummary(os.Stdout, results, time.Since(started))
 
-			readFile, err := os.Open(fmt.Sprintf("%s/%s", filesDir, file))
-			if err != nil {
-				slog.Error("Error reading file " + file + ": " + err.Error())
+		all := []string{}
+		uploaded := []string{}
+		uploadedKeys := []string{}
+		for _, result := range results {
+			all = append(all, result.file.rel)
+			if result.err == nil {
+				uploaded = append(uploaded, result.file.rel)
+				uploadedKeys = append(uploadedKeys, result.key)
 			}
-			defer readFile.Close()
+		}
 
-			uploadOutput, err := uploadFiles(ctx, s3Uploader, file, readFile)
-			if err != nil {
-				slog.Error("Error uploading file " + file + ": " + err.Error())
+		if ctx.Err() != nil {
+			printInterrupted(os.Stdout, context.Cause(ctx), uploaded, all)
+			cancel()
+			os.Exit(1)
+		}
+		if verifySSE {
+			sseErrs := verifyEncryption(ctx, s3Client, bucket, uploadedKeys, encryption, concurrency)
+			printEncryptionCheck(os.Stdout, uploadedKeys, sseErrs)
+			if errors.Join(sseErrs...) != nil {
+				cancel()
+				os.Exit(1)
 			}
-
-			slog.Debug(file + " file uploaded as: " + *uploadOutput.Key)
+		}
+		if len(uploaded) < len(all) {
+			cancel()
+			os.Exit(1)
 		}
 	}
 
 	if download != "" {
-		objectFound, err := lookupObject(ctx, s3Client, download)
+		key := objectKey(prefix, download)
+		objectFound, err := lookupObject(ctx, s3Client, bucket, key, withCustomerKeyHead(encryption))
 		if err != nil {
-			slog.Error("Error listing objects: " + err.Error())
+			slog.Error("Error looking up object: " + err.Error())
+			cancel()
+			os.Exit(1)
 		}
 
 		if !objectFound {
-			slog.Error("Objects " + download + " wasn't found in " + bucketName + " bucket")
+			slog.Error("Objects " + download + " wasn't found in " + bucket + " bucket")
 			os.Exit(1)
 		}
 
 		s3Downloader := manager.NewDownloader(s3Client)
 
-		newFile, err := os.Create(fmt.Sprintf("downloads/%s", download))
+		newFile, err := createLocalFile(dest, download)
 		if err != nil {
 			slog.Error("Error creating new local file: " + err.Error())
+			cancel()
+			os.Exit(1)
 		}
 		defer newFile.Close()
 
-		numBytesDownloaded, err := downloadFile(ctx, s3Downloader, newFile, download)
+		numBytesDownloaded, err := downloadFile(ctx, s3Downloader, newFile, bucket, key, withCustomerKey(encryption))
 		if err != nil {
 			slog.Error("Error downloading file: " + err.Error())
 		}
 
+		if ctx.Err() != nil {
+			// partial download is worse than none
+			newFile.Close()
+			os.Remove(newFile.Name())
+			printInterrupted(os.Stdout, context.Cause(ctx), nil, []string{download})
+			cancel()
+			os.Exit(1)
+		}
+		if err != nil {
+			newFile.Close()
+			os.Remove(newFile.Name())
+			cancel()
+			os.Exit(1)
+		}
+
+		newFile.Close()
+		err = verifyDownload(ctx, s3Client, bucket, key, newFile.Name(), encryption)
+		if err != nil {
+			// corrupt download is worse than none too
+			os.Remove(newFile.Name())
+			slog.Error("Error verifying download: " + err.Error())
+			cancel()
+			os.Exit(1)
+		}
+
 		if numBytesDownloaded != 0 {
 			slog.Info("Successfully downloaded " + download)
 		}
 	}
 }
+
+// printInterrupted tells which of all items finished before the run was interrupted and which were aborted
+func printInterrupted(w io.Writer, cause error, finished []string, all []string) {
+	fmt.Fprintln(w, "Interrupted: "+cause.Error())
+	if len(finished) > 0 {
+		fmt.Fprintln(w, "Finished: "+strings.Join(finished, ", "))
+	}
+
+	aborted := []string{}
+	for _, item := range all {
+		if !slices.Contains(finished, item) {
+			aborted = append(aborted, item)
+		}
+	}
+	if len(aborted) > 0 {
+		fmt.Fprintln(w, "Aborted: "+strings.Join(aborted, ", "))
+	}
+}
+
+// keyValueFlag collects repeated -flag key=value pairs
+type keyValueFlag map[string]string
+
+func (f keyValueFlag) String() string {
+	pairs := []string{}
+	for key, value := range f {
+		pairs = append(pairs, key+"="+value)
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (f keyValueFlag) Set(pair string) error {
+	key, value, found := strings.Cut(pair, "=")
+	if !found || key == "" {
+		return errors.New("expected key=value, got " + pair)
+	}
+
+	f[key] = value
+	return nil
+}
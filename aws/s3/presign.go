@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// maxPresignExpiry is the longest SigV4 presigned URL S3 accepts
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+type s3Presigner interface {
+	PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+	PresignPutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+}
+
+// presignOptions shape URLs, content type and size are signed into PUT URLs, so uploads with other ones are refused
+type presignOptions struct {
+	method  string
+	expires time.Duration
+	// Content-Disposition GET responses get, like "attachment; filename=report.pdf"
+	contentDisposition string
+	// PUT content type, detected by key extension if empty
+	contentType string
+	// exact PUT size in bytes, any if 0
+	size int64
+}
+
+// presignedURL is URL anyone holding it can use on key till expires
+type presignedURL struct {
+	key     string
+	method  string
+	url     string
+	expires time.Time
+	// headers PUT must send as they are signed, host excluded
+	headers map[string]string
+}
+
+func (o presignOptions) check() error {
+	switch o.method {
+	case "GET", "PUT":
+	default:
+		return errors.New("unknown -method " + o.method + ", expected GET or PUT")
+	}
+	if o.expires <= 0 || o.expires > maxPresignExpiry {
+		return errors.New("-expires should be between 1s and 168h")
+	}
+	if o.method == "GET" && (o.contentType != "" || o.size != 0) {
+		return errors.New("-content-type and -size are for PUT URLs")
+	}
+	if o.method == "PUT" && o.contentDisposition != "" {
+		return errors.New("-content-disposition is for GET URLs")
+	}
+	if o.size < 0 {
+		return errors.New("-size can't be negative")
+	}
+
+	return nil
+}
+
+// presignKeys signs URL for every key, signing is local, so no request is made
+func presignKeys(ctx context.Context, presigner s3Presigner, bucket string, keys []string, o presignOptions, now time.Time) ([]presignedURL, error) {
+	urls := []presignedURL{}
+	for _, key := range keys {
+		var (
+			request *v4.PresignedHTTPRequest
+			err     error
+		)
+		expires := func(po *s3.PresignOptions) { po.Expires = o.expires }
+		switch o.method {
+		case "GET":
+			input := &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}
+			if o.contentDisposition != "" {
+				input.ResponseContentDisposition = aws.String(o.contentDisposition)
+			}
+			request, err = presigner.PresignGetObject(ctx, input, expires)
+		case "PUT":
+			input := &s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}
+			contentType := o.contentType
+			if contentType == "" {
+				contentType = contentTypeByExtension(key)
+			}
+			if contentType != "" {
+				input.ContentType = aws.String(contentType)
+			}
+			if o.size > 0 {
+				input.ContentLength = aws.Int64(o.size)
+			}
+			request, err = presigner.PresignPutObject(ctx, input, expires)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("presigning %s: %w", key, err)
+		}
+
+		url := presignedURL{key: key, method: request.Method, url: request.URL, expires: now.Add(o.expires), headers: map[string]string{}}
+		for name, values := range request.SignedHeader {
+			if !strings.EqualFold(name, "host") {
+				url.headers[name] = strings.Join(values, ",")
+			}
+		}
+		urls = append(urls, url)
+	}
+
+	return urls, nil
+}
+
+// presignKeysOf are keys to sign: given keys relative to prefix, or every object under prefix without them,
+// PUT URLs are for new objects, so they need keys
+func presignKeysOf(ctx context.Context, s3Client s3Client, bucket string, prefix string, rels []string, method string) ([]string, error) {
+	keys := []string{}
+	for _, rel := range rels {
+		keys = append(keys, objectKey(prefix, rel))
+	}
+	if len(keys) > 0 {
+		return keys, nil
+	}
+	if method == "PUT" {
+		return nil, errors.New("PUT URLs need keys")
+	}
+
+	err := eachObject(ctx, s3Client, bucket, objectKey(prefix, ""), func(object types.Object) bool {
+		if key := aws.ToString(object.Key); !strings.HasSuffix(key, "/") {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no objects under " + objectKey(prefix, ""))
+	}
+
+	return keys, nil
+}
+
+// printPresignedURLs prints a line per key, key and URL separated by tab, headers PUT has to send as they are
+// signed follow their URL as comment lines, so a script reading URLs can skip them
+func printPresignedURLs(w io.Writer, urls []presignedURL) {
+	for _, url := range urls {
+		fmt.Fprintln(w, url.key+"\t"+url.url)
+
+		names := []string{}
+		for name := range url.headers {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			fmt.Fprintln(w, "#   "+name+": "+url.headers[name])
+		}
+	}
+	if len(urls) > 0 {
+		fmt.Fprintf(w, "# %d %s URLs, expire %s\n", len(urls), urls[0].method, urls[0].expires.UTC().Format(time.RFC3339))
+	}
+}
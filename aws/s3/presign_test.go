@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// testPresigner signs with fixed credentials, presigning needs no requests
+func testPresigner() *s3.PresignClient {
+	client := s3.New(s3.Options{
+		Region: "eu-central-1",
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, nil
+		}),
+	})
+	return s3.NewPresignClient(client)
+}
+
+func TestPresignOptionsCheck(t *testing.T) {
+	tests := []struct {
+		opts  presignOptions
+		valid bool
+	}{
+		{presignOptions{method: "GET", expires: time.Hour}, true},
+		{presignOptions{method: "GET", expires: time.Hour, contentDisposition: "attachment"}, true},
+		{presignOptions{method: "PUT", expires: 7 * 24 * time.Hour, contentType: "text/csv", size: 10}, true},
+		{presignOptions{method: "DELETE", expires: time.Hour}, false},
+		{presignOptions{method: "GET", expires: 8 * 24 * time.Hour}, false},
+		{presignOptions{method: "GET", expires: 0}, false},
+		{presignOptions{method: "GET", expires: time.Hour, size: 10}, false},
+		{presignOptions{method: "PUT", expires: time.Hour, contentDisposition: "attachment"}, false},
+		{presignOptions{method: "PUT", expires: time.Hour, size: -1}, false},
+	}
+
+	for _, test := range tests {
+		err := test.opts.check()
+		if (err == nil) != test.valid {
+			t.Errorf("check of %+v: expected valid %v, got %v", test.opts, test.valid, err)
+		}
+	}
+}
+
+func TestPresignGet(t *testing.T) {
+	now := time.Now()
+	opts := presignOptions{method: "GET", expires: 2 * time.Hour, contentDisposition: "attachment; filename=q1.pdf"}
+	urls, err := presignKeys(context.Background(), testPresigner(), defaultBucketName, []string{"reports/q1.pdf", "reports/q2.pdf"}, opts, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 2 || urls[1].key != "reports/q2.pdf" || urls[0].method != "GET" || !urls[0].expires.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("unexpected URLs %+v", urls)
+	}
+
+	parsed, err := url.Parse(urls[0].url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if !strings.HasSuffix(parsed.Path, "/reports/q1.pdf") {
+		t.Errorf("unexpected URL %s", urls[0].url)
+	}
+	if query.Get("X-Amz-Expires") != "7200" || query.Get("response-content-disposition") != "attachment; filename=q1.pdf" || query.Get("X-Amz-Signature") == "" {
+		t.Errorf("unexpected query %v", query)
+	}
+}
+
+func TestPresignPut(t *testing.T) {
+	opts := presignOptions{method: "PUT", expires: time.Hour, size: 2048}
+	urls, err := presignKeys(context.Background(), testPresigner(), defaultBucketName, []string{"uploads/data.csv"}, opts, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if urls[0].method != "PUT" || urls[0].headers["Content-Type"] != "text/csv; charset=utf-8" || urls[0].headers["Content-Length"] != "2048" {
+		t.Fatalf("expected content type and size signed, got %+v", urls[0])
+	}
+	parsed, err := url.Parse(urls[0].url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed := parsed.Query().Get("X-Amz-SignedHeaders"); !strings.Contains(signed, "content-length") || !strings.Contains(signed, "content-type") {
+		t.Errorf("expected content type and size among signed headers, got %s", signed)
+	}
+
+	output := new(bytes.Buffer)
+	printPresignedURLs(output, urls)
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "uploads/data.csv\thttps://") || lines[1] != "#   Content-Length: 2048" || !strings.HasPrefix(lines[3], "# 1 PUT URLs, expire ") {
+		t.Errorf("unexpected output:\n%s", output.String())
+	}
+}
+
+func TestPresignKeysOf(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.pageSize = 1
+	bucket.put("reports/q1.pdf", []byte("q1"), nil)
+	bucket.put("reports/q2.pdf", []byte("q2"), nil)
+	bucket.put("reports/", nil, nil)
+	bucket.put("other/q3.pdf", []byte("q3"), nil)
+
+	keys, err := presignKeysOf(context.Background(), bucket, defaultBucketName, "reports", nil, "GET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "reports/q1.pdf,reports/q2.pdf" {
+		t.Errorf("expected every object under prefix, got %v", keys)
+	}
+
+	keys, err = presignKeysOf(context.Background(), bucket, defaultBucketName, "reports", []string{"new.csv"}, "PUT")
+	if err != nil || strings.Join(keys, ",") != "reports/new.csv" {
+		t.Errorf("expected given key under prefix, got %v, %v", keys, err)
+	}
+
+	if _, err := presignKeysOf(context.Background(), bucket, defaultBucketName, "reports", nil, "PUT"); err == nil {
+		t.Error("expected PUT without keys to fail")
+	}
+	if _, err := presignKeysOf(context.Background(), bucket, defaultBucketName, "empty", nil, "GET"); err == nil {
+		t.Error("expected empty prefix listing to fail")
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// multipartClient is what resumable uploads and cleanup need on top of s3Client
+type multipartClient interface {
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	ListMultipartUploads(ctx context.Context, params *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error)
+}
+
+// checkpoint is progress of a multipart upload, it's valid only for the same file size, mtime and part size,
+// and for the same checksum and encryption, as every part has to be sent with ones the upload was created with
+type checkpoint struct {
+	Bucket            string                  `json:"bucket"`
+	Key               string                  `json:"key"`
+	UploadId          string                  `json:"uploadId"`
+	Size              int64                   `json:"size"`
+	ModTime           time.Time               `json:"modTime"`
+	PartSize          int64                   `json:"partSize"`
+	ChecksumAlgorithm types.ChecksumAlgorithm `json:"checksumAlgorithm,omitempty"`
+	Encryption        string                  `json:"encryption,omitempty"`
+	Parts             []completedPart         `json:"parts"`
+}
+
+type completedPart struct {
+	PartNumber int32  `json:"partNumber"`
+	ETag       string `json:"etag"`
+	// checksum of the part, its kind is ChecksumAlgorithm of the upload
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// resumableUploader uploads files bigger than partSize part by part itself, recording finished parts in
+// checkpointDir, so upload interrupted by crash or Ctrl-C goes on from the last finished part next time.
+// Smaller files and bodies which aren't files go to fallback
+type resumableUploader struct {
+	client        multipartClient
+	fallback      s3Uploader
+	partSize      int64
+	checkpointDir string
+}
+
+func (u *resumableUploader) Upload(ctx context.Context, input *s3.PutObjectInput, opts ...func(*manager.Uploader)) (*manager.UploadOutput, error) {
+	file, ok := input.Body.(*os.File)
+	if !ok {
+		return u.fallback.Upload(ctx, input, opts...)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() <= u.partSize {
+		return u.fallback.Upload(ctx, input, opts...)
+	}
+
+	output, err := u.uploadParts(ctx, input, file, info)
+	var noSuchUpload *types.NoSuchUpload
+	if errors.As(err, &noSuchUpload) {
+		// upload was aborted or expired since the checkpoint was written
+		slog.Warn("Multipart upload of " + aws.ToString(input.Key) + " is gone, starting over")
+		err = os.Remove(u.checkpointPath(aws.ToString(input.Bucket), aws.ToString(input.Key)))
+		if err != nil {
+			return nil, err
+		}
+		output, err = u.uploadParts(ctx, input, file, info)
+	}
+
+	return output, err
+}
+
+func (u *resumableUploader) uploadParts(ctx context.Context, input *s3.PutObjectInput, file *os.File, info os.FileInfo) (*manager.UploadOutput, error) {
+	bucket, key := aws.ToString(input.Bucket), aws.ToString(input.Key)
+	cp, err := u.startOrResume(ctx, input, info)
+	if err != nil {
+		return nil, err
+	}
+
+	done := map[int32]bool{}
+	for _, part := range cp.Parts {
+		done[part.PartNumber] = true
+	}
+	if len(done) > 0 {
+		slog.Info(fmt.Sprintf("Resuming upload of %s, %d parts of %d are already uploaded", key, len(done), partCount(cp.Size, cp.PartSize)))
+	}
+
+	for partNumber := int32(1); int64(partNumber) <= partCount(cp.Size, cp.PartSize); partNumber++ {
+		if done[partNumber] {
+			continue
+		}
+
+		offset := int64(partNumber-1) * cp.PartSize
+		partOutput, err := u.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:               input.Bucket,
+			Key:                  input.Key,
+			UploadId:             aws.String(cp.UploadId),
+			PartNumber:           aws.Int32(partNumber),
+			Body:                 io.NewSectionReader(file, offset, min(cp.PartSize, cp.Size-offset)),
+			ChecksumAlgorithm:    input.ChecksumAlgorithm,
+			SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+			SSECustomerKey:       input.SSECustomerKey,
+			SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("uploading part %d of %s: %w", partNumber, key, err)
+		}
+
+		_, checksum := partChecksum(partOutput)
+		cp.Parts = append(cp.Parts, completedPart{PartNumber: partNumber, ETag: aws.ToString(partOutput.ETag), Checksum: checksum})
+		err = u.saveCheckpoint(cp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	slices.SortFunc(cp.Parts, func(a, b completedPart) int { return int(a.PartNumber - b.PartNumber) })
+	parts := []types.CompletedPart{}
+	for _, part := range cp.Parts {
+		parts = append(parts, completedPartOf(part, input.ChecksumAlgorithm))
+	}
+	completeOutput, err := u.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:               input.Bucket,
+		Key:                  input.Key,
+		UploadId:             aws.String(cp.UploadId),
+		MultipartUpload:      &types.CompletedMultipartUpload{Parts: parts},
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+		SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("completing upload of %s: %w", key, err)
+	}
+
+	err = os.Remove(u.checkpointPath(bucket, key))
+	if err != nil {
+		return nil, err
+	}
+
+	return &manager.UploadOutput{
+		Key:      input.Key,
+		UploadID: cp.UploadId,
+		ETag:     completeOutput.ETag,
+		Location: aws.ToString(completeOutput.Location),
+	}, nil
+}
+
+// startOrResume loads checkpoint of the same file or creates multipart upload, checkpoint of changed file is dropped
+// together with its upload
+func (u *resumableUploader) startOrResume(ctx context.Context, input *s3.PutObjectInput, info os.FileInfo) (checkpoint, error) {
+	bucket, key := aws.ToString(input.Bucket), aws.ToString(input.Key)
+	cp, err := u.loadCheckpoint(bucket, key)
+	if err != nil {
+		return checkpoint{}, err
+	}
+	sameFile := cp.Size == info.Size() && cp.ModTime.Equal(info.ModTime()) && cp.PartSize == u.partSize
+	sameOptions := cp.ChecksumAlgorithm == input.ChecksumAlgorithm && cp.Encryption == uploadEncryption(input)
+	if cp.UploadId != "" && sameFile && sameOptions {
+		return cp, nil
+	}
+	if cp.UploadId != "" {
+		slog.Info("File " + key + ", part size, checksum or encryption changed since its upload was interrupted, starting over")
+		_, err = u.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   input.Bucket,
+			Key:      input.Key,
+			UploadId: aws.String(cp.UploadId),
+		})
+		var noSuchUpload *types.NoSuchUpload
+		if err != nil && !errors.As(err, &noSuchUpload) {
+			return checkpoint{}, err
+		}
+	}
+
+	createOutput, err := u.client.CreateMultipartUpload(ctx, createMultipartUploadInput(input))
+	if err != nil {
+		return checkpoint{}, err
+	}
+	cp = checkpoint{
+		Bucket:   bucket,
+		Key:      key,
+		UploadId: aws.ToString(createOutput.UploadId),
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		PartSize: u.partSize,
+		Parts:    []completedPart{},
+
+		ChecksumAlgorithm: input.ChecksumAlgorithm,
+		Encryption:        uploadEncryption(input),
+	}
+
+	return cp, u.saveCheckpoint(cp)
+}
+
+// uploadEncryption sums up encryption upload asks for, SSE-C key is represented by its MD5
+func uploadEncryption(input *s3.PutObjectInput) string {
+	parts := []string{string(input.ServerSideEncryption), aws.ToString(input.SSEKMSKeyId), aws.ToString(input.SSECustomerKeyMD5)}
+	if aws.ToBool(input.BucketKeyEnabled) {
+		parts = append(parts, "bucket-key")
+	}
+
+	return strings.TrimRight(strings.Join(parts, "/"), "/")
+}
+
+// createMultipartUploadInput carries headers, metadata, tags, encryption and checksum of upload over
+func createMultipartUploadInput(input *s3.PutObjectInput) *s3.CreateMultipartUploadInput {
+	return &s3.CreateMultipartUploadInput{
+		Bucket:               input.Bucket,
+		Key:                  input.Key,
+		CacheControl:         input.CacheControl,
+		ContentDisposition:   input.ContentDisposition,
+		ContentType:          input.ContentType,
+		Metadata:             input.Metadata,
+		Tagging:              input.Tagging,
+		ServerSideEncryption: input.ServerSideEncryption,
+		SSEKMSKeyId:          input.SSEKMSKeyId,
+		BucketKeyEnabled:     input.BucketKeyEnabled,
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+		SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+		ChecksumAlgorithm:    input.ChecksumAlgorithm,
+	}
+}
+
+func partChecksum(output *s3.UploadPartOutput) (types.ChecksumAlgorithm, string) {
+	switch {
+	case output.ChecksumSHA256 != nil:
+		return types.ChecksumAlgorithmSha256, *output.ChecksumSHA256
+	case output.ChecksumCRC32C != nil:
+		return types.ChecksumAlgorithmCrc32c, *output.ChecksumCRC32C
+	case output.ChecksumSHA1 != nil:
+		return types.ChecksumAlgorithmSha1, *output.ChecksumSHA1
+	case output.ChecksumCRC32 != nil:
+		return types.ChecksumAlgorithmCrc32, *output.ChecksumCRC32
+	}
+
+	return "", ""
+}
+
+func completedPartOf(part completedPart, algorithm types.ChecksumAlgorithm) types.CompletedPart {
+	completed := types.CompletedPart{PartNumber: aws.Int32(part.PartNumber), ETag: aws.String(part.ETag)}
+	if part.Checksum == "" {
+		return completed
+	}
+
+	switch algorithm {
+	case types.ChecksumAlgorithmSha256:
+		completed.ChecksumSHA256 = aws.String(part.Checksum)
+	case types.ChecksumAlgorithmCrc32c:
+		completed.ChecksumCRC32C = aws.String(part.Checksum)
+	case types.ChecksumAlgorithmSha1:
+		completed.ChecksumSHA1 = aws.String(part.Checksum)
+	case types.ChecksumAlgorithmCrc32:
+		completed.ChecksumCRC32 = aws.String(part.Checksum)
+	}
+
+	return completed
+}
+
+func partCount(size int64, partSize int64) int64 {
+	return (size + partSize - 1) / partSize
+}
+
+// checkpointPath is named by hash of bucket and key, keys may have any characters
+func (u *resumableUploader) checkpointPath(bucket string, key string) string {
+	sum := sha256.Sum256([]byte(bucket + "/" + key))
+	return filepath.Join(u.checkpointDir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// loadCheckpoint returns empty checkpoint if there's none
+func (u *resumableUploader) loadCheckpoint(bucket string, key string) (checkpoint, error) {
+	cp := checkpoint{}
+	content, err := os.ReadFile(u.checkpointPath(bucket, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+
+	err = json.Unmarshal(content, &cp)
+	if err != nil || cp.Bucket != bucket || cp.Key != key {
+		slog.Warn("Ignoring unreadable checkpoint of " + key)
+		return checkpoint{}, nil
+	}
+
+	return cp, nil
+}
+
+// saveCheckpoint replaces checkpoint file at once, so a crash never leaves half of it
+func (u *resumableUploader) saveCheckpoint(cp checkpoint) error {
+	err := os.MkdirAll(u.checkpointDir, 0700)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := u.checkpointPath(cp.Bucket, cp.Key)
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, content, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// eachMultipartUpload calls fn for every incomplete multipart upload under prefix page by page, till fn returns false
+func eachMultipartUpload(ctx context.Context, client multipartClient, bucket string, prefix string, fn func(types.MultipartUpload) bool) error {
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	for {
+		page, err := client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			return err
+		}
+
+		for _, upload := range page.Uploads {
+			if !fn(upload) {
+				return nil
+			}
+		}
+		if !aws.ToBool(page.IsTruncated) {
+			return nil
+		}
+		input.KeyMarker, input.UploadIdMarker = page.NextKeyMarker, page.NextUploadIdMarker
+	}
+}
+
+// staleUpload is incomplete multipart upload cleanup aborts
+type staleUpload struct {
+	key       string
+	uploadId  string
+	initiated time.Time
+	err       error
+}
+
+// cleanupUploads aborts multipart uploads under prefix started before olderThan ago, dry run only lists them
+func cleanupUploads(ctx context.Context, client multipartClient, bucket string, prefix string, olderThan time.Duration, now time.Time, dryRun bool) ([]staleUpload, error) {
+	stale := []staleUpload{}
+	err := eachMultipartUpload(ctx, client, bucket, prefix, func(upload types.MultipartUpload) bool {
+		initiated := aws.ToTime(upload.Initiated)
+		if now.Sub(initiated) >= olderThan {
+			stale = append(stale, staleUpload{key: aws.ToString(upload.Key), uploadId: aws.ToString(upload.UploadId), initiated: initiated})
+		}
+		return true
+	})
+	if err != nil || dryRun {
+		return stale, err
+	}
+
+	for index := range stale {
+		_, stale[index].err = client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(stale[index].key),
+			UploadId: aws.String(stale[index].uploadId),
+		})
+	}
+
+	return stale, nil
+}
+
+func printStaleUploads(w io.Writer, stale []staleUpload, dryRun bool) {
+	action := "Aborted"
+	if dryRun {
+		action = "Would abort"
+	}
+
+	aborted := 0
+	for _, upload := range stale {
+		if upload.err != nil {
+			fmt.Fprintln(w, "Failed: "+upload.key+" ("+upload.uploadId+"): "+upload.err.Error())
+			continue
+		}
+		aborted++
+		fmt.Fprintln(w, action+": "+upload.key+" started "+upload.initiated.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintln(w, strconv.Itoa(aborted)+" stale multipart uploads")
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type fakeMultipartUpload struct {
+	key       string
+	input     *s3.CreateMultipartUploadInput
+	initiated time.Time
+	parts     map[int32][]byte
+}
+
+// fakeMultipart adds multipart uploads to fakeBucket, completed upload becomes an object,
+// UploadPart of failPart fails like a dropped connection
+type fakeMultipart struct {
+	*fakeBucket
+	failPart int32
+	uploads  map[string]*fakeMultipartUpload
+	nextId   int
+	// part numbers uploaded, in order
+	uploadedParts []int32
+}
+
+func newFakeMultipart(partSize int64) *fakeMultipart {
+	bucket := newFakeBucket()
+	bucket.partSize = partSize
+	return &fakeMultipart{fakeBucket: bucket, uploads: map[string]*fakeMultipartUpload{}}
+}
+
+func (m *fakeMultipart) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	m.nextId++
+	uploadId := "upload-" + strconv.Itoa(m.nextId)
+	m.uploads[uploadId] = &fakeMultipartUpload{key: aws.ToString(params.Key), input: params, initiated: time.Now(), parts: map[int32][]byte{}}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(uploadId)}, nil
+}
+
+func (m *fakeMultipart) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	upload, found := m.uploads[aws.ToString(params.UploadId)]
+	if !found {
+		return nil, &types.NoSuchUpload{}
+	}
+	if params.ChecksumAlgorithm != upload.input.ChecksumAlgorithm {
+		return nil, errors.New("checksum algorithm differs from the upload's one")
+	}
+	partNumber := aws.ToInt32(params.PartNumber)
+	if partNumber == m.failPart {
+		return nil, errors.New("connection reset")
+	}
+
+	body := new(bytes.Buffer)
+	_, err := body.ReadFrom(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	upload.parts[partNumber] = body.Bytes()
+	m.uploadedParts = append(m.uploadedParts, partNumber)
+	output := &s3.UploadPartOutput{ETag: aws.String(`"etag-` + strconv.Itoa(int(partNumber)) + `"`)}
+	if params.ChecksumAlgorithm == types.ChecksumAlgorithmSha256 {
+		output.ChecksumSHA256 = aws.String("sum-" + strconv.Itoa(int(partNumber)))
+	}
+	return output, nil
+}
+
+func (m *fakeMultipart) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	upload, found := m.uploads[aws.ToString(params.UploadId)]
+	if !found {
+		return nil, &types.NoSuchUpload{}
+	}
+
+	body := []byte{}
+	for index, part := range params.MultipartUpload.Parts {
+		partNumber := aws.ToInt32(part.PartNumber)
+		checksumMissing := upload.input.ChecksumAlgorithm == types.ChecksumAlgorithmSha256 && aws.ToString(part.ChecksumSHA256) != "sum-"+strconv.Itoa(int(partNumber))
+		if partNumber != int32(index+1) || checksumMissing {
+			return nil, errors.New("invalid part " + strconv.Itoa(int(partNumber)))
+		}
+		body = append(body, upload.parts[partNumber]...)
+	}
+	m.putObject(upload.key, fakeObject{body: body, metadata: upload.input.Metadata, sse: upload.input.ServerSideEncryption, checksumAlgorithm: upload.input.ChecksumAlgorithm})
+	delete(m.uploads, aws.ToString(params.UploadId))
+	return &s3.CompleteMultipartUploadOutput{Key: params.Key}, nil
+}
+
+func (m *fakeMultipart) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	if _, found := m.uploads[aws.ToString(params.UploadId)]; !found {
+		return nil, &types.NoSuchUpload{}
+	}
+	delete(m.uploads, aws.ToString(params.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+// ListMultipartUploads returns an upload per page, ordered by id
+func (m *fakeMultipart) ListMultipartUploads(ctx context.Context, params *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	ids := []string{}
+	for id, upload := range m.uploads {
+		if strings.HasPrefix(upload.key, aws.ToString(params.Prefix)) && id > aws.ToString(params.UploadIdMarker) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	output := &s3.ListMultipartUploadsOutput{IsTruncated: aws.Bool(len(ids) > 1)}
+	if len(ids) > 0 {
+		upload := m.uploads[ids[0]]
+		output.Uploads = []types.MultipartUpload{{Key: aws.String(upload.key), UploadId: aws.String(ids[0]), Initiated: aws.Time(upload.initiated)}}
+		output.NextKeyMarker, output.NextUploadIdMarker = aws.String(upload.key), aws.String(ids[0])
+	}
+	return output, nil
+}
+
+func writeTestFile(t *testing.T, path string, size int) []byte {
+	t.Helper()
+	content := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+	err := os.WriteFile(path, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestResumableUpload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "big.bin")
+	content := writeTestFile(t, path, 3500)
+
+	client := newFakeMultipart(1024)
+	client.failPart = 3
+	uploader := &resumableUploader{client: client, fallback: client, partSize: 1024, checkpointDir: filepath.Join(dir, "checkpoints")}
+	file := localFile{path: path, rel: "big.bin"}
+
+	result := uploadOne(context.Background(), uploader, defaultBucketName, "reports/big.bin", file, uploadHeaders{}, withChecksum(types.ChecksumAlgorithmSha256))
+	if result.err == nil {
+		t.Fatal("expected interrupted upload to fail")
+	}
+	cp, err := uploader.loadCheckpoint(defaultBucketName, "reports/big.bin")
+	if err != nil || len(cp.Parts) != 2 {
+		t.Fatalf("expected checkpoint with 2 parts, got %v, %v", cp, err)
+	}
+
+	client.failPart = 0
+	result = uploadOne(context.Background(), uploader, defaultBucketName, "reports/big.bin", file, uploadHeaders{}, withChecksum(types.ChecksumAlgorithmSha256))
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	if !slices.Equal(client.uploadedParts, []int32{1, 2, 3, 4}) {
+		t.Errorf("expected every part uploaded once, got %v", client.uploadedParts)
+	}
+	if !bytes.Equal(client.objects["reports/big.bin"].body, content) {
+		t.Error("uploaded object differs from the file")
+	}
+	if client.objects["reports/big.bin"].metadata[mtimeMetadataKey] == "" {
+		t.Error("expected mtime metadata carried to multipart upload")
+	}
+	if _, err := os.Stat(uploader.checkpointPath(defaultBucketName, "reports/big.bin")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected checkpoint removed after upload, got %v", err)
+	}
+	if len(client.uploads) != 0 {
+		t.Errorf("expected no incomplete uploads, got %d", len(client.uploads))
+	}
+}
+
+func TestResumableUploadRestarts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "big.bin")
+	writeTestFile(t, path, 3000)
+
+	client := newFakeMultipart(1024)
+	client.failPart = 2
+	uploader := &resumableUploader{client: client, fallback: client, partSize: 1024, checkpointDir: filepath.Join(dir, "checkpoints")}
+	file := localFile{path: path, rel: "big.bin"}
+
+	result := uploadOne(context.Background(), uploader, defaultBucketName, "big.bin", file, uploadHeaders{})
+	if result.err == nil {
+		t.Fatal("expected interrupted upload to fail")
+	}
+
+	// changed file can't reuse uploaded parts, its upload is aborted
+	content := writeTestFile(t, path, 2500)
+	client.failPart = 0
+	client.uploadedParts = nil
+	result = uploadOne(context.Background(), uploader, defaultBucketName, "big.bin", file, uploadHeaders{})
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	if !slices.Equal(client.uploadedParts, []int32{1, 2, 3}) || !bytes.Equal(client.objects["big.bin"].body, content) {
+		t.Errorf("expected changed file uploaded from the start, got parts %v", client.uploadedParts)
+	}
+	if len(client.uploads) != 0 {
+		t.Errorf("expected stale upload aborted, got %d incomplete", len(client.uploads))
+	}
+
+	// upload gone from the bucket is started over
+	client.failPart = 3
+	client.uploadedParts = nil
+	writeTestFile(t, path, 3000)
+	uploadOne(context.Background(), uploader, defaultBucketName, "big.bin", file, uploadHeaders{})
+	clear(client.uploads)
+	client.failPart = 0
+	client.uploadedParts = nil
+	result = uploadOne(context.Background(), uploader, defaultBucketName, "big.bin", file, uploadHeaders{})
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	if !slices.Equal(client.uploadedParts, []int32{1, 2, 3}) {
+		t.Errorf("expected upload started over, got parts %v", client.uploadedParts)
+	}
+}
+
+// parts have to be sent with checksum and encryption the upload was created with, so changing them starts over
+func TestResumableUploadOptionsChange(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "big.bin")
+	content := writeTestFile(t, path, 3000)
+	file := localFile{path: path, rel: "big.bin"}
+
+	client := newFakeMultipart(1024)
+	uploader := &resumableUploader{client: client, fallback: client, partSize: 1024, checkpointDir: filepath.Join(dir, "checkpoints")}
+	runs := []struct {
+		name   string
+		optFns []func(*s3.PutObjectInput)
+	}{
+		{"sha256", []func(*s3.PutObjectInput){withChecksum(types.ChecksumAlgorithmSha256)}},
+		{"no checksum", nil},
+		{"sse-s3", []func(*s3.PutObjectInput){withEncryption(encryptionOptions{mode: sseS3})}},
+	}
+	for _, run := range runs {
+		client.failPart = 2
+		client.uploadedParts = nil
+		result := uploadOne(context.Background(), uploader, defaultBucketName, "big.bin", file, uploadHeaders{}, run.optFns...)
+		if result.err == nil {
+			t.Fatalf("%s: expected interrupted upload to fail", run.name)
+		}
+		if !slices.Equal(client.uploadedParts, []int32{1}) || len(client.uploads) != 1 {
+			t.Errorf("%s: expected upload started over and previous one aborted, got parts %v, %d uploads", run.name, client.uploadedParts, len(client.uploads))
+		}
+	}
+
+	client.failPart = 0
+	result := uploadOne(context.Background(), uploader, defaultBucketName, "big.bin", file, uploadHeaders{}, runs[2].optFns...)
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	object := client.objects["big.bin"]
+	if !bytes.Equal(object.body, content) || object.sse != types.ServerSideEncryptionAes256 {
+		t.Errorf("expected object encrypted as the last run asked, got %q", object.sse)
+	}
+}
+
+func TestResumableUploadSmallFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "small.txt")
+	writeTestFile(t, path, 100)
+
+	client := newFakeMultipart(1024)
+	uploader := &resumableUploader{client: client, fallback: client, partSize: 1024, checkpointDir: filepath.Join(dir, "checkpoints")}
+	result := uploadOne(context.Background(), uploader, defaultBucketName, "small.txt", localFile{path: path, rel: "small.txt"}, uploadHeaders{})
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	if len(client.uploadedParts) != 0 || !slices.Equal(client.sortedCalls(), []string{"Upload small.txt"}) {
+		t.Errorf("expected small file uploaded by fallback, got parts %v", client.uploadedParts)
+	}
+}
+
+func TestCleanupUploads(t *testing.T) {
+	client := newFakeMultipart(manager.DefaultUploadPartSize)
+	now := time.Now()
+	for _, key := range []string{"reports/old.bin", "reports/new.bin", "other/old.bin"} {
+		client.CreateMultipartUpload(context.Background(), &s3.CreateMultipartUploadInput{Key: aws.String(key)})
+	}
+	for _, upload := range client.uploads {
+		if strings.HasSuffix(upload.key, "old.bin") {
+			upload.initiated = now.Add(-48 * time.Hour)
+		}
+	}
+
+	stale, err := cleanupUploads(context.Background(), client, defaultBucketName, "reports/", 24*time.Hour, now, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 1 || stale[0].key != "reports/old.bin" || len(client.uploads) != 3 {
+		t.Fatalf("expected dry run to find reports/old.bin only and abort nothing, got %v", stale)
+	}
+
+	stale, err = cleanupUploads(context.Background(), client, defaultBucketName, "reports/", 24*time.Hour, now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 1 || stale[0].err != nil || len(client.uploads) != 2 {
+		t.Fatalf("expected reports/old.bin aborted, got %v", stale)
+	}
+
+	output := new(bytes.Buffer)
+	printStaleUploads(output, stale, false)
+	if !strings.Contains(output.String(), "Aborted: reports/old.bin") || !strings.Contains(output.String(), "1 stale multipart uploads") {
+		t.Errorf("unexpected output: %s", output.String())
+	}
+}
@@ -2,19 +2,24 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"io"
 	"os"
+	"path/filepath"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
 type s3Client interface {
 	ListBuckets(ctx context.Context, params *s3.ListBucketsInput, optFns ...func(*s3.Options)) (*s3.ListBucketsOutput, error)
 	CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error)
-	ListObjects(ctx context.Context, params *s3.ListObjectsInput, optFns ...func(*s3.Options)) (*s3.ListObjectsOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
 }
 
 type s3Uploader interface {
@@ -25,26 +30,27 @@ type s3Downloader interface {
 	Download(ctx context.Context, w io.WriterAt, input *s3.GetObjectInput, options ...func(*manager.Downloader)) (n int64, err error)
 }
 
-func lookupBucket(ctx context.Context, s3Client s3Client) (bool, error) {
-	bucketsList, err := s3Client.ListBuckets(ctx, &s3.ListBucketsInput{})
-	if err != nil {
-		return false, err
-	}
+func lookupBucket(ctx context.Context, s3Client s3Client, bucket string) (bool, error) {
+	paginator := s3.NewListBucketsPaginator(s3Client, &s3.ListBucketsInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return false, err
+		}
 
-	bucketFound := false
-	for _, bucket := range bucketsList.Buckets {
-		if *bucket.Name == bucketName {
-			bucketFound = true
-			break
+		for _, b := range page.Buckets {
+			if aws.ToString(b.Name) == bucket {
+				return true, nil
+			}
 		}
 	}
 
-	return bucketFound, nil
+	return false, nil
 }
 
-func createBucket(ctx context.Context, s3Client s3Client) (*s3.CreateBucketOutput, error) {
+func createBucket(ctx context.Context, s3Client s3Client, bucket string) (*s3.CreateBucketOutput, error) {
 	bucketCreatedOutput, err := s3Client.CreateBucket(ctx, &s3.CreateBucketInput{
-		Bucket: aws.String(bucketName),
+		Bucket: aws.String(bucket),
 	})
 	if err != nil {
 		return nil, err
@@ -53,32 +59,88 @@ func createBucket(ctx context.Context, s3Client s3Client) (*s3.CreateBucketOutpu
 	return bucketCreatedOutput, nil
 }
 
-func lookupObject(ctx context.Context, s3Client s3Client, download string) (bool, error) {
-	objectsList, err := s3Client.ListObjects(ctx, &s3.ListObjectsInput{
-		Bucket: aws.String(bucketName),
-		Prefix: aws.String(uploadToDir),
-	})
+// objectNotFoundError is returned by headObject when there's no object under key
+type objectNotFoundError struct {
+	bucket string
+	key    string
+}
+
+func (e *objectNotFoundError) Error() string {
+	return "object " + e.key + " wasn't found in " + e.bucket + " bucket"
+}
+
+// headObject reads object metadata, missing object is reported as *objectNotFoundError
+func headObject(ctx context.Context, s3Client s3Client, bucket string, key string, optFns ...func(*s3.HeadObjectInput)) (*s3.HeadObjectOutput, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	for _, fn := range optFns {
+		fn(input)
+	}
+
+	headOutput, err := s3Client.HeadObject(ctx, input)
+
+	// HEAD responses have no body, so a missing object comes as bare NotFound code
+	var notFound *types.NotFound
+	var apiErr smithy.APIError
+	if errors.As(err, &notFound) || (errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey")) {
+		return nil, &objectNotFoundError{bucket: bucket, key: key}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return headOutput, nil
+}
+
+func lookupObject(ctx context.Context, s3Client s3Client, bucket string, key string, optFns ...func(*s3.HeadObjectInput)) (bool, error) {
+	_, err := headObject(ctx, s3Client, bucket, key, optFns...)
+	var notFound *objectNotFoundError
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
 	if err != nil {
 		return false, err
 	}
 
-	objectFound := false
-	for _, object := range objectsList.Contents {
-		if *object.Key == fmt.Sprintf("%s/%s", uploadToDir, download) {
-			objectFound = true
-			break
+	return true, nil
+}
+
+// eachObject calls fn for every object under prefix page by page, till fn returns false
+func eachObject(ctx context.Context, s3Client s3Client, bucket string, prefix string, fn func(types.Object) bool) error {
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, object := range page.Contents {
+			if !fn(object) {
+				return nil
+			}
 		}
 	}
 
-	return objectFound, nil
+	return nil
 }
 
-func uploadFiles(ctx context.Context, s3Uploader s3Uploader, file string, readFile *os.File) (*manager.UploadOutput, error) {
-	uploadOutput, err := s3Uploader.Upload(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(fmt.Sprintf("%s/%s", uploadToDir, file)),
+// uploadFiles uploads readFile as key, optFns add metadata and the like to the request
+func uploadFiles(ctx context.Context, s3Uploader s3Uploader, bucket string, key string, readFile *os.File, optFns ...func(*s3.PutObjectInput)) (*manager.UploadOutput, error) {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
 		Body:   readFile,
-	})
+	}
+	for _, fn := range optFns {
+		fn(input)
+	}
+
+	uploadOutput, err := s3Uploader.Upload(ctx, input)
 	if err != nil {
 		return nil, err
 	}
@@ -86,11 +148,30 @@ func uploadFiles(ctx context.Context, s3Uploader s3Uploader, file string, readFi
 	return uploadOutput, nil
 }
 
-func downloadFile(ctx context.Context, s3Downloader s3Downloader, newFile *os.File, download string) (int64, error) {
-	numBytesDownloaded, err := s3Downloader.Download(ctx, newFile, &s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(fmt.Sprintf("%s/%s", uploadToDir, download)),
-	})
+// createLocalFile creates file object with relative key rel is downloaded to under dir, with its folders
+func createLocalFile(dir string, rel string) (*os.File, error) {
+	path, err := localPath(dir, rel)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Create(path)
+}
+
+func downloadFile(ctx context.Context, s3Downloader s3Downloader, newFile *os.File, bucket string, key string, optFns ...func(*s3.GetObjectInput)) (int64, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	for _, fn := range optFns {
+		fn(input)
+	}
+
+	numBytesDownloaded, err := s3Downloader.Download(ctx, newFile, input)
 	if err != nil {
 		return 0, err
 	}
@@ -2,34 +2,82 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 	"github.com/aws/smithy-go/middleware"
 )
 
+// mockS3Client serves buckets and objects pageSize at a time, all at once if it's 0
 type mockS3Client struct {
 	listBucketsOutput  *s3.ListBucketsOutput
 	createBucketOutput *s3.CreateBucketOutput
-	listObjectsOutput  *s3.ListObjectsOutput
+	objects            []types.Object
+	pageSize           int
+	// number of list calls made
+	listCalls int
+}
+
+// page cuts items from continuation token to pageSize further, next token is empty on the last page
+func page[T any](items []T, token *string, pageSize int) ([]T, *string) {
+	start, _ := strconv.Atoi(aws.ToString(token))
+	end := len(items)
+	if pageSize > 0 && start+pageSize < end {
+		end = start + pageSize
+	}
+	if end == len(items) {
+		return items[start:end], nil
+	}
+
+	return items[start:end], aws.String(strconv.Itoa(end))
 }
 
 func (m *mockS3Client) ListBuckets(ctx context.Context, params *s3.ListBucketsInput, optFns ...func(*s3.Options)) (*s3.ListBucketsOutput, error) {
-	return m.listBucketsOutput, nil
+	m.listCalls++
+	buckets, next := page(m.listBucketsOutput.Buckets, params.ContinuationToken, m.pageSize)
+	return &s3.ListBucketsOutput{Buckets: buckets, ContinuationToken: next}, nil
 }
 
 func (m *mockS3Client) CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
 	return m.createBucketOutput, nil
 }
 
-func (m *mockS3Client) ListObjects(ctx context.Context, params *s3.ListObjectsInput, optFns ...func(*s3.Options)) (*s3.ListObjectsOutput, error) {
-	return m.listObjectsOutput, nil
+func (m *mockS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	m.listCalls++
+	matching := []types.Object{}
+	for _, object := range m.objects {
+		if strings.HasPrefix(aws.ToString(object.Key), aws.ToString(params.Prefix)) {
+			matching = append(matching, object)
+		}
+	}
+
+	contents, next := page(matching, params.ContinuationToken, m.pageSize)
+	return &s3.ListObjectsV2Output{Contents: contents, IsTruncated: aws.Bool(next != nil), NextContinuationToken: next}, nil
+}
+
+func (m *mockS3Client) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	for _, object := range m.objects {
+		if aws.ToString(object.Key) == aws.ToString(params.Key) {
+			return &s3.HeadObjectOutput{ContentLength: object.Size, ETag: object.ETag}, nil
+		}
+	}
+
+	return nil, &smithy.GenericAPIError{Code: "NotFound", Message: "Not Found"}
+}
+
+func (m *mockS3Client) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	return &s3.DeleteObjectOutput{}, nil
 }
 
 type mockS3Uploader struct {
@@ -54,13 +102,13 @@ func TestLookupBucket(t *testing.T) {
 		listBucketsOutput: &s3.ListBucketsOutput{
 			Buckets: []types.Bucket{
 				{
-					Name: aws.String(bucketName),
+					Name: aws.String(defaultBucketName),
 				},
 			},
 		},
 	}
 
-	bucketFound, err := lookupBucket(ctx, s3Client)
+	bucketFound, err := lookupBucket(ctx, s3Client, defaultBucketName)
 	if err != nil {
 		t.Error("Error looking up bucket: " + err.Error())
 	}
@@ -78,7 +126,7 @@ func TestCreateBucket(t *testing.T) {
 		},
 	}
 
-	_, err := createBucket(ctx, s3Client)
+	_, err := createBucket(ctx, s3Client, defaultBucketName)
 	if err != nil {
 		t.Error("Error creating bucket: " + err.Error())
 	}
@@ -89,33 +137,111 @@ func TestLookupObject(t *testing.T) {
 
 	ctx := context.TODO()
 	s3Client := &mockS3Client{
-		listObjectsOutput: &s3.ListObjectsOutput{
-			Contents: []types.Object{
-				{
-					Key: aws.String(fmt.Sprintf("%s/%s", uploadToDir, download)),
-				},
+		objects: []types.Object{
+			{
+				Key: aws.String(fmt.Sprintf("%s/%s", defaultUploadToDir, download)),
 			},
 		},
 	}
 
-	objectFound, err := lookupObject(ctx, s3Client, download)
+	objectFound, err := lookupObject(ctx, s3Client, defaultBucketName, objectKey(defaultUploadToDir, download))
 	if err != nil {
-		t.Error("Error listing objects: " + err.Error())
+		t.Error("Error looking up object: " + err.Error())
 	}
 
 	if !objectFound {
-		t.Errorf("Objects %s wasn't found in %s bucket, expected to be true", download, bucketName)
+		t.Errorf("Objects %s wasn't found in %s bucket, expected to be true", download, defaultBucketName)
+	}
+}
+
+func TestLookupObjectMissing(t *testing.T) {
+	s3Client := &mockS3Client{objects: []types.Object{{Key: aws.String("reports/a.txt")}}}
+
+	objectFound, err := lookupObject(context.TODO(), s3Client, defaultBucketName, "reports/b.txt")
+	if err != nil || objectFound {
+		t.Errorf("objectFound is %v (%v), expected false without error", objectFound, err)
+	}
+
+	_, err = headObject(context.TODO(), s3Client, defaultBucketName, "reports/b.txt")
+	var notFound *objectNotFoundError
+	if !errors.As(err, &notFound) || notFound.key != "reports/b.txt" {
+		t.Errorf("err is %v, expected objectNotFoundError", err)
+	}
+
+	_, err = headObject(context.TODO(), &failingHeadS3Client{err: &types.NotFound{}}, defaultBucketName, "reports/b.txt")
+	if !errors.As(err, &notFound) {
+		t.Errorf("typed NotFound should be mapped too, err is %v", err)
+	}
+
+	denied := &smithy.GenericAPIError{Code: "Forbidden"}
+	_, err = headObject(context.TODO(), &failingHeadS3Client{err: denied}, defaultBucketName, "reports/b.txt")
+	if !errors.Is(err, denied) {
+		t.Errorf("other errors should be returned as is, err is %v", err)
+	}
+}
+
+type failingHeadS3Client struct {
+	mockS3Client
+	err error
+}
+
+func (m *failingHeadS3Client) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	return nil, m.err
+}
+
+func TestLookupBucketPages(t *testing.T) {
+	buckets := []types.Bucket{}
+	for i := range 5 {
+		buckets = append(buckets, types.Bucket{Name: aws.String(fmt.Sprintf("bucket-%d", i))})
+	}
+	s3Client := &mockS3Client{listBucketsOutput: &s3.ListBucketsOutput{Buckets: buckets}, pageSize: 2}
+
+	bucketFound, err := lookupBucket(context.TODO(), s3Client, "bucket-4")
+	if err != nil || !bucketFound {
+		t.Errorf("bucket on the last page should be found, got %v (%v)", bucketFound, err)
+	}
+	if s3Client.listCalls != 3 {
+		t.Errorf("%d pages listed, expected 3", s3Client.listCalls)
+	}
+}
+
+func TestEachObjectPages(t *testing.T) {
+	s3Client := &mockS3Client{pageSize: 3}
+	for i := range 8 {
+		s3Client.objects = append(s3Client.objects, types.Object{Key: aws.String(fmt.Sprintf("reports/%d.txt", i))})
+	}
+	s3Client.objects = append(s3Client.objects, types.Object{Key: aws.String("other/x.txt")})
+
+	keys := []string{}
+	err := eachObject(context.TODO(), s3Client, defaultBucketName, "reports/", func(object types.Object) bool {
+		keys = append(keys, aws.ToString(object.Key))
+		return true
+	})
+	if err != nil {
+		t.Fatal("Error listing objects: " + err.Error())
+	}
+	if len(keys) != 8 || keys[7] != "reports/7.txt" || s3Client.listCalls != 3 {
+		t.Errorf("expected 8 keys from 3 pages, got %v from %d", keys, s3Client.listCalls)
+	}
+
+	// stopping early leaves further pages unread
+	s3Client.listCalls = 0
+	err = eachObject(context.TODO(), s3Client, defaultBucketName, "reports/", func(object types.Object) bool {
+		return aws.ToString(object.Key) != "reports/1.txt"
+	})
+	if err != nil || s3Client.listCalls != 1 {
+		t.Errorf("expected 1 page listed, got %d (%v)", s3Client.listCalls, err)
 	}
 }
 
 func TestUploadFiles(t *testing.T) {
 	var mockFile string = "75e21680-2ad7-4203-96bf-bf68906a088a.txt"
-	err := os.WriteFile(fmt.Sprintf("%s/%s", filesDir, mockFile), []byte(mockFile), 0700)
+	err := os.WriteFile(fmt.Sprintf("%s/%s", defaultFilesDir, mockFile), []byte(mockFile), 0700)
 	if err != nil {
 		t.Error("Error creating test file: " + err.Error())
 	}
 
-	readFile, err := os.Open(fmt.Sprintf("%s/%s", filesDir, mockFile))
+	readFile, err := os.Open(fmt.Sprintf("%s/%s", defaultFilesDir, mockFile))
 	if err != nil {
 		t.Error("Error reading file " + mockFile + ": " + err.Error())
 	}
@@ -127,7 +253,7 @@ func TestUploadFiles(t *testing.T) {
 			Key: aws.String(mockFile),
 		},
 	}
-	uploadOutput, err := uploadFiles(ctx, s3Uploader, mockFile, readFile)
+	uploadOutput, err := uploadFiles(ctx, s3Uploader, defaultBucketName, objectKey(defaultUploadToDir, mockFile), readFile)
 	if err != nil {
 		t.Error("Error uploading file " + mockFile + ": " + err.Error())
 	}
@@ -137,6 +263,26 @@ func TestUploadFiles(t *testing.T) {
 	}
 }
 
+func TestCreateLocalFile(t *testing.T) {
+	dir := t.TempDir()
+	newFile, err := createLocalFile(dir, "2024/q1/report.txt")
+	if err != nil {
+		t.Fatal("Error creating local file: " + err.Error())
+	}
+	newFile.Close()
+	if newFile.Name() != filepath.Join(dir, "2024", "q1", "report.txt") {
+		t.Errorf("file is %s", newFile.Name())
+	}
+
+	// folder can't be made where a file is
+	if _, err := createLocalFile(dir, "2024/q1/report.txt/copy.txt"); err == nil {
+		t.Error("file under a file shouldn't be created")
+	}
+	if _, err := createLocalFile(dir, "../report.txt"); err == nil {
+		t.Error("file outside of dir shouldn't be created")
+	}
+}
+
 func TestDownloadFile(t *testing.T) {
 	var download string = "95124219-1ab2-4939-9bc1-cad22d413076.txt"
 
@@ -145,13 +291,13 @@ func TestDownloadFile(t *testing.T) {
 		numBytesDownloaded: 1048576,
 	}
 
-	newFile, err := os.Create(fmt.Sprintf("downloads/%s", download))
+	newFile, err := os.Create(filepath.Join(t.TempDir(), download))
 	if err != nil {
 		t.Error("Error creating new local file: " + err.Error())
 	}
 	defer newFile.Close()
 
-	numBytesDownloaded, err := downloadFile(ctx, s3Downloader, newFile, download)
+	numBytesDownloaded, err := downloadFile(ctx, s3Downloader, newFile, defaultBucketName, objectKey(defaultUploadToDir, download))
 	if err != nil {
 		t.Error("Error downloading file: " + err.Error())
 	}
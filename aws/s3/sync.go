@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// mtimeMetadataKey is object metadata with modification time of the uploaded file
+const mtimeMetadataKey string = "mtime"
+
+const (
+	syncUp   string = "up"
+	syncDown string = "down"
+
+	compareChecksum string = "checksum"
+	compareMtime    string = "mtime"
+)
+
+type syncOptions struct {
+	dir            string
+	bucket         string
+	prefix         string
+	direction      string
+	compare        string
+	delete         bool
+	followSymlinks bool
+	concurrency    int
+	encryption     encryptionOptions
+	headers        uploadHeaders
+	checksum       types.ChecksumAlgorithm
+}
+
+// remoteObject is an object under the sync prefix, rel is its key relative to the prefix
+type remoteObject struct {
+	key          string
+	rel          string
+	size         int64
+	etag         string
+	lastModified time.Time
+}
+
+// syncAction is a planned change, upload and delete-remote act on the bucket, download and delete-local on the folder,
+// reject marks object which key can't be a local path
+type syncAction struct {
+	kind   string
+	rel    string
+	key    string
+	path   string
+	reason string
+	// modification time the downloaded file gets
+	mtime time.Time
+}
+
+// listRemote lists objects under prefix by their relative key, "folder" placeholder objects are left out
+func listRemote(ctx context.Context, s3Client s3Client, bucket string, prefix string) (map[string]remoteObject, error) {
+	listPrefix := objectKey(prefix, "")
+	objects := map[string]remoteObject{}
+	err := eachObject(ctx, s3Client, bucket, listPrefix, func(object types.Object) bool {
+		key := aws.ToString(object.Key)
+		if strings.HasSuffix(key, "/") {
+			return true
+		}
+		rel := strings.TrimPrefix(key, listPrefix)
+		objects[rel] = remoteObject{
+			key:          key,
+			rel:          rel,
+			size:         aws.ToInt64(object.Size),
+			etag:         aws.ToString(object.ETag),
+			lastModified: aws.ToTime(object.LastModified),
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+// planSync compares the folder with objects under prefix and lists what makes the target side equal to the source one
+func planSync(ctx context.Context, s3Client s3Client, opts syncOptions) ([]syncAction, error) {
+	files, err := collectFiles(opts.dir, opts.followSymlinks)
+	if errors.Is(err, fs.ErrNotExist) && opts.direction == syncDown {
+		// folder is created with the first download
+		files, err = []localFile{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing files in %s: %w", opts.dir, err)
+	}
+	remote, err := listRemote(ctx, s3Client, opts.bucket, opts.prefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing objects under %s: %w", objectKey(opts.prefix, ""), err)
+	}
+
+	local := map[string]localFile{}
+	for _, file := range files {
+		local[filepath.ToSlash(file.rel)] = file
+	}
+
+	actions := []syncAction{}
+	switch opts.direction {
+	case syncUp:
+		for _, file := range files {
+			rel := filepath.ToSlash(file.rel)
+			action := syncAction{kind: "upload", rel: rel, key: objectKey(opts.prefix, file.rel), path: file.path}
+			object, found := remote[rel]
+			if !found {
+				action.reason = "new"
+				actions = append(actions, action)
+				continue
+			}
+
+			action.reason, _, err = compareObject(ctx, s3Client, opts, file.path, object)
+			if err != nil {
+				return nil, err
+			}
+			if action.reason != "" {
+				actions = append(actions, action)
+			}
+		}
+		if opts.delete {
+			for _, object := range sortedObjects(remote) {
+				if _, found := local[object.rel]; !found {
+					actions = append(actions, syncAction{kind: "delete-remote", rel: object.rel, key: object.key, reason: "missing locally"})
+				}
+			}
+		}
+	case syncDown:
+		for _, object := range sortedObjects(remote) {
+			path, err := localPath(opts.dir, object.rel)
+			if err != nil {
+				actions = append(actions, syncAction{kind: "reject", rel: object.rel, key: object.key, reason: err.Error()})
+				continue
+			}
+			action := syncAction{kind: "download", rel: object.rel, key: object.key, path: path, mtime: object.lastModified}
+			file, found := local[object.rel]
+			if !found {
+				if opts.compare == compareMtime {
+					mtime, err := objectMtime(ctx, s3Client, opts.bucket, object.key, withCustomerKeyHead(opts.encryption))
+					if err != nil {
+						return nil, err
+					}
+					if !mtime.IsZero() {
+						action.mtime = mtime
+					}
+				}
+				action.reason = "new"
+				actions = append(actions, action)
+				continue
+			}
+
+			var mtime time.Time
+			action.reason, mtime, err = compareObject(ctx, s3Client, opts, file.path, object)
+			if err != nil {
+				return nil, err
+			}
+			if !mtime.IsZero() {
+				action.mtime = mtime
+			}
+			if action.reason != "" {
+				actions = append(actions, action)
+			}
+		}
+		if opts.delete {
+			for _, file := range files {
+				rel := filepath.ToSlash(file.rel)
+				if _, found := remote[rel]; !found {
+					actions = append(actions, syncAction{kind: "delete-local", rel: rel, path: file.path, reason: "missing in bucket"})
+				}
+			}
+		}
+	default:
+		return nil, errors.New("unknown sync direction " + opts.direction + ", expected up or down")
+	}
+
+	return actions, nil
+}
+
+// compareObject returns why local file and object differ, empty reason if they don't, and mtime kept in object's
+// metadata if it was looked at
+func compareObject(ctx context.Context, s3Client s3Client, opts syncOptions, path string, object remoteObject) (string, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if info.Size() != object.size {
+		return "size", time.Time{}, nil
+	}
+
+	if opts.compare == compareMtime {
+		mtime, err := objectMtime(ctx, s3Client, opts.bucket, object.key, withCustomerKeyHead(opts.encryption))
+		if err != nil {
+			return "", time.Time{}, err
+		}
+
+		// objects uploaded by other tools have no mtime, checksum decides for them
+		if !mtime.IsZero() {
+			if mtime.Equal(info.ModTime()) {
+				return "", mtime, nil
+			}
+			return "mtime", mtime, nil
+		}
+	}
+
+	partSize := int64(0)
+	if strings.Contains(object.etag, "-") {
+		partSize, err = firstPartSize(ctx, s3Client, opts.bucket, object.key, withCustomerKeyHead(opts.encryption))
+		if err != nil {
+			return "", time.Time{}, err
+		}
+	}
+	matches, err := matchesETag(path, info.Size(), object.etag, partSize)
+	if errors.Is(err, errNoChecksum) {
+		// content can't be compared, transferring it again is safe
+		slog.Debug(object.key + ": " + err.Error())
+		return "checksum", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if !matches {
+		return compareEncrypted(ctx, s3Client, opts, path, object)
+	}
+
+	return "", time.Time{}, nil
+}
+
+// compareEncrypted compares file with checksum of object which ETag differs, ETag of SSE-KMS and SSE-C objects isn't
+// MD5 of content, so they'd be transferred on every sync otherwise. Encrypted objects without checksum aren't compared
+func compareEncrypted(ctx context.Context, s3Client s3Client, opts syncOptions, path string, object remoteObject) (string, time.Time, error) {
+	headOutput, err := headObject(ctx, s3Client, opts.bucket, object.key, withCustomerKeyHead(opts.encryption), withChecksumMode)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if !opaqueETag(headOutput) {
+		return "checksum", time.Time{}, nil
+	}
+
+	err = matchesChecksum(ctx, s3Client, opts.bucket, object.key, path, headOutput, withCustomerKeyHead(opts.encryption))
+	switch {
+	case errors.Is(err, errNoChecksum):
+		slog.Info("Encrypted object " + object.key + " has no checksum, its content isn't compared")
+		return "", time.Time{}, nil
+	case errors.Is(err, errChecksumMismatch):
+		return "checksum", time.Time{}, nil
+	case err != nil:
+		return "", time.Time{}, err
+	}
+
+	return "", time.Time{}, nil
+}
+
+// objectMtime reads file modification time kept in object metadata, zero time if there's none
+func objectMtime(ctx context.Context, s3Client s3Client, bucket string, key string, optFns ...func(*s3.HeadObjectInput)) (time.Time, error) {
+	headOutput, err := headObject(ctx, s3Client, bucket, key, optFns...)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("reading metadata of %s: %w", key, err)
+	}
+
+	mtime, err := time.Parse(time.RFC3339Nano, headOutput.Metadata[mtimeMetadataKey])
+	if err != nil {
+		return time.Time{}, nil
+	}
+
+	return mtime, nil
+}
+
+// matchesETag tells if file content produces etag, multipart ETag is MD5 of part MD5s followed by "-<parts>",
+// partSize is size of the object's parts
+func matchesETag(path string, size int64, etag string, partSize int64) (bool, error) {
+	return matchesDigest(path, size, strings.Trim(etag, `"`), partSize, md5.New, hex.EncodeToString)
+}
+
+// localPath is where object with relative key rel goes under dir, keys escaping dir are refused,
+// backslash and colon are too, as Windows reads them as separator, drive or stream
+func localPath(dir string, rel string) (string, error) {
+	if strings.ContainsAny(rel, `\:`) {
+		return "", errors.New("key has backslash or colon")
+	}
+	if !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", errors.New("key is empty, absolute or leads outside of " + dir)
+	}
+
+	return filepath.Join(dir, filepath.FromSlash(rel)), nil
+}
+
+func sortedObjects(objects map[string]remoteObject) []remoteObject {
+	sorted := make([]remoteObject, 0, len(objects))
+	for _, object := range objects {
+		sorted = append(sorted, object)
+	}
+	slices.SortFunc(sorted, func(a, b remoteObject) int {
+		return strings.Compare(a.rel, b.rel)
+	})
+
+	return sorted
+}
+
+// applySync runs actions with concurrency workers, errors are in order of actions
+func applySync(ctx context.Context, s3Client s3Client, s3Uploader s3Uploader, s3Downloader s3Downloader, opts syncOptions, actions []syncAction) []error {
+	errs := make([]error, len(actions))
+	parallel(opts.concurrency, len(actions), func(index int) {
+		if ctx.Err() != nil {
+			errs[index] = context.Cause(ctx)
+			return
+		}
+		errs[index] = applyAction(ctx, s3Client, s3Uploader, s3Downloader, opts, actions[index])
+	})
+
+	return errs
+}
+
+func applyAction(ctx context.Context, s3Client s3Client, s3Uploader s3Uploader, s3Downloader s3Downloader, opts syncOptions, action syncAction) error {
+	switch action.kind {
+	case "upload":
+		result := uploadOne(ctx, s3Uploader, opts.bucket, action.key, localFile{path: action.path, rel: action.rel}, opts.headers, withEncryption(opts.encryption), withChecksum(opts.checksum))
+		return result.err
+	case "download":
+		return downloadTo(ctx, s3Client, s3Downloader, opts.bucket, action.key, action.path, action.mtime, opts.encryption)
+	case "delete-remote":
+		_, err := s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(opts.bucket),
+			Key:    aws.String(action.key),
+		})
+		return err
+	case "delete-local":
+		return os.Remove(action.path)
+	case "reject":
+		return errors.New("key rejected, " + action.reason)
+	}
+
+	return errors.New("unknown sync action " + action.kind)
+}
+
+// downloadTo downloads key next to path and moves it in place when complete and matching object's checksum,
+// so partial or corrupt download never replaces the file, mtime is set so the next sync sees the file unchanged
+func downloadTo(ctx context.Context, s3Client s3Client, s3Downloader s3Downloader, bucket string, key string, path string, mtime time.Time, encryption encryptionOptions) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	newFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = downloadFile(ctx, s3Downloader, newFile, bucket, key, withCustomerKey(encryption))
+	err = errors.Join(err, newFile.Close())
+	if err == nil {
+		err = verifyDownload(ctx, s3Client, bucket, key, newFile.Name(), encryption)
+	}
+	if err == nil && !mtime.IsZero() {
+		err = os.Chtimes(newFile.Name(), mtime, mtime)
+	}
+	if err == nil {
+		err = os.Rename(newFile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(newFile.Name())
+		return err
+	}
+
+	return nil
+}
+
+// verifyDownload checks downloaded file against object's checksum, objects uploaded without one can't be checked
+func verifyDownload(ctx context.Context, s3Client s3Client, bucket string, key string, path string, encryption encryptionOptions) error {
+	err := verifyChecksum(ctx, s3Client, bucket, key, path, withCustomerKeyHead(encryption))
+	if errors.Is(err, errNoChecksum) {
+		slog.Debug(key + " has no checksum, download isn't verified")
+		return nil
+	}
+
+	return err
+}
+
+// printSyncPlan prints an action per line, like "upload        2024/a.txt (size)"
+func printSyncPlan(w io.Writer, actions []syncAction) {
+	for _, action := range actions {
+		fmt.Fprintf(w, "%-13s %s (%s)\n", action.kind, action.rel, action.reason)
+	}
+	fmt.Fprintf(w, "%d actions planned\n", len(actions))
+}
+
+// printSyncResult prints failed actions and how many succeeded
+func printSyncResult(w io.Writer, actions []syncAction, errs []error, duration time.Duration) {
+	done := 0
+	for index, err := range errs {
+		if err != nil {
+			fmt.Fprintln(w, "Failed: "+actions[index].kind+" "+actions[index].rel+": "+err.Error())
+			continue
+		}
+		done++
+	}
+	fmt.Fprintf(w, "Done %d of %d actions in %s\n", done, len(actions), duration.Round(time.Millisecond))
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+type fakeObject struct {
+	body     []byte
+	etag     string
+	metadata map[string]string
+	// encryption the object was uploaded with
+	sse            types.ServerSideEncryption
+	kmsKeyId       string
+	bucketKey      bool
+	customerKeyMD5 string
+	// checksum computed on upload, composite for multipart ones
+	checksumAlgorithm types.ChecksumAlgorithm
+	checksum          string
+}
+
+// fakeBucket keeps objects in memory and serves as client, uploader and downloader, bodies longer than partSize get
+// multipart ETags like manager's uploader produces, listings return pageSize keys per page
+type fakeBucket struct {
+	partSize int64
+	pageSize int
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	// names of mutating calls with their keys, like "Upload reports/a.txt"
+	calls []string
+}
+
+func newFakeBucket() *fakeBucket {
+	return &fakeBucket{partSize: manager.DefaultUploadPartSize, pageSize: 1000, objects: map[string]fakeObject{}}
+}
+
+func (b *fakeBucket) put(key string, body []byte, metadata map[string]string) {
+	b.putObject(key, fakeObject{body: body, metadata: metadata})
+}
+
+func (b *fakeBucket) putObject(key string, object fakeObject) {
+	body := object.body
+	if newHash := newChecksumHash(object.checksumAlgorithm); newHash != nil {
+		object.checksum = fakeDigest(body, b.partSize, newHash, base64.StdEncoding.EncodeToString)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	object.etag = `"` + fakeDigest(body, b.partSize, md5.New, hex.EncodeToString) + `"`
+	if object.sse == types.ServerSideEncryptionAwsKms || object.customerKeyMD5 != "" {
+		// ETag of encrypted object isn't MD5 of content
+		object.etag = `"` + fakeDigest(append([]byte("encrypted "), body...), b.partSize, md5.New, hex.EncodeToString) + `"`
+	}
+	b.objects[key] = object
+}
+
+// fakeDigest is digest of body, or digest of part digests with "-<parts>" if body is longer than partSize
+func fakeDigest(body []byte, partSize int64, newHash func() hash.Hash, encode func([]byte) string) string {
+	if int64(len(body)) <= partSize {
+		whole := newHash()
+		whole.Write(body)
+		return encode(whole.Sum(nil))
+	}
+
+	partDigests := newHash()
+	parts := 0
+	for start := int64(0); start < int64(len(body)); start += partSize {
+		part := newHash()
+		part.Write(body[start:min(start+partSize, int64(len(body)))])
+		partDigests.Write(part.Sum(nil))
+		parts++
+	}
+
+	return fmt.Sprintf("%s-%d", encode(partDigests.Sum(nil)), parts)
+}
+
+// checkCustomerKey fails like S3 does when SSE-C object is read without its key
+func (object fakeObject) checkCustomerKey(keyMD5 *string) error {
+	if object.customerKeyMD5 != "" && aws.ToString(keyMD5) != object.customerKeyMD5 {
+		return &smithy.GenericAPIError{Code: "BadRequest", Message: "customer key is missing or wrong"}
+	}
+
+	return nil
+}
+
+func (b *fakeBucket) ListBuckets(ctx context.Context, params *s3.ListBucketsInput, optFns ...func(*s3.Options)) (*s3.ListBucketsOutput, error) {
+	return &s3.ListBucketsOutput{Buckets: []types.Bucket{{Name: aws.String(defaultBucketName)}}}, nil
+}
+
+func (b *fakeBucket) CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
+	return &s3.CreateBucketOutput{}, nil
+}
+
+func (b *fakeBucket) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	keys := []string{}
+	for key := range b.objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) && key > aws.ToString(params.ContinuationToken) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	output := &s3.ListObjectsV2Output{}
+	if len(keys) > b.pageSize {
+		keys = keys[:b.pageSize]
+		output.IsTruncated = aws.Bool(true)
+		output.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+	for _, key := range keys {
+		object := b.objects[key]
+		output.Contents = append(output.Contents, types.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(object.body))),
+			ETag:         aws.String(object.etag),
+			LastModified: aws.Time(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)),
+		})
+	}
+
+	return output, nil
+}
+
+func (b *fakeBucket) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	object, found := b.objects[aws.ToString(params.Key)]
+	if !found {
+		return nil, &types.NotFound{}
+	}
+	if err := object.checkCustomerKey(params.SSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+
+	output := &s3.HeadObjectOutput{
+		ContentLength:        aws.Int64(int64(len(object.body))),
+		ETag:                 aws.String(object.etag),
+		Metadata:             object.metadata,
+		ServerSideEncryption: object.sse,
+		BucketKeyEnabled:     aws.Bool(object.bucketKey),
+	}
+	if object.kmsKeyId != "" {
+		output.SSEKMSKeyId = aws.String(object.kmsKeyId)
+	}
+	if partNumber := aws.ToInt32(params.PartNumber); partNumber > 0 && int64(len(object.body)) > b.partSize {
+		start := int64(partNumber-1) * b.partSize
+		output.ContentLength = aws.Int64(max(0, min(b.partSize, int64(len(object.body))-start)))
+		output.PartsCount = aws.Int32(int32(partCount(int64(len(object.body)), b.partSize)))
+	}
+	if params.ChecksumMode == types.ChecksumModeEnabled {
+		switch object.checksumAlgorithm {
+		case types.ChecksumAlgorithmSha256:
+			output.ChecksumSHA256 = aws.String(object.checksum)
+		case types.ChecksumAlgorithmCrc32c:
+			output.ChecksumCRC32C = aws.String(object.checksum)
+		}
+	}
+	if object.customerKeyMD5 != "" {
+		output.SSECustomerAlgorithm = aws.String("AES256")
+		output.SSECustomerKeyMD5 = aws.String(object.customerKeyMD5)
+	}
+	return output, nil
+}
+
+func (b *fakeBucket) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.objects, aws.ToString(params.Key))
+	b.calls = append(b.calls, "DeleteObject "+aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (b *fakeBucket) Upload(ctx context.Context, input *s3.PutObjectInput, opts ...func(*manager.Uploader)) (*manager.UploadOutput, error) {
+	body, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	object := fakeObject{
+		body:           body,
+		metadata:       input.Metadata,
+		sse:            input.ServerSideEncryption,
+		bucketKey:      aws.ToBool(input.BucketKeyEnabled),
+		customerKeyMD5: aws.ToString(input.SSECustomerKeyMD5),
+
+		checksumAlgorithm: input.ChecksumAlgorithm,
+	}
+	if object.sse == types.ServerSideEncryptionAwsKms {
+		object.kmsKeyId = "arn:aws:kms:eu-central-1:123456789012:key/" + aws.ToString(input.SSEKMSKeyId)
+	}
+	b.putObject(aws.ToString(input.Key), object)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls = append(b.calls, "Upload "+aws.ToString(input.Key))
+	return &manager.UploadOutput{Key: input.Key}, nil
+}
+
+func (b *fakeBucket) Download(ctx context.Context, w io.WriterAt, input *s3.GetObjectInput, options ...func(*manager.Downloader)) (int64, error) {
+	b.mu.Lock()
+	object, found := b.objects[aws.ToString(input.Key)]
+	b.calls = append(b.calls, "Download "+aws.ToString(input.Key))
+	b.mu.Unlock()
+	if !found {
+		return 0, &types.NoSuchKey{}
+	}
+	if err := object.checkCustomerKey(input.SSECustomerKeyMD5); err != nil {
+		return 0, err
+	}
+
+	n, err := w.WriteAt(object.body, 0)
+	return int64(n), err
+}
+
+func (b *fakeBucket) sortedCalls() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	calls := slices.Clone(b.calls)
+	sort.Strings(calls)
+	b.calls = nil
+	return calls
+}
+
+func syncTestOptions(dir string, direction string) syncOptions {
+	return syncOptions{dir: dir, bucket: defaultBucketName, prefix: "reports", direction: direction, compare: compareChecksum, concurrency: 2}
+}
+
+func runSync(t *testing.T, bucket *fakeBucket, opts syncOptions) []syncAction {
+	actions, err := planSync(context.TODO(), bucket, opts)
+	if err != nil {
+		t.Fatal("Error planning sync: " + err.Error())
+	}
+	errs := applySync(context.TODO(), bucket, bucket, bucket, opts, actions)
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal("Error applying sync: " + err.Error())
+	}
+
+	return actions
+}
+
+func TestSyncUp(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, "a.txt", "nested/b.txt", "nested/c.txt")
+	bucket := newFakeBucket()
+	bucket.put("reports/nested/b.txt", []byte("nested/b.txt"), nil)
+	bucket.put("reports/nested/c.txt", []byte("nested/X.txt"), nil)
+	bucket.put("reports/stale.txt", []byte("stale"), nil)
+	bucket.put("other/keep.txt", []byte("keep"), nil)
+
+	opts := syncTestOptions(dir, syncUp)
+	opts.delete = true
+	actions := runSync(t, bucket, opts)
+
+	planned := []string{}
+	for _, action := range actions {
+		planned = append(planned, action.kind+" "+action.rel+" "+action.reason)
+	}
+	expected := []string{"upload a.txt new", "upload nested/c.txt checksum", "delete-remote stale.txt missing locally"}
+	if !slices.Equal(planned, expected) {
+		t.Errorf("planned %v, expected %v", planned, expected)
+	}
+	calls := bucket.sortedCalls()
+	if !slices.Equal(calls, []string{"DeleteObject reports/stale.txt", "Upload reports/a.txt", "Upload reports/nested/c.txt"}) {
+		t.Errorf("calls are %v", calls)
+	}
+
+	again := runSync(t, bucket, opts)
+	if len(again) != 0 {
+		t.Errorf("second sync should have nothing to do, planned %v", again)
+	}
+	if _, found := bucket.objects["other/keep.txt"]; !found {
+		t.Error("objects outside prefix shouldn't be touched")
+	}
+}
+
+func TestSyncDown(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, "a.txt", "local-only.txt")
+	bucket := newFakeBucket()
+	bucket.put("reports/a.txt", []byte("a.txt"), nil)
+	bucket.put("reports/nested/b.txt", []byte("remote b"), nil)
+
+	opts := syncTestOptions(dir, syncDown)
+	opts.delete = true
+	runSync(t, bucket, opts)
+
+	content, err := os.ReadFile(filepath.Join(dir, "nested", "b.txt"))
+	if err != nil || string(content) != "remote b" {
+		t.Errorf("nested/b.txt should be downloaded, content %q (%v)", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "local-only.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("local-only.txt should be deleted")
+	}
+	calls := bucket.sortedCalls()
+	if !slices.Equal(calls, []string{"Download reports/nested/b.txt"}) {
+		t.Errorf("only missing file should be downloaded, calls are %v", calls)
+	}
+}
+
+func TestListRemotePages(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.pageSize = 2
+	for i := range 5 {
+		bucket.put(fmt.Sprintf("reports/2024/%d.txt", i), []byte("x"), nil)
+	}
+	bucket.put("reports/2024/", nil, nil)
+	bucket.put("reports/2023/old.txt", []byte("x"), nil)
+
+	objects, err := listRemote(context.TODO(), bucket, defaultBucketName, "reports/2024")
+	if err != nil {
+		t.Fatal("Error listing objects: " + err.Error())
+	}
+	if len(objects) != 5 {
+		t.Errorf("expected 5 objects from 3 pages without folder placeholder, got %v", objects)
+	}
+	if objects["4.txt"].key != "reports/2024/4.txt" {
+		t.Errorf("object on the last page is %+v", objects["4.txt"])
+	}
+}
+
+func TestDownloadPrefix(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "out")
+	makeTree(t, dest, "january/a.txt")
+	bucket := newFakeBucket()
+	bucket.put("reports/2024/january/a.txt", []byte("january/a.txt"), nil)
+	bucket.put("reports/2024/january/b.txt", []byte("january b"), nil)
+	bucket.put("reports/2024/february/deep/c.txt", []byte("february c"), nil)
+	bucket.put("reports/2024/../../escape.txt", []byte("escape"), nil)
+	bucket.put("reports/2023/old.txt", []byte("old"), nil)
+
+	opts := syncOptions{dir: dest, bucket: defaultBucketName, prefix: "reports/2024/", direction: syncDown, compare: compareChecksum, concurrency: 3}
+	actions, err := planSync(context.TODO(), bucket, opts)
+	if err != nil {
+		t.Fatal("Error planning download: " + err.Error())
+	}
+	errs := applySync(context.TODO(), bucket, bucket, bucket, opts, actions)
+
+	failed := []string{}
+	for index, err := range errs {
+		if err != nil {
+			failed = append(failed, actions[index].key)
+		}
+	}
+	if !slices.Equal(failed, []string{"reports/2024/../../escape.txt"}) {
+		t.Errorf("only key with .. should fail, failed are %v", failed)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dest), "escape.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("key with .. shouldn't be written outside of destination")
+	}
+
+	for rel, expected := range map[string]string{"january/b.txt": "january b", "february/deep/c.txt": "february c"} {
+		content, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(rel)))
+		if err != nil || string(content) != expected {
+			t.Errorf("%s has content %q (%v), expected %q", rel, content, err, expected)
+		}
+	}
+	calls := bucket.sortedCalls()
+	if !slices.Equal(calls, []string{"Download reports/2024/february/deep/c.txt", "Download reports/2024/january/b.txt"}) {
+		t.Errorf("matching file and other prefixes shouldn't be downloaded, calls are %v", calls)
+	}
+}
+
+func TestSyncMtime(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, "a.txt")
+	bucket := newFakeBucket()
+	opts := syncTestOptions(dir, syncUp)
+	opts.compare = compareMtime
+	runSync(t, bucket, opts)
+	bucket.sortedCalls()
+
+	// same size and content, only mtime differs
+	later := time.Now().Add(time.Hour)
+	err := os.Chtimes(filepath.Join(dir, "a.txt"), later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := runSync(t, bucket, opts)
+	if len(actions) != 1 || actions[0].reason != "mtime" {
+		t.Errorf("touched file should be uploaded for its mtime, planned %v", actions)
+	}
+
+	// downloaded file gets mtime of metadata, so syncing back finds nothing to do
+	downDir := t.TempDir()
+	downOpts := syncTestOptions(downDir, syncDown)
+	downOpts.compare = compareMtime
+	runSync(t, bucket, downOpts)
+	info, err := os.Stat(filepath.Join(downDir, "a.txt"))
+	if err != nil || !info.ModTime().Equal(later) {
+		t.Errorf("downloaded file should have mtime %v, got %v (%v)", later, info, err)
+	}
+	if again := runSync(t, bucket, downOpts); len(again) != 0 {
+		t.Errorf("nothing should change, planned %v", again)
+	}
+}
+
+func TestMatchesETagMultipart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "big.bin")
+	body := bytes.Repeat([]byte("0123456789abcdef"), 800*1024)
+	err := os.WriteFile(path, body, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, partSize := range []int64{manager.DefaultUploadPartSize, 6 * 1024 * 1024, 8 * 1024 * 1024} {
+		bucket := newFakeBucket()
+		bucket.partSize = partSize
+		bucket.put("big.bin", body, nil)
+		etag := bucket.objects["big.bin"].etag
+		if !strings.Contains(etag, "-") {
+			t.Fatalf("etag %s isn't multipart", etag)
+		}
+
+		matches, err := matchesETag(path, int64(len(body)), etag, partSize)
+		if err != nil || !matches {
+			t.Errorf("file should match multipart etag %s of %d byte parts (%v)", etag, partSize, err)
+		}
+	}
+
+	sum := md5.Sum(body)
+	matches, err := matchesETag(path, int64(len(body)), `"`+hex.EncodeToString(sum[:])+`"`, 0)
+	if err != nil || !matches {
+		t.Errorf("file should match its MD5 etag (%v)", err)
+	}
+	matches, _ = matchesETag(path, int64(len(body)), `"0123456789abcdef0123456789abcdef-3"`, 5*1024*1024)
+	if matches {
+		t.Error("file shouldn't match other multipart etag")
+	}
+	_, err = matchesETag(path, int64(len(body)), `"0123456789abcdef0123456789abcdef-3"`, 0)
+	if !errors.Is(err, errNoChecksum) {
+		t.Errorf("multipart etag without part size can't be checked, err is %v", err)
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	for _, rel := range []string{"../a.txt", "a/../../b.txt", "/etc/passwd", "", `..\a.txt`, `a\..\..\b.txt`, "C:/Windows/a.txt", "C:a.txt", "a.txt:stream"} {
+		if _, err := localPath("downloads", rel); err == nil {
+			t.Errorf("key %q should be refused", rel)
+		}
+	}
+
+	path, err := localPath("downloads", "2024/a.txt")
+	if err != nil || path != filepath.Join("downloads", "2024", "a.txt") {
+		t.Errorf("path is %s (%v)", path, err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// rootContext is cancelled on SIGINT/SIGTERM or when timeout passes, 0 means no timeout,
+// once it's cancelled signals are let through again, so a second Ctrl-C kills the tool
+func rootContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
+
+	if timeout <= 0 {
+		return ctx, stop
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// withCallTimeout bounds every single API call, retries included, overall deadline comes from the root context.
+// GetObject is left alone, its body is read after the call returns and cancelling it would cut the download
+func withCallTimeout(timeout time.Duration) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("CallTimeout", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			if _, isGetObject := in.Parameters.(*s3.GetObjectInput); isGetObject {
+				return next.HandleInitialize(ctx, in)
+			}
+
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			return next.HandleInitialize(ctx, in)
+		}), middleware.Before)
+	}
+}
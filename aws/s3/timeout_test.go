@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// blockingS3Uploader never finishes an upload by itself, only cancellation ends it
+type blockingS3Uploader struct{}
+
+func (m *blockingS3Uploader) Upload(ctx context.Context, input *s3.PutObjectInput, opts ...func(*manager.Uploader)) (*manager.UploadOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+type blockingS3Downloader struct{}
+
+func (m *blockingS3Downloader) Download(ctx context.Context, w io.WriterAt, input *s3.GetObjectInput, options ...func(*manager.Downloader)) (n int64, err error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestUploadFilesCancelled(t *testing.T) {
+	ctx, cancel := rootContext(50 * time.Millisecond)
+	defer cancel()
+
+	_, err := uploadFiles(ctx, &blockingS3Uploader{}, defaultBucketName, "reports/report.txt", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err is %v, expected deadline exceeded", err)
+	}
+}
+
+func TestDownloadFileCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := downloadFile(ctx, &blockingS3Downloader{}, nil, defaultBucketName, "reports/report.txt")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err is %v, expected context canceled", err)
+	}
+}
+
+func TestPrintInterrupted(t *testing.T) {
+	var out bytes.Buffer
+	printInterrupted(&out, context.Canceled, []string{"a.txt"}, []string{"a.txt", "b.txt", "c.txt"})
+
+	expected := "Interrupted: context canceled\nFinished: a.txt\nAborted: b.txt, c.txt\n"
+	if out.String() != expected {
+		t.Errorf("output is %q, expected %q", out.String(), expected)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// localFile is a file to upload, rel is its path relative to the source dir
+type localFile struct {
+	path string
+	rel  string
+}
+
+// collectFiles lists regular files under root, symlinks are followed or skipped, links leading back to a directory
+// being walked are skipped in any case
+func collectFiles(root string, followSymlinks bool) ([]localFile, error) {
+	files := []localFile{}
+	err := walkFiles(root, "", followSymlinks, []string{}, &files)
+
+	return files, err
+}
+
+// walkFiles walks real path of dir, its files get relDir prefix, walking are real paths of directories entered so far
+func walkFiles(dir string, relDir string, followSymlinks bool, walking []string, files *[]localFile) error {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	walking = append(walking, realDir)
+
+	return filepath.WalkDir(realDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(realDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.Join(relDir, rel)
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			if !followSymlinks {
+				slog.Info("Skipping symlink " + rel)
+				return nil
+			}
+
+			target, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				slog.Warn("Skipping broken symlink " + rel + ": " + err.Error())
+				return nil
+			}
+			info, err := os.Stat(target)
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				*files = append(*files, localFile{path: path, rel: rel})
+				return nil
+			}
+			if isWithin(filepath.Dir(path), target) || containsDir(walking, target) {
+				slog.Warn("Skipping symlink " + rel + ", it leads back to " + target)
+				return nil
+			}
+
+			return walkFiles(target, rel, followSymlinks, walking, files)
+		}
+
+		if d.Type().IsRegular() {
+			*files = append(*files, localFile{path: path, rel: rel})
+		}
+
+		return nil
+	})
+}
+
+// isWithin tells if path is dir itself or inside it
+func isWithin(path string, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+func containsDir(dirs []string, target string) bool {
+	for _, dir := range dirs {
+		if isWithin(dir, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// objectKey joins prefix and relative file path with slashes, whatever the OS separator is
+func objectKey(prefix string, rel string) string {
+	key := filepath.ToSlash(rel)
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return key
+	}
+
+	return prefix + "/" + key
+}
+
+// uploadResult is outcome of a single file upload
+type uploadResult struct {
+	file  localFile
+	key   string
+	bytes int64
+	err   error
+}
+
+// uploadAll uploads files with concurrency workers, results are in order of files
+func uploadAll(ctx context.Context, s3Uploader s3Uploader, bucket string, prefix string, files []localFile, concurrency int, headers uploadHeaders, optFns ...func(*s3.PutObjectInput)) []uploadResult {
+	results := make([]uploadResult, len(files))
+	parallel(concurrency, len(files), func(index int) {
+		results[index] = uploadOne(ctx, s3Uploader, bucket, objectKey(prefix, files[index].rel), files[index], headers, optFns...)
+	})
+
+	return results
+}
+
+// parallel calls fn for every index below count, at most concurrency calls at once
+func parallel(concurrency int, count int, fn func(index int)) {
+	indexes := make(chan int)
+
+	wg := sync.WaitGroup{}
+	for range max(concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				fn(index)
+			}
+		}()
+	}
+
+	for index := range count {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// uploadOne uploads file, it's closed as soon as it's uploaded, files left after cancellation aren't opened at all,
+// content type is detected and headers of matching rules are set before optFns
+func uploadOne(ctx context.Context, s3Uploader s3Uploader, bucket string, key string, file localFile, headers uploadHeaders, optFns ...func(*s3.PutObjectInput)) uploadResult {
+	result := uploadResult{file: file, key: key}
+	if ctx.Err() != nil {
+		result.err = context.Cause(ctx)
+		return result
+	}
+
+	readFile, err := os.Open(file.path)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer readFile.Close()
+
+	info, err := readFile.Stat()
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	contentType, err := detectContentType(file.rel, readFile)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	fileFns := []func(*s3.PutObjectInput){withContentType(contentType), headers.forFile(file.rel), withMtime(info.ModTime())}
+	_, err = uploadFiles(ctx, s3Uploader, bucket, key, readFile, append(fileFns, optFns...)...)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	slog.Debug(file.rel + " file uploaded as: " + key)
+	result.bytes = info.Size()
+
+	return result
+}
+
+// withMtime keeps file modification time in object metadata, sync compares it with -compare mtime
+func withMtime(mtime time.Time) func(*s3.PutObjectInput) {
+	return func(input *s3.PutObjectInput) {
+		if input.Metadata == nil {
+			input.Metadata = map[string]string{}
+		}
+		input.Metadata[mtimeMetadataKey] = mtime.UTC().Format(time.RFC3339Nano)
+	}
+}
+
+// printUploadSummary prints failed files and totals of uploaded ones
+func printUploadSummary(w io.Writer, results []uploadResult, duration time.Duration) {
+	uploaded := 0
+	var bytes int64
+	for _, result := range results {
+		if result.err != nil {
+			fmt.Fprintln(w, "Failed: "+result.file.rel+": "+result.err.Error())
+			continue
+		}
+		uploaded++
+		bytes += result.bytes
+	}
+
+	throughput := 0.0
+	if duration > 0 {
+		throughput = float64(bytes) / duration.Seconds()
+	}
+	fmt.Fprintf(w, "Uploaded %d of %d files, %s in %s, %s/s\n", uploaded, len(results), formatBytes(bytes), duration.Round(time.Millisecond), formatBytes(int64(throughput)))
+}
+
+// formatBytes prints size in binary units, like 1.5 MiB
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// makeTree creates files under root, keyed by slash separated relative path
+func makeTree(t *testing.T, root string, files ...string) {
+	for _, file := range files {
+		path := filepath.Join(root, filepath.FromSlash(file))
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(file), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func collectedKeys(t *testing.T, root string, followSymlinks bool) []string {
+	files, err := collectFiles(root, followSymlinks)
+	if err != nil {
+		t.Fatal("Error collecting files: " + err.Error())
+	}
+
+	keys := []string{}
+	for _, file := range files {
+		_, err := os.ReadFile(file.path)
+		if err != nil {
+			t.Fatal("Error reading collected file: " + err.Error())
+		}
+		keys = append(keys, objectKey("reports", file.rel))
+	}
+	slices.Sort(keys)
+
+	return keys
+}
+
+func TestCollectFilesNested(t *testing.T) {
+	root := t.TempDir()
+	makeTree(t, root, "a.txt", "2024/01/b.txt", "2024/02/c.txt")
+
+	keys := collectedKeys(t, root, false)
+	expected := []string{"reports/2024/01/b.txt", "reports/2024/02/c.txt", "reports/a.txt"}
+	if !slices.Equal(keys, expected) {
+		t.Errorf("keys are %v, expected %v", keys, expected)
+	}
+}
+
+func TestCollectFilesSymlinks(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	makeTree(t, root, "a.txt")
+	makeTree(t, outside, "shared/d.txt", "e.txt")
+
+	for link, target := range map[string]string{
+		"linked-dir": filepath.Join(outside, "shared"),
+		"linked.txt": filepath.Join(outside, "e.txt"),
+		"loop":       root,
+		"broken.txt": filepath.Join(outside, "missing.txt"),
+	} {
+		err := os.Symlink(target, filepath.Join(root, link))
+		if err != nil {
+			t.Skip("symlinks aren't supported: " + err.Error())
+		}
+	}
+
+	skipped := collectedKeys(t, root, false)
+	if !slices.Equal(skipped, []string{"reports/a.txt"}) {
+		t.Errorf("symlinks should be skipped, keys are %v", skipped)
+	}
+
+	followed := collectedKeys(t, root, true)
+	expected := []string{"reports/a.txt", "reports/linked-dir/d.txt", "reports/linked.txt"}
+	if !slices.Equal(followed, expected) {
+		t.Errorf("keys are %v, expected %v", followed, expected)
+	}
+}
+
+func TestObjectKey(t *testing.T) {
+	cases := []struct {
+		prefix   string
+		rel      string
+		expected string
+	}{
+		{"reports", "a.txt", "reports/a.txt"},
+		{"reports/", filepath.Join("2024", "a.txt"), "reports/2024/a.txt"},
+		{"/reports/daily/", "a.txt", "reports/daily/a.txt"},
+		{"", filepath.Join("2024", "a.txt"), "2024/a.txt"},
+	}
+
+	for _, c := range cases {
+		if key := objectKey(c.prefix, c.rel); key != c.expected {
+			t.Errorf("objectKey(%q, %q) is %q, expected %q", c.prefix, c.rel, key, c.expected)
+		}
+	}
+}
+
+// slowS3Uploader takes latency per upload, fails keys listed in failures and counts uploads in flight
+type slowS3Uploader struct {
+	latency  time.Duration
+	failures map[string]error
+
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+	keys        []string
+}
+
+func (m *slowS3Uploader) Upload(ctx context.Context, input *s3.PutObjectInput, opts ...func(*manager.Uploader)) (*manager.UploadOutput, error) {
+	m.mu.Lock()
+	m.inFlight++
+	m.maxInFlight = max(m.maxInFlight, m.inFlight)
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.inFlight--
+		m.mu.Unlock()
+	}()
+
+	select {
+	case <-time.After(m.latency):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	_, err := io.Copy(io.Discard, input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	key := aws.ToString(input.Key)
+	if err := m.failures[key]; err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.keys = append(m.keys, key)
+	m.mu.Unlock()
+
+	return &manager.UploadOutput{Key: input.Key}, nil
+}
+
+func TestUploadAll(t *testing.T) {
+	root := t.TempDir()
+	names := []string{}
+	for i := range 10 {
+		names = append(names, fmt.Sprintf("dir%d/file%d.txt", i%3, i))
+	}
+	makeTree(t, root, names...)
+	files, err := collectFiles(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploader := &slowS3Uploader{
+		latency:  20 * time.Millisecond,
+		failures: map[string]error{"reports/dir1/file4.txt": errors.New("access denied")},
+	}
+	results := uploadAll(context.TODO(), uploader, defaultBucketName, "reports", files, 3, uploadHeaders{})
+
+	if uploader.maxInFlight != 3 {
+		t.Errorf("%d uploads ran at once, expected 3", uploader.maxInFlight)
+	}
+	if len(results) != len(files) || len(uploader.keys) != 9 {
+		t.Fatalf("%d results and %d uploads, expected %d results and 9 uploads", len(results), len(uploader.keys), len(files))
+	}
+	for index, result := range results {
+		if result.file != files[index] {
+			t.Errorf("result %d is for %s, expected %s", index, result.file.rel, files[index].rel)
+		}
+		failed := result.key == "reports/dir1/file4.txt"
+		if failed != (result.err != nil) {
+			t.Errorf("result of %s has error %v", result.key, result.err)
+		}
+		if !failed && result.bytes != int64(len(filepath.ToSlash(result.file.rel))) {
+			t.Errorf("%s has %d bytes uploaded", result.key, result.bytes)
+		}
+	}
+}
+
+func TestUploadAllCancelled(t *testing.T) {
+	root := t.TempDir()
+	makeTree(t, root, "a.txt", "b.txt", "c.txt", "d.txt")
+	files, err := collectFiles(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	uploader := &slowS3Uploader{latency: time.Hour}
+	results := uploadAll(ctx, uploader, defaultBucketName, "reports", files, 2, uploadHeaders{})
+
+	for _, result := range results {
+		if !errors.Is(result.err, context.DeadlineExceeded) {
+			t.Errorf("%s has error %v, expected deadline exceeded", result.file.rel, result.err)
+		}
+	}
+}
+
+func TestPrintUploadSummary(t *testing.T) {
+	var out bytes.Buffer
+	printUploadSummary(&out, []uploadResult{
+		{file: localFile{rel: "a.txt"}, bytes: 2048},
+		{file: localFile{rel: "b.txt"}, err: errors.New("access denied")},
+		{file: localFile{rel: "c.txt"}, bytes: 1024},
+	}, 2*time.Second)
+
+	expected := "Failed: b.txt: access denied\nUploaded 2 of 3 files, 3.0 KiB in 2s, 1.5 KiB/s\n"
+	if out.String() != expected {
+		t.Errorf("output is %q, expected %q", out.String(), expected)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for bytes, expected := range map[int64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KiB", 5 << 30: "5.0 GiB"} {
+		if formatted := formatBytes(bytes); formatted != expected {
+			t.Errorf("formatBytes(%d) is %q, expected %q", bytes, formatted, expected)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+// verifyResult is outcome of checking one local file against its object
+type verifyResult struct {
+	rel string
+	key string
+	err error
+}
+
+// status is short text of the outcome for the report
+func (r verifyResult) status() string {
+	var notFound *objectNotFoundError
+	switch {
+	case r.err == nil:
+		return "ok"
+	case errors.Is(r.err, errChecksumMismatch):
+		return "mismatch"
+	case errors.Is(r.err, errNoChecksum):
+		return "no checksum"
+	case errors.As(r.err, &notFound):
+		return "missing"
+	}
+
+	return "error"
+}
+
+// verifyFiles compares checksums of local files with ones of objects under prefix, content isn't downloaded
+func verifyFiles(ctx context.Context, s3Client s3Client, bucket string, prefix string, files []localFile, encryption encryptionOptions, concurrency int) []verifyResult {
+	results := make([]verifyResult, len(files))
+	parallel(concurrency, len(files), func(index int) {
+		file := files[index]
+		result := verifyResult{rel: filepath.ToSlash(file.rel), key: objectKey(prefix, file.rel)}
+		if ctx.Err() != nil {
+			result.err = context.Cause(ctx)
+		} else {
+			result.err = verifyChecksum(ctx, s3Client, bucket, result.key, file.path, withCustomerKeyHead(encryption))
+		}
+		results[index] = result
+	})
+
+	return results
+}
+
+func printVerifyResults(w io.Writer, results []verifyResult) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tSTATUS\tDETAILS")
+	verified := 0
+	for _, result := range results {
+		details := "-"
+		if result.err != nil {
+			details = result.err.Error()
+		} else {
+			verified++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", result.rel, result.status(), details)
+	}
+	err := tw.Flush()
+	fmt.Fprintf(w, "Verified %d of %d files\n", verified, len(results))
+
+	return err
+}